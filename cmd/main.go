@@ -7,51 +7,190 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"text/template"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jeks313/go-mongo-slow-queries/internal/mongoslow"
+	"github.com/jeks313/go-mongo-slow-queries/pkg/health"
 	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
 	"github.com/jeks313/go-mongo-slow-queries/pkg/server"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
 )
 
 // MongoOpts is all the mongo specific connection options
 type MongoOpts struct {
-	User string `long:"mongo-user" env:"MONGO_USER" default:"" description:"mongo user name"`
-	Pass string `long:"mongo-pass" env:"MONGO_PASS" default:"" description:"mongo password"`
-	Host string `long:"mongo-host" env:"MONGO_HOST" default:"" description:"mongo hostname"`
-	Port int32  `long:"mongo-port" env:"MONGO_PORT" default:"27017" description:"mongo port"`
-	URI  string `long:"mongo-uri" env:"MONGO_URI" default:"" description:"instead of user,pass,host,port, pass a mongo URI to use directly"`
+	User     string        `long:"mongo-user" env:"MONGO_USER" default:"" description:"mongo user name"`
+	Pass     string        `long:"mongo-pass" env:"MONGO_PASS" default:"" secret:"true" description:"mongo password"`
+	Host     string        `long:"mongo-host" env:"MONGO_HOST" default:"" description:"mongo hostname"`
+	Port     int32         `long:"mongo-port" env:"MONGO_PORT" default:"27017" description:"mongo port"`
+	URI      string        `long:"mongo-uri" env:"MONGO_URI" default:"" description:"instead of user,pass,host,port, pass a mongo URI to use directly"`
+	Replay   string        `long:"replay-file" env:"REPLAY_FILE" default:"" description:"replay recorded currentOp responses from a json or bson file instead of connecting to mongo"`
+	Proxy    string        `long:"mongo-proxy" env:"MONGO_PROXY" default:"" description:"dial mongo through a proxy, e.g. socks5://host:port (ssh -D tunnel) or http://host:port"`
+	Provider string        `long:"provider" env:"PROVIDER" default:"mongodb" choice:"mongodb" choice:"documentdb" choice:"cosmos" description:"currentOp document shape to parse, mongodb, documentdb (Amazon DocumentDB) or cosmos (Azure Cosmos DB)"`
+	DB       string        `long:"monitor-db" env:"MONITOR_DB" default:"admin" description:"database to run currentOp and killOp against, for services that don't expose admin"`
+	AppName  string        `long:"mongo-appname" env:"MONGO_APPNAME" default:"go-mongo-slow-queries" description:"appName the monitor connects with, so its connections can be spotted in currentOp and the server logs, empty to keep the one from the uri"`
+	Retries  int           `long:"mongo-connect-retries" env:"MONGO_CONNECT_RETRIES" default:"3" description:"retry connecting this many times at startup if mongo isn't up yet, 0 to fail straight away"`
+	Backoff  time.Duration `long:"mongo-connect-backoff" env:"MONGO_CONNECT_BACKOFF" default:"1s" description:"wait before the first connect retry, doubled for each retry after"`
+	Compress []string      `long:"mongo-compressors" env:"MONGO_COMPRESSORS" env-delim:"," description:"comma separated wire compressors to negotiate with mongo in order of preference, snappy, zlib or zstd, to cut cross region transfer"`
 }
 
-var opts struct {
-	Port        int                        `long:"port" env:"PORT" default:"8172" description:"port number to listen on"`
-	Application options.ApplicationOptions `group:"Default Application Options"`
-	Mongo       MongoOpts                  `group:"Mongo Connection Options"`
+// MonitorOpts is the options controlling how currentOp results are turned into metrics
+type MonitorOpts struct {
+	MinDeltaMicros   int64         `long:"min-delta-micros" env:"MIN_DELTA_MICROS" default:"10000" description:"skip running query deltas smaller than this, in microseconds"`
+	MinObserveMicros int64         `long:"min-observe-micros" env:"MIN_OBSERVE_MICROS" default:"500000" description:"only add completed queries slower than this to the histogram, in microseconds"`
+	MaxQueries       int           `long:"max-queries-per-poll" env:"MAX_QUERIES_PER_POLL" default:"0" description:"only process the longest running N queries each poll, the rest are counted in mongo_queries_skipped_total, 0 for all"`
+	MaxTrackedOpIDs  int           `long:"tracked-opids-warn" env:"TRACKED_OPIDS_WARN" default:"10000" description:"log a warning when more than this many running queries are tracked, a sign of a leak, 0 to never warn"`
+	CommandTimeout   time.Duration `long:"command-timeout" env:"COMMAND_TIMEOUT" default:"5s" description:"give up on a currentOp poll that takes longer than this and try again on the next interval"`
+	HistogramBuckets string        `long:"histogram-buckets" env:"HISTOGRAM_BUCKETS" default:"" description:"comma separated completed query histogram buckets in seconds, e.g. 0.1,0.5,1,5"`
+	SplitHistograms  bool          `long:"split-histograms-by-op" env:"SPLIT_HISTOGRAMS_BY_OP" description:"also emit a completed query histogram per operation type, e.g. mongo_slow_query_update_secs"`
+	Labels           []string      `long:"metric-labels" env:"METRIC_LABELS" env-delim:"," default:"user" default:"operation" default:"ns" description:"labels to attach to the slow query metrics, drop some to bound the series count (user, operation, ns)"`
+	MaxHistoryBytes  int           `long:"max-history-command-bytes" env:"MAX_HISTORY_COMMAND_BYTES" default:"0" description:"truncate the command of queries kept in the history to this many bytes and drop their raw currentOp document if bigger, bounding the history memory, 0 to keep them whole"`
+	MaxCommandLength int           `long:"max-command-length" env:"MAX_COMMAND_LENGTH" default:"4096" description:"truncate the command shown for each query to this many bytes, 0 for no limit"`
+	UserTrimRegex    string        `long:"user-trim-regex" env:"USER_TRIM_REGEX" default:"-[^-]*$" description:"regex matching the random suffix to strip from user names, the default strips from the last hyphen, e.g. use '-[0-9a-f]{12}$' to keep hyphenated names"`
+	LegacyMsMetric   bool          `long:"legacy-ms-metric" env:"LEGACY_MS_METRIC" description:"also emit the deprecated mongo_slow_query_ms counter, replaced by mongo_slow_query_seconds_total, it will be removed in the next release"`
+	IncludeSelf      bool          `long:"include-self" env:"INCLUDE_SELF" description:"also emit metrics for the monitor's own operations, matched by --mongo-appname, they are left out by default"`
+	YieldsMetric     bool          `long:"yields-metric" env:"YIELDS_METRIC" description:"also emit mongo_running_query_yields, the numYields of the running queries, to spot queries yielding excessively"`
+	IdleCursors      bool          `long:"include-idle-cursors" env:"INCLUDE_IDLE_CURSORS" description:"also fetch idle cursors with $currentOp, listed on /idle.json and kept out of the slow query metrics"`
+	IdleSessions     bool          `long:"include-idle-sessions" env:"INCLUDE_IDLE_SESSIONS" description:"also fetch idle sessions with $currentOp, listed on /idle.json and kept out of the slow query metrics"`
+	MetricNamespaces []string      `long:"namespace-metric-whitelist" env:"NAMESPACE_METRIC_WHITELIST" env-delim:"," description:"comma separated namespace globs that produce metrics, e.g. 'orders.*', the rest are still shown on /running, default all"`
+	KillComment      string        `long:"kill-comment" env:"KILL_COMMENT" default:"killed by go-mongo-slow-queries: {{.Reason}}" description:"template for the comment attached to killOp commands, recorded in mongo's logs, with {{.OperationID}} and {{.Reason}}"`
+	NamespaceRules   []string      `long:"ns-normalize" env:"NS_NORMALIZE" env-delim:";" description:"regex=replacement rewrite of the ns metric label, e.g. '_\\d{4}_\\d{2}$=' to strip date suffixes, repeat for more rules"`
+}
+
+// Options is all the command line options
+type Options struct {
+	Port          int                        `long:"port" env:"PORT" default:"8172" description:"port number to listen on"`
+	Application   options.ApplicationOptions `group:"Default Application Options"`
+	Check         bool                       `long:"check" description:"connect, run one currentOp, giving up after --command-timeout, and report what the monitoring user can see, then exit"`
+	PprofUser     string                     `long:"pprof-user" env:"PPROF_USER" default:"" description:"require this basic auth user for the /debug endpoints, /pause and /resume"`
+	PprofPass     string                     `long:"pprof-pass" env:"PPROF_PASS" default:"" secret:"true" description:"require this basic auth password for the /debug endpoints, /pause and /resume"`
+	HealthGrace   time.Duration              `long:"health-startup-grace" env:"HEALTH_STARTUP_GRACE" default:"0s" description:"dependencies not yet checked this soon after starting are reported as starting instead of failing /health"`
+	HealthFail    bool                       `long:"health-fail-unhealthy" env:"HEALTH_FAIL_UNHEALTHY" description:"answer /health with 503 when a dependency is unhealthy instead of 200, the state in the body is unhealthy either way"`
+	HealthReset   bool                       `long:"health-reset-stats" env:"HEALTH_RESET_STATS" description:"serve POST /health/reset-stats to zero the health check counters"`
+	HealthLogs    int                        `long:"health-recent-errors" env:"HEALTH_RECENT_ERRORS" default:"0" description:"include the last N error log lines under recent_errors in the /health response, 0 to leave them out"`
+	HealthMinDisk uint64                     `long:"health-min-free-disk" env:"HEALTH_MIN_FREE_DISK" default:"104857600" description:"fail /health when the disk the slow log or history file is written to has fewer bytes free"`
+	NoOpenMetrics bool                       `long:"disable-openmetrics" env:"DISABLE_OPENMETRICS" description:"always serve /metrics in the prometheus text format, even to scrapers asking for OpenMetrics"`
+	SlowLogFile   string                     `long:"slowlog-file" env:"SLOWLOG_FILE" default:"" description:"also append every query entering the history to this file as newline delimited JSON, for offline analysis"`
+	SlowLogSize   int64                      `long:"slowlog-max-size" env:"SLOWLOG_MAX_SIZE" default:"104857600" description:"rotate the slow log file to <file>.1 when it grows past this many bytes, 0 to never rotate"`
+	HistoryFile   string                     `long:"history-persist-path" env:"HISTORY_PERSIST_PATH" default:"" description:"save the history to this file periodically and on shutdown, and restore it on startup"`
+	HistorySave   time.Duration              `long:"history-persist-interval" env:"HISTORY_PERSIST_INTERVAL" default:"1m" description:"how often to save the history to --history-persist-path"`
+	TemplateFile  string                     `long:"template-file" env:"TEMPLATE_FILE" default:"" description:"html template to use for the /running and /history tables instead of the built in one, executed with the queries as a JSON array"`
+	HTTP          options.HTTPOptions        `group:"HTTP Server Options"`
+	Mongo         MongoOpts                  `group:"Mongo Connection Options"`
+	Monitor       MonitorOpts                `group:"Monitoring Options"`
+}
+
+var opts Options
+
+// metricSubsystem prefixes all the mongo metric names
+const metricSubsystem = "mongo"
+
+// defaultHistogramBuckets are the slow query histogram buckets in seconds, override with --histogram-buckets
+var defaultHistogramBuckets = []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// registry holds the exporter's own metrics, served on /metrics with the mongoRegistry instead of the global default
+// registry
+var registry = prometheus.NewRegistry()
+
+// mongoRegistry holds just the slow query metrics, also served on their own on /metrics/mongo
+var mongoRegistry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
 }
 
 var (
-	slowQueryCounter = promauto.NewCounterVec(
+	slowDatabaseCounter = promauto.With(mongoRegistry).NewCounterVec(
 		prometheus.CounterOpts{
-			Subsystem: "mongo",
-			Name:      "slow_query_ms",
-			Help:      "milliseconds of slow query, according to db.currentOp(), use to get a real time view of running slow queries",
+			Subsystem: metricSubsystem,
+			Name:      "db_slow_secs",
+			Help:      "seconds of slow query per database, according to db.currentOp(), use for capacity planning rollups",
+		},
+		[]string{"db"},
+	)
+	httpRequestsInFlight = promauto.With(registry).NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "number of http requests to the exporter currently being served",
 		},
-		[]string{"user", "operation", "ns"},
 	)
-	slowQueryHistogram = promauto.NewHistogramVec(
+	skippedQueriesCounter = promauto.With(mongoRegistry).NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: metricSubsystem,
+			Name:      "queries_skipped_total",
+			Help:      "number of running queries left out of a poll by --max-queries-per-poll",
+		},
+	)
+	indexBuildGauge = promauto.With(mongoRegistry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "index_build_secs",
+			Help:      "seconds the longest running index build of the namespace has been running, index builds are left out of the slow query metrics",
+		},
+		[]string{"ns"},
+	)
+	indexBuildProgress = promauto.With(mongoRegistry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "index_build_progress_pct",
+			Help:      "percentage done of the longest running index build of the namespace, when currentOp reports its progress",
+		},
+		[]string{"ns"},
+	)
+	pollDurationHistogram = promauto.With(mongoRegistry).NewHistogram(
 		prometheus.HistogramOpts{
-			Subsystem: "mongo",
-			Name:      "slow_query_secs",
-			Help:      "seconds of slow query histogram, use to get a view of completed slow queries",
-			Buckets:   []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+			Subsystem: metricSubsystem,
+			Name:      "poll_duration_seconds",
+			Help:      "seconds each currentOp poll took, including parsing and updating the metrics, to spot the monitor itself becoming expensive",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+	)
+	pollOpsGauge = promauto.With(mongoRegistry).NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "poll_ops",
+			Help:      "number of operations returned by currentOp in the last successful poll",
+		},
+	)
+	trackedOpIDsGauge = promauto.With(mongoRegistry).NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "tracked_opids",
+			Help:      "number of running queries tracked between polls, steady growth points at finished queries not being pruned",
+		},
+	)
+	interruptedQueriesCounter = promauto.With(mongoRegistry).NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: metricSubsystem,
+			Name:      "interrupted_queries_total",
+			Help:      "number of slow queries that disappeared while killPending, killed or timed out by the server rather than completed",
+		},
+	)
+	activeOpsGauge = promauto.With(mongoRegistry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "active_ops_by_user",
+			Help:      "number of operations db.currentOp() reports per user, a saturation signal",
+		},
+		[]string{"user"},
+	)
+	authErrorCounter = promauto.With(mongoRegistry).NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: metricSubsystem,
+			Name:      "auth_errors_total",
+			Help:      "number of currentOp polls rejected because the monitoring user lacks the inprog privilege",
 		},
-		[]string{"user", "operation", "ns"},
 	)
 )
 
@@ -61,6 +200,8 @@ func main() {
 	stdlog.SetFlags(0)
 	stdlog.SetOutput(log)
 
+	options.Environment("")
+
 	_, err := flags.ParseArgs(&opts, os.Args[1:])
 	if err != nil {
 		log.Error().Err(err).Msg("failed to parse command line arguments")
@@ -71,12 +212,28 @@ func main() {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
+	if opts.HealthLogs > 0 {
+		recentErrors := server.NewLogBuffer(opts.HealthLogs, zerolog.ErrorLevel)
+		log = log.Output(zerolog.MultiLevelWriter(os.Stdout, recentErrors))
+		stdlog.SetOutput(log)
+		zlog.Logger = zlog.Logger.Output(zerolog.MultiLevelWriter(os.Stderr, recentErrors))
+		health.IncludeRecentErrors(recentErrors.Lines)
+	}
+
 	if opts.Application.Version {
 		options.LogVersion()
 		os.Exit(0)
 	}
 
-	if opts.Mongo.URI == "" {
+	if opts.Application.VersionJSON {
+		if err := options.WriteVersionJSON(os.Stdout); err != nil {
+			log.Error().Err(err).Msg("failed to write version")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if opts.Mongo.URI == "" && opts.Mongo.Replay == "" {
 		if opts.Mongo.User == "" ||
 			opts.Mongo.Pass == "" ||
 			opts.Mongo.Host == "" {
@@ -85,26 +242,198 @@ func main() {
 		}
 	}
 
+	if err := opts.HTTP.Validate(); err != nil {
+		log.Error().Err(err).Msg("invalid http server options")
+		os.Exit(1)
+	}
+
+	if opts.Mongo.DB == "" {
+		log.Error().Msg("--monitor-db must not be empty")
+		os.Exit(1)
+	}
+
+	buckets := defaultHistogramBuckets
+	if opts.Monitor.HistogramBuckets != "" {
+		buckets, err = options.ParseBuckets(opts.Monitor.HistogramBuckets)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid histogram buckets")
+			os.Exit(1)
+		}
+	}
+
+	provider, err := mongoslow.ParseProvider(opts.Mongo.Provider)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid provider")
+		os.Exit(1)
+	}
+
+	labels, err := mongoslow.ParseMetricLabels(opts.Monitor.Labels)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid metric labels")
+		os.Exit(1)
+	}
+	slowQuerySeconds := promauto.With(mongoRegistry).NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricSubsystem,
+			Name:      "slow_query_seconds_total",
+			Help:      "seconds of slow query, according to db.currentOp(), use to get a real time view of running slow queries",
+		},
+		labels,
+	)
+
+	var slowQueryCounter *prometheus.CounterVec
+	if opts.Monitor.LegacyMsMetric {
+		slowQueryCounter = promauto.With(mongoRegistry).NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: metricSubsystem,
+				Name:      "slow_query_ms",
+				Help:      "deprecated, use mongo_slow_query_seconds_total, milliseconds of slow query according to db.currentOp()",
+			},
+			labels,
+		)
+	}
+	slowQueryHistogram := promauto.With(mongoRegistry).NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: metricSubsystem,
+			Name:      "slow_query_secs",
+			Help:      "seconds of slow query histogram, use to get a view of completed slow queries",
+			Buckets:   buckets,
+		},
+		labels,
+	)
+	runningQueryGauge := promauto.With(mongoRegistry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricSubsystem,
+			Name:      "running_query_secs",
+			Help:      "seconds the currently running slow queries have been running, according to db.currentOp(), unaffected by exporter restarts",
+		},
+		labels,
+	)
+	runningAgeHistogram := mongoslow.NewRunningAgeHistogram(prometheus.HistogramOpts{
+		Subsystem: metricSubsystem,
+		Name:      "running_age_seconds",
+		Help:      "seconds the queries running at the last poll had been running, replaced every poll, use to see how many queries are running for how long right now",
+		Buckets:   buckets,
+	})
+	mongoRegistry.MustRegister(runningAgeHistogram)
+
+	var yieldsGauge *prometheus.GaugeVec
+	if opts.Monitor.YieldsMetric {
+		yieldsGauge = promauto.With(mongoRegistry).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: metricSubsystem,
+				Name:      "running_query_yields",
+				Help:      "numYields of the currently running slow queries, according to db.currentOp(), a high count points at lock contention",
+			},
+			labels,
+		)
+	}
+
+	var opHistograms map[string]*prometheus.HistogramVec
+	if opts.Monitor.SplitHistograms {
+		opHistograms, err = mongoslow.NewOperationHistograms(mongoRegistry, prometheus.HistogramOpts{
+			Subsystem: metricSubsystem,
+			Buckets:   buckets,
+		}, labels)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to register per operation histograms")
+			os.Exit(1)
+		}
+	}
+
+	if opts.Monitor.MaxHistoryBytes < 0 {
+		log.Error().Int("max_history_command_bytes", opts.Monitor.MaxHistoryBytes).Msg("--max-history-command-bytes must not be negative")
+		os.Exit(1)
+	}
+
+	if opts.Monitor.MaxCommandLength < 0 {
+		log.Error().Int("max_command_length", opts.Monitor.MaxCommandLength).Msg("--max-command-length must not be negative")
+		os.Exit(1)
+	}
+	mongoslow.MaxCommandLength = opts.Monitor.MaxCommandLength
+
+	mongoslow.UserTrim, err = regexp.Compile(opts.Monitor.UserTrimRegex)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid user trim regex")
+		os.Exit(1)
+	}
+
+	var tableTemplate *template.Template
+	if opts.TemplateFile != "" {
+		tableTemplate, err = mongoslow.LoadTableTemplate(opts.TemplateFile)
+		if err != nil {
+			log.Error().Err(err).Str("filename", opts.TemplateFile).Msg("invalid template file, using the built in one")
+		}
+	}
+
+	killComment, err := mongoslow.ParseKillComment(opts.Monitor.KillComment)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid kill comment template")
+		os.Exit(1)
+	}
+
+	namespaceRules, err := mongoslow.ParseNamespaceRules(opts.Monitor.NamespaceRules)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid namespace normalize rules")
+		os.Exit(1)
+	}
+
+	metricNamespaces, err := mongoslow.ParseNamespaceGlobs(opts.Monitor.MetricNamespaces)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid namespace metric whitelist")
+		os.Exit(1)
+	}
+
+	var clientOptions []mongoslow.ClientOptionFunc
+	if opts.Mongo.Proxy != "" {
+		if _, err := mongoslow.ParseProxy(opts.Mongo.Proxy); err != nil {
+			log.Error().Err(err).Str("proxy", opts.Mongo.Proxy).Msg("invalid mongo proxy")
+			os.Exit(1)
+		}
+		clientOptions = append(clientOptions, mongoslow.WithProxy(opts.Mongo.Proxy))
+	}
+	if opts.Mongo.AppName != "" {
+		clientOptions = append(clientOptions, mongoslow.WithAppName(opts.Mongo.AppName))
+	}
+	if opts.Mongo.Retries < 0 || opts.Mongo.Backoff < 0 {
+		log.Error().Int("retries", opts.Mongo.Retries).Dur("backoff", opts.Mongo.Backoff).Msg("--mongo-connect-retries and --mongo-connect-backoff must not be negative")
+		os.Exit(1)
+	}
+	if len(opts.Mongo.Compress) > 0 {
+		if err := mongoslow.ValidateCompressors(opts.Mongo.Compress); err != nil {
+			log.Error().Err(err).Msg("invalid mongo compressors")
+			os.Exit(1)
+		}
+		clientOptions = append(clientOptions, mongoslow.WithCompressors(opts.Mongo.Compress))
+	}
+
 	// router
 	r := mux.NewRouter()
-	r.Use(handlers.CompressHandler)
+	r.Use(server.CompressMiddleware())
 
 	// setup logging
 	server.Log(r)
+	r.Use(server.InFlightMiddleware(httpRequestsInFlight))
 
 	// default end points
-	server.Profiling(r, "/debug/pprof")
+	var profilingMiddleware []mux.MiddlewareFunc
+	if opts.PprofUser != "" || opts.PprofPass != "" {
+		profilingMiddleware = append(profilingMiddleware, server.BasicAuthMiddleware(opts.PprofUser, opts.PprofPass))
+	}
+	server.Profiling(r, "/debug/pprof", profilingMiddleware...)
+	server.Config(r, "/debug/config.json", &opts, profilingMiddleware...)
 
 	// metrics
-	server.Metrics(r, "/metrics")
+	server.OpenMetrics = !opts.NoOpenMetrics
+	server.MetricsWithRegistry(r, "/metrics", prometheus.Gatherers{registry, mongoRegistry})
+	server.MetricsWithRegistry(r, "/metrics/mongo", mongoRegistry)
+
+	// build metadata
+	server.BuildInfo(r, "/build-info")
 
 	listen := fmt.Sprintf(":%d", opts.Port)
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         listen,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second}
+	srv := server.NewServer(listen, r, opts.HTTP)
 
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -127,35 +456,230 @@ func main() {
 		}
 	}()
 
-	log.Info().Msg("connecting to mongo ...")
-	slow, err := mongoslow.New(ctx, opts.Mongo.URI, opts.Mongo.User, opts.Mongo.Pass, opts.Mongo.Host, opts.Mongo.Port)
+	var slow *mongoslow.MongoSlow
+	if opts.Mongo.Replay != "" {
+		log.Info().Str("filename", opts.Mongo.Replay).Msg("replaying recorded currentOp responses ...")
+		slow, err = mongoslow.NewReplay(opts.Mongo.Replay)
+	} else {
+		log.Info().Msg("connecting to mongo ...")
+		mongoslow.ConnectRetries = opts.Mongo.Retries
+		mongoslow.ConnectBackoff = opts.Mongo.Backoff
+		slow, err = mongoslow.New(ctx, opts.Mongo.URI, opts.Mongo.Host, opts.Mongo.User, opts.Mongo.Pass, opts.Mongo.Port, clientOptions...)
+		if err == nil {
+			err = slow.MonitorDatabase(opts.Mongo.DB)
+		}
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("failed to setup mongo")
 		os.Exit(1)
 	}
 
+	slow.Provider = provider
+	slow.CommandTimeout = opts.Monitor.CommandTimeout
+
+	if opts.Check {
+		err = slow.CheckConnection(ctx, os.Stdout)
+		slow.Close(ctx)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	r.HandleFunc("/running.json", mongoslow.SlowQueryHandler(slow))
 	r.HandleFunc("/running", mongoslow.RunningQueryTableHandler(slow))
+	r.HandleFunc("/running/columns.json", mongoslow.QueryColumnsHandler())
+	r.HandleFunc("/running/snapshot.html", mongoslow.RunningQuerySnapshotHandler(slow))
+	r.HandleFunc("/running/{opid:[0-9]+}/raw.json", mongoslow.RawQueryHandler(slow))
 	r.HandleFunc("/history.json", mongoslow.HistoryQueryHandler(slow))
 	r.HandleFunc("/history", mongoslow.HistoryQueryTableHandler(slow))
+	r.HandleFunc("/history/timeseries.json", mongoslow.HistoryTimeseriesHandler(slow))
+	r.HandleFunc("/all.json", mongoslow.AllQueriesHandler(slow))
+	r.HandleFunc("/stats.json", mongoslow.StatsHandler(slow))
+	r.Handle("/pause", server.Chain(http.HandlerFunc(mongoslow.PauseHandler(slow)), profilingMiddleware...))
+	r.Handle("/resume", server.Chain(http.HandlerFunc(mongoslow.ResumeHandler(slow)), profilingMiddleware...))
+	r.HandleFunc("/ready", mongoslow.ReadyHandler(slow))
+	r.HandleFunc("/connections.json", mongoslow.ConnectionsHandler(slow))
+	r.HandleFunc("/idle.json", mongoslow.IdleHandler(slow))
+
+	dashboard, err := mongoslow.GrafanaDashboardHandler(metricSubsystem)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to render grafana dashboard")
+		os.Exit(1)
+	}
+	r.HandleFunc("/grafana/dashboard.json", dashboard)
+
+	health.Config.StartupGrace = opts.HealthGrace
+	health.Config.FailUnhealthy = opts.HealthFail
+	server.HealthStartup(r, "/health/startup")
+	if opts.HealthReset {
+		server.HealthResetStats(r, "/health/reset-stats")
+	}
+	dependencies := []*health.Dependency{{
+		Name: "mongo",
+		Desc: "currentOp polling",
+		Item: mongoslow.NewHealthCheck(slow),
+	}}
+	if opts.SlowLogFile != "" {
+		dependencies = append(dependencies, health.NewDiskSpaceDependency("slowlog_disk", filepath.Dir(opts.SlowLogFile), opts.HealthMinDisk))
+	}
+	if opts.HistoryFile != "" {
+		dependencies = append(dependencies, health.NewDiskSpaceDependency("history_disk", filepath.Dir(opts.HistoryFile), opts.HealthMinDisk))
+	}
+	server.Health(r, "/health", dependencies...)
 
-	go func(ctx context.Context, counter *prometheus.CounterVec, histogram *prometheus.HistogramVec) {
-		slow.QueryCounter = counter
-		slow.QueryHistogram = slowQueryHistogram
-		err = slow.Run(2 * time.Second)
+	slow.QueryCounter = slowQueryCounter
+	slow.QuerySeconds = slowQuerySeconds
+	slow.QueryHistogram = slowQueryHistogram
+	slow.OpHistograms = opHistograms
+	slow.DatabaseCounter = slowDatabaseCounter
+	slow.RunningGauge = runningQueryGauge
+	slow.RunningAge = runningAgeHistogram
+	slow.YieldsGauge = yieldsGauge
+	slow.IndexBuildGauge = indexBuildGauge
+	slow.IndexBuildProgress = indexBuildProgress
+	slow.ActiveOpsGauge = activeOpsGauge
+	slow.AuthErrors = authErrorCounter
+	slow.SkippedQueries = skippedQueriesCounter
+	slow.InterruptedQueries = interruptedQueriesCounter
+	slow.PollDuration = pollDurationHistogram
+	slow.PollOps = pollOpsGauge
+	slow.TrackedOpIDs = trackedOpIDsGauge
+	slow.MaxTrackedOpIDs = opts.Monitor.MaxTrackedOpIDs
+	slow.MaxQueriesPerPoll = opts.Monitor.MaxQueries
+	slow.MaxHistoryBytes = opts.Monitor.MaxHistoryBytes
+	slow.MinDeltaMicros = opts.Monitor.MinDeltaMicros
+	slow.MinObserveMicros = opts.Monitor.MinObserveMicros
+	slow.NamespaceRules = namespaceRules
+	slow.MetricNamespaces = metricNamespaces
+	slow.Labels = labels
+	if !opts.Monitor.IncludeSelf {
+		slow.ExcludeAppName = opts.Mongo.AppName
+	}
+	slow.TableTemplate = tableTemplate
+	slow.KillComment = killComment
+
+	var slowLog *mongoslow.SlowLog
+	if opts.SlowLogFile != "" {
+		slowLog, err = mongoslow.OpenSlowLog(opts.SlowLogFile, opts.SlowLogSize)
+		if err != nil {
+			log.Error().Err(err).Str("filename", opts.SlowLogFile).Msg("failed to open slow log file")
+			os.Exit(1)
+		}
+		slow.SlowLog = slowLog
+	}
+
+	if opts.HistoryFile != "" {
+		if opts.HistorySave <= 0 {
+			log.Error().Dur("interval", opts.HistorySave).Msg("--history-persist-interval must be positive")
+			os.Exit(1)
+		}
+		if err = slow.LoadHistory(opts.HistoryFile); err != nil {
+			log.Warn().Err(err).Str("filename", opts.HistoryFile).Msg("not restoring history")
+		}
+		go slow.PersistHistory(ctx, opts.HistoryFile, opts.HistorySave)
+	}
+
+	if opts.Monitor.IdleCursors || opts.Monitor.IdleSessions {
+		err = slow.IncludeIdle(mongoslow.IdleOptions{Cursors: opts.Monitor.IdleCursors, Sessions: opts.Monitor.IdleSessions})
+		if err != nil {
+			log.Warn().Err(err).Msg("not including idle cursors and sessions")
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				reloadConfig(log, slow)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		err := slow.Run(ctx, 2*time.Second)
 		if err != nil {
 			log.Error().Err(err).Msg("run loop failed")
 			cancel()
 			srv.Shutdown(ctx)
 		}
-	}(ctx, slowQueryCounter, slowQueryHistogram)
+	}()
 
-	log.Info().Int("port", opts.Port).Msg("started server ...")
+	log.Info().Int("port", opts.Port).Bool("tls", opts.HTTP.TLS()).Msg("started server ...")
 
 	if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Error().Err(err).Msg("failed to start http server")
 		os.Exit(1)
 	}
 
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer closeCancel()
+	if err = slow.Close(closeCtx); err != nil {
+		log.Error().Err(err).Msg("failed to disconnect from mongo")
+	}
+	if opts.HistoryFile != "" {
+		if err = slow.SaveHistory(opts.HistoryFile); err != nil {
+			log.Error().Err(err).Str("filename", opts.HistoryFile).Msg("failed to save history")
+		}
+	}
+	if slowLog != nil {
+		if err = slowLog.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close slow log file")
+		}
+	}
+
 	log.Info().Msg("stopped")
 }
+
+// reloadConfig re-reads the environment files and command line and applies the options that are safe to change while
+// running: the thresholds, the namespace rules and the log level. Anything else needs a restart.
+func reloadConfig(log zerolog.Logger, slow *mongoslow.MongoSlow) {
+	changed, err := reload(slow, os.Args[1:], options.EnvironmentFiles(opts.Application.Environment)...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload configuration, keeping the current one")
+		return
+	}
+	log.Info().Strs("changed", changed).Msg("reloaded configuration")
+}
+
+// reload loads the envFiles over the environment, parses args and applies the reloadable options to slow and the
+// global log level, returning the names of the options that changed. Nothing is applied if args don't parse or the
+// namespace rules or metric whitelist are invalid.
+func reload(slow *mongoslow.MongoSlow, args []string, envFiles ...string) ([]string, error) {
+	options.OverloadEnvironment(envFiles...)
+
+	var reloaded Options
+	if _, err := flags.ParseArgs(&reloaded, args); err != nil {
+		return nil, err
+	}
+	rules, err := mongoslow.ParseNamespaceRules(reloaded.Monitor.NamespaceRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace normalize rules: %w", err)
+	}
+	metricNamespaces, err := mongoslow.ParseNamespaceGlobs(reloaded.Monitor.MetricNamespaces)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace metric whitelist: %w", err)
+	}
+
+	changed := slow.Apply(mongoslow.Settings{
+		MinDeltaMicros:   reloaded.Monitor.MinDeltaMicros,
+		MinObserveMicros: reloaded.Monitor.MinObserveMicros,
+		NamespaceRules:   rules,
+		MetricNamespaces: metricNamespaces,
+	})
+
+	level := zerolog.InfoLevel
+	if reloaded.Application.Debug {
+		level = zerolog.DebugLevel
+	}
+	if level != zerolog.GlobalLevel() {
+		zerolog.SetGlobalLevel(level)
+		changed = append(changed, "debug")
+	}
+	return changed, nil
+}
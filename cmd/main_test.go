@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeks313/go-mongo-slow-queries/internal/mongoslow"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// idleRunner is a currentOp source with nothing running
+type idleRunner struct{}
+
+func (idleRunner) CurrentOp(ctx context.Context) ([]primitive.M, error) {
+	return nil, nil
+}
+
+func TestReload(t *testing.T) {
+	Convey("Given a running monitor and an environment file", t, func() {
+		defer os.Unsetenv("MIN_OBSERVE_MICROS")
+		defer os.Unsetenv("NS_NORMALIZE")
+		defer os.Unsetenv("NAMESPACE_METRIC_WHITELIST")
+		defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+		slow := mongoslow.NewWithRunner(idleRunner{})
+		slow.MinObserveMicros = 500000
+		envFile := filepath.Join(t.TempDir(), "slow-queries-dev.env")
+		writeEnv := func(contents string) {
+			So(ioutil.WriteFile(envFile, []byte(contents), 0644), ShouldBeNil)
+		}
+
+		Convey("A changed MIN_OBSERVE_MICROS takes effect", func() {
+			writeEnv("MIN_OBSERVE_MICROS=750000\n")
+			changed, err := reload(slow, nil, envFile)
+			So(err, ShouldBeNil)
+			So(changed, ShouldResemble, []string{"min_observe_micros"})
+			So(slow.Settings().MinObserveMicros, ShouldEqual, 750000)
+
+			Convey("And an edit to the file replaces the value loaded before", func() {
+				writeEnv("MIN_OBSERVE_MICROS=900000\n")
+				_, err := reload(slow, nil, envFile)
+				So(err, ShouldBeNil)
+				So(slow.Settings().MinObserveMicros, ShouldEqual, 900000)
+			})
+		})
+
+		Convey("The command line still wins over the file", func() {
+			writeEnv("MIN_OBSERVE_MICROS=750000\n")
+			_, err := reload(slow, []string{"--min-observe-micros", "600000"}, envFile)
+			So(err, ShouldBeNil)
+			So(slow.Settings().MinObserveMicros, ShouldEqual, 600000)
+		})
+
+		Convey("Missing environment files are skipped", func() {
+			changed, err := reload(slow, nil, filepath.Join(t.TempDir(), "missing.env"))
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeEmpty)
+		})
+
+		Convey("Invalid namespace rules keep the current configuration", func() {
+			writeEnv("MIN_OBSERVE_MICROS=750000\nNS_NORMALIZE=([=x\n")
+			_, err := reload(slow, nil, envFile)
+			So(err, ShouldNotBeNil)
+			So(slow.Settings().MinObserveMicros, ShouldEqual, 500000)
+		})
+
+		Convey("A changed NAMESPACE_METRIC_WHITELIST takes effect", func() {
+			writeEnv("NAMESPACE_METRIC_WHITELIST=orders.*,*.sessions\n")
+			changed, err := reload(slow, nil, envFile)
+			So(err, ShouldBeNil)
+			So(changed, ShouldResemble, []string{"namespace_metric_whitelist"})
+			So(slow.Settings().MetricNamespaces, ShouldResemble, []string{"orders.*", "*.sessions"})
+		})
+
+		Convey("An invalid namespace metric whitelist keeps the current configuration", func() {
+			writeEnv("MIN_OBSERVE_MICROS=750000\nNAMESPACE_METRIC_WHITELIST=orders.[\n")
+			_, err := reload(slow, nil, envFile)
+			So(err, ShouldNotBeNil)
+			So(slow.Settings().MinObserveMicros, ShouldEqual, 500000)
+			So(slow.Settings().MetricNamespaces, ShouldBeEmpty)
+		})
+
+		Convey("Unparseable arguments keep the current configuration", func() {
+			writeEnv("MIN_OBSERVE_MICROS=750000\n")
+			_, err := reload(slow, []string{"--min-observe-micros", "soon"}, envFile)
+			So(err, ShouldNotBeNil)
+			So(slow.Settings().MinObserveMicros, ShouldEqual, 500000)
+		})
+
+		Convey("--debug switches the log level", func() {
+			changed, err := reload(slow, []string{"--debug"})
+			So(err, ShouldBeNil)
+			So(changed, ShouldContain, "debug")
+			So(zerolog.GlobalLevel(), ShouldEqual, zerolog.DebugLevel)
+
+			changed, err = reload(slow, nil)
+			So(err, ShouldBeNil)
+			So(changed, ShouldContain, "debug")
+			So(zerolog.GlobalLevel(), ShouldEqual, zerolog.InfoLevel)
+		})
+	})
+}
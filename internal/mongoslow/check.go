@@ -0,0 +1,64 @@
+package mongoslow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mongo error codes returned when the monitoring user is not allowed to run currentOp
+const (
+	codeUnauthorized         = 13
+	codeAuthenticationFailed = 18
+	codeUserNotFound         = 11
+)
+
+// IsAuthError reports whether err is a mongo authentication or authorization failure
+func IsAuthError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		switch cmdErr.Code {
+		case codeUnauthorized, codeAuthenticationFailed, codeUserNotFound:
+			return true
+		}
+	}
+	return false
+}
+
+// authErrorMessage is the actionable log message for an auth error
+const authErrorMessage = "not authorized to run currentOp, grant the monitoring user the inprog privilege (clusterMonitor role)"
+
+// CheckConnection runs a single currentOp, giving up after the CommandTimeout, and writes a report of what the
+// monitoring user can see to w. It returns an error if currentOp failed, a missing privilege is reported as such.
+func (s *MongoSlow) CheckConnection(ctx context.Context, w io.Writer) error {
+	ops, err := s.currentOp(ctx)
+	if err != nil {
+		if isTimeout(err) {
+			fmt.Fprintf(w, "currentOp: FAILED, no answer within the command timeout of %v: %v\n", s.CommandTimeout, err)
+			return err
+		}
+		if IsAuthError(err) {
+			fmt.Fprintf(w, "currentOp: FAILED, not authorized: %v\n", err)
+			fmt.Fprintln(w, "privileges: MISSING, grant the monitoring user the inprog privilege (clusterMonitor role)")
+			return err
+		}
+		fmt.Fprintf(w, "currentOp: FAILED: %v\n", err)
+		return err
+	}
+
+	users := make(map[string]bool)
+	for _, op := range ops {
+		q, err := s.parse(op)
+		if err != nil {
+			continue
+		}
+		users[q.EffectiveUser] = true
+	}
+
+	fmt.Fprintf(w, "currentOp: ok, %d operations visible from %d users\n", len(ops), len(users))
+	fmt.Fprintln(w, "privileges: ok, able to see all operations")
+	return nil
+}
@@ -0,0 +1,112 @@
+package mongoslow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCheckConnection(t *testing.T) {
+	Convey("Given a runner that can see operations", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), op(2, 1000000, "foo.baz")},
+		}})
+		out := new(bytes.Buffer)
+
+		So(slow.CheckConnection(context.Background(), out), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "2 operations visible from 1 users")
+		So(out.String(), ShouldContainSubstring, "privileges: ok")
+	})
+
+	Convey("Given a runner that is not authorized", t, func() {
+		slow := NewWithRunner(&fakeRunner{err: errUnauthorized})
+		out := new(bytes.Buffer)
+
+		So(slow.CheckConnection(context.Background(), out), ShouldNotBeNil)
+		So(out.String(), ShouldContainSubstring, "privileges: MISSING")
+		So(out.String(), ShouldContainSubstring, "clusterMonitor")
+	})
+
+	Convey("Given a server that never answers currentOp", t, func() {
+		slow := NewWithRunner(blockingRunner{})
+		slow.CommandTimeout = 10 * time.Millisecond
+		out := new(bytes.Buffer)
+
+		Convey("The check fails once the command timeout is up instead of hanging", func() {
+			result := make(chan error, 1)
+			go func() {
+				result <- slow.CheckConnection(context.Background(), out)
+			}()
+			select {
+			case err := <-result:
+				So(isTimeout(err), ShouldBeTrue)
+				So(out.String(), ShouldContainSubstring, "no answer within the command timeout of 10ms")
+			case <-time.After(time.Second):
+				So("check still running after the command timeout", ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+var errUnauthorized = mongo.CommandError{
+	Code:    13,
+	Name:    "Unauthorized",
+	Message: "not authorized on admin to execute command { currentOp: 1, $all: true }",
+}
+
+func TestAuthErrors(t *testing.T) {
+	Convey("Given errors returned by currentOp", t, func() {
+		So(IsAuthError(errUnauthorized), ShouldBeTrue)
+		So(IsAuthError(fmt.Errorf("poll: %w", errUnauthorized)), ShouldBeTrue)
+		So(IsAuthError(mongo.CommandError{Code: 18, Name: "AuthenticationFailed"}), ShouldBeTrue)
+		So(IsAuthError(mongo.CommandError{Code: 59, Name: "CommandNotFound"}), ShouldBeFalse)
+		So(IsAuthError(errors.New("connection refused")), ShouldBeFalse)
+	})
+
+	Convey("Given a runner that is not authorized", t, func() {
+		slow := NewWithRunner(&fakeRunner{err: errUnauthorized})
+		slow.AuthErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: "auth_errors_total"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- slow.Run(ctx, time.Millisecond)
+		}()
+		for slow.Stats().Polls < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		Convey("The run loop keeps going and counts the auth errors", func() {
+			cancel()
+			So(<-result, ShouldBeNil)
+			So(testutil.ToFloat64(slow.AuthErrors), ShouldBeGreaterThanOrEqualTo, 2)
+		})
+
+		Convey("The health check reports the auth error", func() {
+			state, err := NewHealthCheck(slow).Check()
+			So(err, ShouldNotBeNil)
+			So(state["auth_error"], ShouldEqual, true)
+			So(state["hint"], ShouldContainSubstring, "clusterMonitor")
+			cancel()
+			<-result
+		})
+	})
+
+	Convey("Given a runner failing for another reason", t, func() {
+		slow := NewWithRunner(&fakeRunner{err: errors.New("connection refused")})
+		So(slow.Run(context.Background(), time.Millisecond), ShouldNotBeNil)
+
+		state, err := NewHealthCheck(slow).Check()
+		So(err, ShouldNotBeNil)
+		So(state["auth_error"], ShouldEqual, false)
+	})
+}
@@ -0,0 +1,61 @@
+package mongoslow
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Column describes a Query field as shown in the running and history tables
+type Column struct {
+	Field    string `json:"field"`    // Query field name
+	Key      string `json:"key"`      // JSON key in the running and history json
+	Label    string `json:"label"`    // table column heading
+	Type     string `json:"type"`     // number, string or object
+	Sortable bool   `json:"sortable"` // numbers and strings sort, objects don't
+}
+
+// queryColumns is generated from the Query struct tags, so it stays in step with the json
+var queryColumns = columns(reflect.TypeOf(Query{}))
+
+// columns describes the exported json fields of a struct type, using the json and label struct tags
+func columns(t reflect.Type) []Column {
+	var cols []Column
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+		label := field.Tag.Get("label")
+		if label == "" {
+			label = field.Name
+		}
+		col := Column{Field: field.Name, Key: key, Label: label, Type: "object"}
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			col.Type = "number"
+			col.Sortable = true
+		case reflect.String:
+			col.Type = "string"
+			col.Sortable = true
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// QueryColumnsHandler will output the column definitions of the running and history queries
+func QueryColumnsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, queryColumns)
+	}
+}
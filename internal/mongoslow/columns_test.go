@@ -0,0 +1,47 @@
+package mongoslow
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryColumnsHandler(t *testing.T) {
+	Convey("Given the query columns json", t, func() {
+		rec := httptest.NewRecorder()
+		QueryColumnsHandler()(rec, httptest.NewRequest("GET", "/running/columns.json", nil))
+		So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+
+		var cols []Column
+		So(json.Unmarshal(rec.Body.Bytes(), &cols), ShouldBeNil)
+		byField := make(map[string]Column)
+		for _, col := range cols {
+			byField[col.Field] = col
+		}
+
+		Convey("Every exported Query field appears with its json key", func() {
+			queryType := reflect.TypeOf(Query{})
+			exported := 0
+			for i := 0; i < queryType.NumField(); i++ {
+				field := queryType.Field(i)
+				if field.PkgPath != "" {
+					continue
+				}
+				exported++
+				So(byField, ShouldContainKey, field.Name)
+				So(byField[field.Name].Key, ShouldEqual, strings.Split(field.Tag.Get("json"), ",")[0])
+			}
+			So(cols, ShouldHaveLength, exported)
+		})
+
+		Convey("Columns carry their label, type and sortability", func() {
+			So(byField["OperationID"], ShouldResemble, Column{Field: "OperationID", Key: "opid", Label: "Op ID", Type: "number", Sortable: true})
+			So(byField["Namespace"].Type, ShouldEqual, "string")
+			So(byField["Raw"].Sortable, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,59 @@
+package mongoslow
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Connection is the slow running queries of a single client connection
+type Connection struct {
+	ConnectionID  int64   `json:"connection_id"`
+	Queries       int     `json:"queries"`
+	RunningMicros int64   `json:"running_micros"` // total running time of the connection's queries
+	OperationIDs  []int32 `json:"opids"`
+}
+
+// connections groups queries by their connection, longest total running time first, queries without a connection
+// are left out
+func connections(queries map[int32]*Query) []*Connection {
+	byID := make(map[int64]*Connection)
+	for _, query := range queries {
+		if query.ConnectionID == 0 {
+			continue
+		}
+		conn, ok := byID[query.ConnectionID]
+		if !ok {
+			conn = &Connection{ConnectionID: query.ConnectionID}
+			byID[query.ConnectionID] = conn
+		}
+		conn.Queries++
+		conn.RunningMicros += query.RunningMicros
+		conn.OperationIDs = append(conn.OperationIDs, query.OperationID)
+	}
+
+	conns := make([]*Connection, 0, len(byID))
+	for _, conn := range byID {
+		sort.Slice(conn.OperationIDs, func(i, j int) bool { return conn.OperationIDs[i] < conn.OperationIDs[j] })
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].RunningMicros != conns[j].RunningMicros {
+			return conns[i].RunningMicros > conns[j].RunningMicros
+		}
+		return conns[i].ConnectionID < conns[j].ConnectionID
+	})
+	return conns
+}
+
+// ConnectionsHandler will output the running queries grouped by client connection
+func ConnectionsHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if initializing(w, r, slow) {
+			return
+		}
+		slow.mu.RLock()
+		conns := connections(slow.runningQueries)
+		slow.mu.RUnlock()
+		writeJSON(w, r, http.StatusOK, conns)
+	}
+}
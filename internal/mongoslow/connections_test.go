@@ -0,0 +1,44 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// connectionOp is a currentOp entry running on the given client connection
+func connectionOp(opid int32, micros int64, connectionID int32) primitive.M {
+	entry := op(opid, micros, "foo.bar")
+	entry["connectionId"] = connectionID
+	return entry
+}
+
+func TestConnectionsHandler(t *testing.T) {
+	Convey("Given two queries on one connection, one on another and an internal op", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{
+			connectionOp(1, 1000000, 17),
+			connectionOp(2, 3000000, 17),
+			connectionOp(3, 2000000, 42),
+			op(4, 9000000, "local.oplog.rs"),
+		}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		rec := httptest.NewRecorder()
+		ConnectionsHandler(slow)(rec, httptest.NewRequest("GET", "/connections.json", nil))
+		So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+
+		var conns []Connection
+		So(json.Unmarshal(rec.Body.Bytes(), &conns), ShouldBeNil)
+
+		Convey("The queries are grouped by connection, slowest first, without the internal op", func() {
+			So(conns, ShouldResemble, []Connection{
+				{ConnectionID: 17, Queries: 2, RunningMicros: 4000000, OperationIDs: []int32{1, 2}},
+				{ConnectionID: 42, Queries: 1, RunningMicros: 2000000, OperationIDs: []int32{3}},
+			})
+		})
+	})
+}
@@ -0,0 +1,107 @@
+package mongoslow
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/proxy"
+)
+
+// ParseProxy validates a proxy URL and returns a dialer that connects through it. Supported schemes are socks5,
+// socks5h (resolve names on the proxy, use this for an `ssh -D` tunnel) and http (CONNECT proxy).
+func ParseProxy(proxyURL string) (options.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: missing host", proxyURL)
+	}
+
+	forward := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy dialer for %q does not support contexts", u.Scheme)
+		}
+		return cd, nil
+	case "http":
+		return &httpConnectDialer{proxy: u, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5, socks5h or http", u.Scheme)
+	}
+}
+
+// httpConnectDialer tunnels connections through a HTTP proxy using the CONNECT method
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps any bytes the proxy sent after the CONNECT response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
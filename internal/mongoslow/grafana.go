@@ -0,0 +1,39 @@
+package mongoslow
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed grafana/dashboard.json
+var dashboardJSON string
+
+// GrafanaDashboardHandler serves a ready made Grafana dashboard for the metrics, rendered for the metric subsystem in use
+func GrafanaDashboardHandler(subsystem string) (func(w http.ResponseWriter, r *http.Request), error) {
+	// grafana uses {{}} for legends, so use different delimiters for our own template
+	t, err := template.New("dashboard").Delims("[[", "]]").Parse(dashboardJSON)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, struct{ Subsystem string }{subsystem}); err != nil {
+		return nil, err
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, errors.New("rendered grafana dashboard is not valid json")
+	}
+	dashboard := b.Bytes()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		if _, err := w.Write(dashboard); err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("failed to write grafana dashboard")
+		}
+	}, nil
+}
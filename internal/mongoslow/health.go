@@ -0,0 +1,31 @@
+package mongoslow
+
+// HealthCheck reports the state of the currentOp polling as a health dependency
+type HealthCheck struct {
+	slow *MongoSlow
+}
+
+// NewHealthCheck creates a health dependency for the given MongoSlow
+func NewHealthCheck(slow *MongoSlow) *HealthCheck {
+	return &HealthCheck{slow: slow}
+}
+
+// Check is unhealthy when the last currentOp poll failed, auth failures are flagged separately
+func (h *HealthCheck) Check() (map[string]interface{}, error) {
+	h.slow.mu.RLock()
+	err := h.slow.lastErr
+	stats := h.slow.stats
+	h.slow.mu.RUnlock()
+
+	state := map[string]interface{}{
+		"polls":         stats.Polls,
+		"tracked_opids": stats.TrackedOpIDs,
+	}
+	if err != nil {
+		state["auth_error"] = IsAuthError(err)
+		if IsAuthError(err) {
+			state["hint"] = authErrorMessage
+		}
+	}
+	return state, err
+}
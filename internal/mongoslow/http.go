@@ -1,63 +1,415 @@
 package mongoslow
 
 import (
+	"bytes"
 	_ "embed"
 	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 //go:embed html/queries.html
 var queriesHTML string
 
-// SlowQueryHandler will output the current running query list
+//go:embed html/snapshot.html
+var snapshotHTML string
+
+// writeJSON writes v with the status as compact JSON, or indented if the request has ?pretty=true. It is encoded
+// before anything is written, so an encode failure is logged and sent as a 500 with a JSON error instead.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("failed to encode json response")
+		buf.Reset()
+		json.NewEncoder(&buf).Encode(map[string]string{"error": "failed to encode response: " + err.Error()})
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Warn().Err(err).Str("path", r.URL.Path).Msg("failed to write json response")
+	}
+}
+
+// executor is a text or html template
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// writeTemplate executes the template before writing anything, so a failure is logged and sent as a 500 instead of
+// a half rendered page
+func writeTemplate(w http.ResponseWriter, r *http.Request, t executor, data interface{}) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("failed to execute template")
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": "failed to render page: " + err.Error()})
+		return
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Warn().Err(err).Str("path", r.URL.Path).Msg("failed to write page")
+	}
+}
+
+// initializing writes an {"initializing": true} envelope instead of the json until the first poll has succeeded, so
+// an empty list isn't mistaken for no slow queries, returning true if it did
+func initializing(w http.ResponseWriter, r *http.Request, slow *MongoSlow) bool {
+	if slow.Ready() {
+		return false
+	}
+	writeJSON(w, r, http.StatusOK, map[string]bool{"initializing": true})
+	return true
+}
+
+// ReadyHandler reports ready once the first currentOp poll has succeeded, with a 503 until then for readiness probes
+func ReadyHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := slow.Ready()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, r, status, map[string]bool{"ready": ready})
+	}
+}
+
+// SlowQueryHandler will output the current running query list, ?min_secs=N leaves out queries running for less
 func SlowQueryHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("content-type", "application/json")
-		json.NewEncoder(w).Encode(slow.runningQueries)
+		if initializing(w, r, slow) {
+			return
+		}
+		minMicros, err := minRunningMicros(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prepare := rawDocuments(r)
+		queries := make(map[int32]*Query)
+		slow.mu.RLock()
+		for opid, query := range slow.runningQueries {
+			if query.RunningMicros >= minMicros {
+				queries[opid] = prepare(query)
+			}
+		}
+		slow.mu.RUnlock()
+		writeJSON(w, r, http.StatusOK, queries)
+	}
+}
+
+// rawDocuments returns a function preparing queries for a response, leaving out their raw currentOp document unless
+// the request has ?raw=true, as it doubles the response size. RawQueryHandler serves a single one in full.
+func rawDocuments(r *http.Request) func(*Query) *Query {
+	if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+		return func(q *Query) *Query { return q }
 	}
+	return func(q *Query) *Query {
+		c := *q
+		c.Raw = nil
+		return &c
+	}
+}
+
+// prepareAll applies prepare to each of the queries in place
+func prepareAll(queries []*Query, prepare func(*Query) *Query) []*Query {
+	for i, q := range queries {
+		queries[i] = prepare(q)
+	}
+	return queries
+}
+
+// minRunningMicros reads the ?min_secs= filter on the running queries as microseconds, zero if not set
+func minRunningMicros(r *http.Request) (int64, error) {
+	param := r.URL.Query().Get("min_secs")
+	if param == "" {
+		return 0, nil
+	}
+	secs, err := strconv.ParseFloat(param, 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid min_secs %q: must be a number of seconds", param)
+	}
+	return int64(secs * 1000000), nil
 }
 
-// HistoryQueryHandler will dump the ring buffer of historical slow queries
+// HistoryQueryHandler will dump the ring buffer of historical slow queries, see historyFilter for narrowing it down
 func HistoryQueryHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("content-type", "application/json")
-		var queries []*Query
-		slow.history.Do(func(p interface{}) {
-			if p != nil {
-				queries = append(queries, p.(*Query))
+		if initializing(w, r, slow) {
+			return
+		}
+		keep, err := historyFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, prepareAll(slow.filterHistory(keep), rawDocuments(r)))
+	}
+}
+
+// historyFilter reads the ?ns= and ?user= substring filters and the ?min_secs= threshold on the history
+func historyFilter(r *http.Request) (func(*Query) bool, error) {
+	minMicros, err := minRunningMicros(r)
+	if err != nil {
+		return nil, err
+	}
+	ns, user := r.URL.Query().Get("ns"), r.URL.Query().Get("user")
+	return func(q *Query) bool {
+		return q.RunningMicros >= minMicros &&
+			strings.Contains(q.Namespace, ns) &&
+			strings.Contains(q.EffectiveUser, user)
+	}, nil
+}
+
+// filterHistory returns the queries in the history that keep returns true for, oldest first
+func (s *MongoSlow) filterHistory(keep func(*Query) bool) []*Query {
+	queries := []*Query{} // encodes as [] rather than null when there are none
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.history.Do(func(p interface{}) {
+		if p != nil && keep(p.(*Query)) {
+			queries = append(queries, p.(*Query))
+		}
+	})
+	return queries
+}
+
+// allSections are the sections of /all.json, selected with ?include=
+var allSections = []string{"running", "history"}
+
+// AllQueriesHandler will output the running queries, slowest first, and the history, newest first, in one response
+// read under the same lock, ?include=running,history selects the sections
+func AllQueriesHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if initializing(w, r, slow) {
+			return
+		}
+		include := make(map[string]bool)
+		if param := r.URL.Query().Get("include"); param != "" {
+			for _, section := range strings.Split(param, ",") {
+				if !containsString(allSections, section) {
+					http.Error(w, fmt.Sprintf("invalid include %q, expected a comma separated list of %v", section, allSections), http.StatusBadRequest)
+					return
+				}
+				include[section] = true
 			}
-		})
-		json.NewEncoder(w).Encode(queries)
+		} else {
+			for _, section := range allSections {
+				include[section] = true
+			}
+		}
+
+		all := make(map[string][]*Query)
+		slow.mu.RLock()
+		if include["running"] {
+			running := make([]*Query, 0, len(slow.runningQueries))
+			for _, query := range slow.runningQueries {
+				running = append(running, query)
+			}
+			sort.Slice(running, func(i, j int) bool {
+				return running[i].RunningMicros > running[j].RunningMicros
+			})
+			all["running"] = prepareAll(running, rawDocuments(r))
+		}
+		if include["history"] {
+			history := []*Query{}
+			slow.history.Do(func(p interface{}) {
+				if p != nil {
+					history = append(history, p.(*Query))
+				}
+			})
+			for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 { // the ring runs oldest first
+				history[i], history[j] = history[j], history[i]
+			}
+			all["history"] = prepareAll(history, rawDocuments(r))
+		}
+		slow.mu.RUnlock()
+
+		writeJSON(w, r, http.StatusOK, all)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
+	return false
 }
 
-// RunningQueryTableHandler will output the running queries in a datatable
+// RawQueryHandler will output the unmodified currentOp document of the running query with the {opid} route variable
+// as relaxed extended JSON, so the bson types like ObjectIds and dates stay readable
+func RawQueryHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opid, err := strconv.ParseInt(mux.Vars(r)["opid"], 10, 32)
+		if err != nil {
+			http.Error(w, "invalid opid", http.StatusBadRequest)
+			return
+		}
+		slow.mu.RLock()
+		query, ok := slow.runningQueries[int32(opid)]
+		var raw []byte
+		if ok {
+			raw, err = bson.MarshalExtJSON(primitive.M(query.Raw), false, false)
+		}
+		slow.mu.RUnlock()
+		if !ok {
+			http.Error(w, "query not running", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		if _, err := w.Write(raw); err != nil {
+			log.Warn().Err(err).Str("path", r.URL.Path).Msg("failed to write raw query")
+		}
+	}
+}
+
+var defaultTableTemplate = template.Must(template.New("table").Parse(queriesHTML))
+
+// LoadTableTemplate loads a replacement for the embedded queries.html, executed with the queries as a JSON array
+// string. It is test executed so a template that can't render is rejected up front.
+func LoadTableTemplate(filename string) (*template.Template, error) {
+	t, err := template.ParseFiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(ioutil.Discard, "[]"); err != nil {
+		return nil, fmt.Errorf("failed to execute template %s: %w", filename, err)
+	}
+	return t, nil
+}
+
+// tableTemplate is the template for the running and history tables
+func (s *MongoSlow) tableTemplate() *template.Template {
+	if s.TableTemplate == nil {
+		return defaultTableTemplate
+	}
+	return s.TableTemplate
+}
+
+// RunningQueryTableHandler will output the running queries in a datatable, filtered by ?min_secs=N like the json
 func RunningQueryTableHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
-	t := template.Must(template.New("table").Parse(queriesHTML))
 	return func(w http.ResponseWriter, r *http.Request) {
-		var queries []*Query
+		minMicros, err := minRunningMicros(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queries := []*Query{}
+		slow.mu.RLock()
 		for _, query := range slow.runningQueries {
-			queries = append(queries, query)
+			if query.RunningMicros >= minMicros {
+				queries = append(queries, query)
+			}
 		}
-		w.Header().Set("content-type", "text/html")
-		j, _ := json.Marshal(queries)
-		t.Execute(w, string(j))
+		slow.mu.RUnlock()
+		writeTable(w, r, slow, queries)
 	}
 }
 
-// HistoryQueryTableHandler will output the running queries in a datatable
-func HistoryQueryTableHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
-	t := template.Must(template.New("table").Parse(queriesHTML))
+// writeTable renders the queries into the table template, without their raw documents unless asked for like the json
+func writeTable(w http.ResponseWriter, r *http.Request, slow *MongoSlow, queries []*Query) {
+	j, err := json.Marshal(prepareAll(queries, rawDocuments(r)))
+	if err != nil {
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("failed to encode queries for the table")
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": "failed to encode queries: " + err.Error()})
+		return
+	}
+	w.Header().Set("content-type", "text/html")
+	writeTemplate(w, r, slow.tableTemplate(), string(j))
+}
+
+// snapshot is the data the snapshot template is executed with
+type snapshot struct {
+	Generated time.Time
+	Queries   []*Query
+}
+
+// RunningQuerySnapshotHandler will output the running queries as a standalone html file to download, rendered on the
+// server with no scripts or external assets so it can be attached to a ticket
+func RunningQuerySnapshotHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	t := htmltemplate.Must(htmltemplate.New("snapshot").Parse(snapshotHTML))
 	return func(w http.ResponseWriter, r *http.Request) {
-		var queries []*Query
-		slow.history.Do(func(p interface{}) {
-			if p != nil {
-				queries = append(queries, p.(*Query))
-			}
+		data := snapshot{Generated: time.Now().UTC()}
+		slow.mu.RLock()
+		for _, query := range slow.runningQueries {
+			data.Queries = append(data.Queries, query)
+		}
+		slow.mu.RUnlock()
+		sort.Slice(data.Queries, func(i, j int) bool {
+			return data.Queries[i].RunningMicros > data.Queries[j].RunningMicros
 		})
 		w.Header().Set("content-type", "text/html")
-		j, _ := json.Marshal(queries)
-		t.Execute(w, string(j))
+		w.Header().Set("content-disposition",
+			fmt.Sprintf(`attachment; filename="slow-queries-%s.html"`, data.Generated.Format("20060102-150405")))
+		writeTemplate(w, r, t, data)
+	}
+}
+
+// HistoryQueryTableHandler will output the history queries in a datatable, filtered like the json
+func HistoryQueryTableHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keep, err := historyFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queries := slow.filterHistory(keep)
+		writeTable(w, r, slow, queries)
+	}
+}
+
+// PauseHandler pauses polling on POST, see MongoSlow.Pause
+func PauseHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return pausedHandler(slow, true)
+}
+
+// ResumeHandler resumes polling on POST
+func ResumeHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return pausedHandler(slow, false)
+}
+
+func pausedHandler(slow *MongoSlow, pause bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if pause {
+			slow.Pause()
+			log.Info().Str("remote", r.RemoteAddr).Msg("monitoring paused")
+		} else {
+			slow.Resume()
+			log.Info().Str("remote", r.RemoteAddr).Msg("monitoring resumed")
+		}
+		writeJSON(w, r, http.StatusOK, map[string]bool{"paused": slow.Paused()})
+	}
+}
+
+// StatsHandler will output the internal poll loop counters
+func StatsHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, slow.Stats())
 	}
 }
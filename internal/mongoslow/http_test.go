@@ -0,0 +1,578 @@
+package mongoslow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStatsHandler(t *testing.T) {
+	Convey("Given a number of polls with one unparseable entry", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), op(2, 1000000, "foo.baz"), {"op": "none"}},
+			{op(1, 2000000, "foo.bar")},
+			{op(1, 3000000, "foo.bar")},
+		}}
+		slow := NewWithRunner(runner)
+		for i := 0; i < 3; i++ {
+			So(slow.poll(context.Background()), ShouldBeNil)
+		}
+
+		rec := httptest.NewRecorder()
+		StatsHandler(slow)(rec, httptest.NewRequest("GET", "/stats.json", nil))
+		So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+
+		var stats Stats
+		So(json.Unmarshal(rec.Body.Bytes(), &stats), ShouldBeNil)
+		So(stats.Polls, ShouldEqual, 3)
+		So(stats.ParseFailures, ShouldEqual, 1)
+		So(stats.TrackedOpIDs, ShouldEqual, 1)
+		So(stats.Reconnects, ShouldEqual, 0)
+		So(stats.LastPollDurationSec, ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestGrafanaDashboardHandler(t *testing.T) {
+	Convey("Given the dashboard rendered for the mongo subsystem", t, func() {
+		handler, err := GrafanaDashboardHandler("mongo")
+		So(err, ShouldBeNil)
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/grafana/dashboard.json", nil))
+		So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+
+		var dashboard map[string]interface{}
+		So(json.Unmarshal(rec.Body.Bytes(), &dashboard), ShouldBeNil)
+		So(dashboard["title"], ShouldEqual, "Mongo Slow Queries")
+
+		body := rec.Body.String()
+		So(body, ShouldContainSubstring, "mongo_slow_query_seconds_total")
+		So(body, ShouldContainSubstring, "mongo_slow_query_secs_bucket")
+		So(body, ShouldContainSubstring, "mongo_db_slow_secs")
+		So(body, ShouldContainSubstring, "mongo_auth_errors_total")
+		So(body, ShouldContainSubstring, "{{ns}}")
+	})
+
+	Convey("Given a different subsystem", t, func() {
+		handler, err := GrafanaDashboardHandler("slowmon")
+		So(err, ShouldBeNil)
+
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/grafana/dashboard.json", nil))
+		So(rec.Body.String(), ShouldContainSubstring, "slowmon_slow_query_seconds_total")
+		So(rec.Body.String(), ShouldNotContainSubstring, "mongo_slow_query_seconds_total")
+	})
+}
+
+func TestPrettyJSON(t *testing.T) {
+	Convey("Given a running query", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar")}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		get := func(url string) string {
+			rec := httptest.NewRecorder()
+			SlowQueryHandler(slow)(rec, httptest.NewRequest("GET", url, nil))
+			return rec.Body.String()
+		}
+
+		Convey("The output is compact by default", func() {
+			out := get("/running.json")
+			So(out, ShouldStartWith, `{"1":{"opid":1,`)
+			So(strings.Count(out, "\n"), ShouldEqual, 1)
+		})
+
+		Convey("The output is indented with pretty=true", func() {
+			out := get("/running.json?pretty=true")
+			So(out, ShouldStartWith, "{\n  \"1\": {\n    \"opid\": 1,")
+
+			var running map[string]*Query
+			So(json.Unmarshal([]byte(out), &running), ShouldBeNil)
+			So(running["1"].Namespace, ShouldEqual, "foo.bar")
+		})
+
+		Convey("The history is indented with pretty=true", func() {
+			slow.History(slow.runningQueries[1])
+			rec := httptest.NewRecorder()
+			HistoryQueryHandler(slow)(rec, httptest.NewRequest("GET", "/history.json?pretty=1", nil))
+			So(rec.Body.String(), ShouldStartWith, "[\n  {\n")
+		})
+	})
+}
+
+func TestRunningQuerySnapshotHandler(t *testing.T) {
+	Convey("Given two running queries", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), op(2, 5000000, "orders.<script>")},
+		}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		rec := httptest.NewRecorder()
+		RunningQuerySnapshotHandler(slow)(rec, httptest.NewRequest("GET", "/running/snapshot.html", nil))
+		body := rec.Body.String()
+
+		Convey("It is downloaded as an attachment", func() {
+			So(rec.Header().Get("content-type"), ShouldEqual, "text/html")
+			So(rec.Header().Get("content-disposition"), ShouldStartWith, `attachment; filename="slow-queries-`)
+		})
+
+		Convey("The data is inlined, slowest first and escaped", func() {
+			So(body, ShouldContainSubstring, "<td>foo.bar</td>")
+			So(body, ShouldContainSubstring, "<td>orders.&lt;script&gt;</td>")
+			So(strings.Index(body, "<td>5000000</td>"), ShouldBeLessThan, strings.Index(body, "<td>1000000</td>"))
+		})
+
+		Convey("It has no scripts or external asset references", func() {
+			So(body, ShouldNotContainSubstring, "<script")
+			So(body, ShouldNotContainSubstring, "<link")
+			So(body, ShouldNotContainSubstring, "http://")
+			So(body, ShouldNotContainSubstring, "https://")
+			So(body, ShouldNotContainSubstring, " src=")
+		})
+	})
+}
+
+func TestRawQueryHandler(t *testing.T) {
+	Convey("Given a running query with bson typed fields", t, func() {
+		id, _ := primitive.ObjectIDFromHex("5f1d7a2b9c3e4d5f6a7b8c9d")
+		entry := op(7, 1000000, "foo.bar")
+		entry["command"] = primitive.M{"find": "bar", "filter": primitive.M{"_id": id}}
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{entry}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		r := mux.NewRouter()
+		r.HandleFunc("/running/{opid}/raw.json", RawQueryHandler(slow))
+		get := func(url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		Convey("The raw document round trips as extended JSON", func() {
+			rec := get("/running/7/raw.json")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+			So(rec.Body.String(), ShouldContainSubstring, `{"$oid":"5f1d7a2b9c3e4d5f6a7b8c9d"}`)
+
+			var raw struct {
+				OperationID int32  `bson:"opid"`
+				Namespace   string `bson:"ns"`
+				Command     struct {
+					Find   string `bson:"find"`
+					Filter struct {
+						ID primitive.ObjectID `bson:"_id"`
+					} `bson:"filter"`
+				} `bson:"command"`
+			}
+			So(bson.UnmarshalExtJSON(rec.Body.Bytes(), false, &raw), ShouldBeNil)
+			So(raw.OperationID, ShouldEqual, 7)
+			So(raw.Namespace, ShouldEqual, "foo.bar")
+			So(raw.Command.Find, ShouldEqual, "bar")
+			So(raw.Command.Filter.ID, ShouldEqual, id)
+		})
+
+		Convey("An opid that isn't running is not found", func() {
+			So(get("/running/8/raw.json").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("An invalid opid is rejected", func() {
+			So(get("/running/abc/raw.json").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	Convey("Given a MongoSlow whose first poll fails", t, func() {
+		runner := &fakeRunner{err: errors.New("connection refused")}
+		slow := NewWithRunner(runner)
+		So(slow.poll(context.Background()), ShouldNotBeNil)
+
+		get := func(handler func(w http.ResponseWriter, r *http.Request), url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		Convey("It is not ready and the json handlers say it is initializing", func() {
+			So(slow.Ready(), ShouldBeFalse)
+			rec := get(ReadyHandler(slow), "/ready")
+			So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(rec.Body.String(), ShouldEqual, "{\"ready\":false}\n")
+
+			So(get(SlowQueryHandler(slow), "/running.json").Body.String(), ShouldEqual, "{\"initializing\":true}\n")
+			So(get(HistoryQueryHandler(slow), "/history.json").Body.String(), ShouldEqual, "{\"initializing\":true}\n")
+			So(get(ConnectionsHandler(slow), "/connections.json").Body.String(), ShouldEqual, "{\"initializing\":true}\n")
+		})
+
+		Convey("It is ready after the first successful poll", func() {
+			runner.err = nil
+			runner.polls = [][]primitive.M{{op(1, 1000000, "foo.bar")}}
+			So(slow.poll(context.Background()), ShouldBeNil)
+
+			So(slow.Ready(), ShouldBeTrue)
+			rec := get(ReadyHandler(slow), "/ready")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "{\"ready\":true}\n")
+			So(get(SlowQueryHandler(slow), "/running.json").Body.String(), ShouldStartWith, `{"1":{"opid":1,`)
+
+			Convey("And stays ready if a later poll fails", func() {
+				runner.err = errors.New("connection refused")
+				So(slow.poll(context.Background()), ShouldNotBeNil)
+				So(slow.Ready(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestEmptyState(t *testing.T) {
+	Convey("Given a poll with no running queries and an empty history", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		get := func(handler func(w http.ResponseWriter, r *http.Request), url string) string {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", url, nil))
+			return rec.Body.String()
+		}
+
+		Convey("The json handlers return empty objects and arrays", func() {
+			So(get(SlowQueryHandler(slow), "/running.json"), ShouldEqual, "{}\n")
+			So(get(HistoryQueryHandler(slow), "/history.json"), ShouldEqual, "[]\n")
+			So(get(ConnectionsHandler(slow), "/connections.json"), ShouldEqual, "[]\n")
+			So(get(IdleHandler(slow), "/idle.json"), ShouldEqual, "[]\n")
+		})
+
+		Convey("The tables are given an empty array", func() {
+			for _, body := range []string{
+				get(RunningQueryTableHandler(slow), "/running"),
+				get(HistoryQueryTableHandler(slow), "/history"),
+			} {
+				So(body, ShouldContainSubstring, `"aaData":[],`)
+				So(body, ShouldNotContainSubstring, "null")
+			}
+		})
+	})
+}
+
+func TestTableTemplate(t *testing.T) {
+	Convey("Given a custom table template file", t, func() {
+		filename := filepath.Join(t.TempDir(), "queries.html")
+		So(ioutil.WriteFile(filename, []byte(`<h1>ACME queries</h1><script>var data = {{.}};</script>`), 0644), ShouldBeNil)
+
+		tmpl, err := LoadTableTemplate(filename)
+		So(err, ShouldBeNil)
+
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar")}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		slow.TableTemplate = tmpl
+
+		Convey("It renders the running queries instead of the embedded one", func() {
+			rec := httptest.NewRecorder()
+			RunningQueryTableHandler(slow)(rec, httptest.NewRequest("GET", "/running", nil))
+			So(rec.Body.String(), ShouldStartWith, `<h1>ACME queries</h1><script>var data = [{"opid":1,`)
+			So(rec.Body.String(), ShouldNotContainSubstring, "DataTable")
+		})
+	})
+
+	Convey("Given template files that don't parse or execute", t, func() {
+		dir := t.TempDir()
+		unparseable := filepath.Join(dir, "unparseable.html")
+		So(ioutil.WriteFile(unparseable, []byte(`{{.`), 0644), ShouldBeNil)
+		unexecutable := filepath.Join(dir, "unexecutable.html")
+		So(ioutil.WriteFile(unexecutable, []byte(`{{.Queries}}`), 0644), ShouldBeNil)
+
+		_, err := LoadTableTemplate(unparseable)
+		So(err, ShouldNotBeNil)
+		_, err = LoadTableTemplate(unexecutable)
+		So(err, ShouldNotBeNil)
+		_, err = LoadTableTemplate(filepath.Join(dir, "missing.html"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMinSecsFilter(t *testing.T) {
+	Convey("Given queries running for one, five and ten seconds", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), op(2, 5000000, "foo.baz"), op(3, 10000000, "foo.qux")},
+		}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		get := func(handler func(w http.ResponseWriter, r *http.Request), url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		Convey("Only the queries running at least min_secs are returned", func() {
+			var running map[string]*Query
+			So(json.Unmarshal(get(SlowQueryHandler(slow), "/running.json?min_secs=5").Body.Bytes(), &running), ShouldBeNil)
+			So(running, ShouldHaveLength, 2)
+			So(running, ShouldContainKey, "2")
+			So(running, ShouldContainKey, "3")
+
+			var slowest map[string]*Query
+			So(json.Unmarshal(get(SlowQueryHandler(slow), "/running.json?min_secs=7.5").Body.Bytes(), &slowest), ShouldBeNil)
+			So(slowest, ShouldHaveLength, 1)
+		})
+
+		Convey("It combines with pretty", func() {
+			body := get(SlowQueryHandler(slow), "/running.json?min_secs=10&pretty=true").Body.String()
+			So(body, ShouldStartWith, "{\n  \"3\": {\n")
+		})
+
+		Convey("The table is filtered too", func() {
+			body := get(RunningQueryTableHandler(slow), "/running?min_secs=5").Body.String()
+			So(body, ShouldContainSubstring, "foo.baz")
+			So(body, ShouldNotContainSubstring, "foo.bar")
+		})
+
+		Convey("An invalid threshold is rejected", func() {
+			So(get(SlowQueryHandler(slow), "/running.json?min_secs=soon").Code, ShouldEqual, http.StatusBadRequest)
+			So(get(RunningQueryTableHandler(slow), "/running?min_secs=-1").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestAllQueriesHandler(t *testing.T) {
+	Convey("Given running queries and a history", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 6000000, "foo.bar"), op(2, 7000000, "foo.baz"), op(3, 8000000, "foo.qux")},
+			{op(3, 9000000, "foo.qux"), op(4, 1000000, "foo.a"), op(5, 2000000, "foo.b")},
+		}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		get := func(url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			AllQueriesHandler(slow)(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		Convey("Both sections are populated, slowest and newest first", func() {
+			var all map[string][]*Query
+			So(json.Unmarshal(get("/all.json").Body.Bytes(), &all), ShouldBeNil)
+			So(all, ShouldHaveLength, 2)
+			So(all["running"], ShouldHaveLength, 3)
+			So(all["running"][0].OperationID, ShouldEqual, 3)
+			So(all["running"][2].OperationID, ShouldEqual, 4)
+			So(all["history"], ShouldHaveLength, 2)
+		})
+
+		Convey("The selector limits the output", func() {
+			var all map[string][]*Query
+			So(json.Unmarshal(get("/all.json?include=history").Body.Bytes(), &all), ShouldBeNil)
+			So(all, ShouldHaveLength, 1)
+			So(all, ShouldContainKey, "history")
+		})
+
+		Convey("An unknown section is rejected", func() {
+			So(get("/all.json?include=running,idle").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestHistoryFilter(t *testing.T) {
+	Convey("Given a history of queries from two users on two collections", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		slow.History(&Query{OperationID: 1, EffectiveUser: "orders-api", Namespace: "shop.orders", RunningMicros: 6000000})
+		slow.History(&Query{OperationID: 2, EffectiveUser: "orders-api", Namespace: "shop.carts", RunningMicros: 9000000})
+		slow.History(&Query{OperationID: 3, EffectiveUser: "reporting", Namespace: "shop.orders", RunningMicros: 30000000})
+
+		history := func(url string) []*Query {
+			rec := httptest.NewRecorder()
+			HistoryQueryHandler(slow)(rec, httptest.NewRequest("GET", url, nil))
+			var queries []*Query
+			So(json.Unmarshal(rec.Body.Bytes(), &queries), ShouldBeNil)
+			return queries
+		}
+		opids := func(queries []*Query) []int32 {
+			ids := []int32{}
+			for _, q := range queries {
+				ids = append(ids, q.OperationID)
+			}
+			return ids
+		}
+
+		Convey("The filters narrow the history", func() {
+			So(opids(history("/history.json")), ShouldResemble, []int32{1, 2, 3})
+			So(opids(history("/history.json?ns=orders")), ShouldResemble, []int32{1, 3})
+			So(opids(history("/history.json?user=orders-api")), ShouldResemble, []int32{1, 2})
+			So(opids(history("/history.json?min_secs=8")), ShouldResemble, []int32{2, 3})
+			So(opids(history("/history.json?ns=shop.orders&user=orders&min_secs=1")), ShouldResemble, []int32{1})
+			So(opids(history("/history.json?user=nobody")), ShouldResemble, []int32{})
+		})
+
+		Convey("The table is filtered too", func() {
+			rec := httptest.NewRecorder()
+			HistoryQueryTableHandler(slow)(rec, httptest.NewRequest("GET", "/history?user=reporting", nil))
+			So(rec.Body.String(), ShouldContainSubstring, `"opid":3`)
+			So(rec.Body.String(), ShouldNotContainSubstring, `"opid":1`)
+		})
+
+		Convey("An invalid threshold is rejected", func() {
+			rec := httptest.NewRecorder()
+			HistoryQueryHandler(slow)(rec, httptest.NewRequest("GET", "/history.json?min_secs=x", nil))
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestPauseHandler(t *testing.T) {
+	Convey("Given the pause and resume handlers", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		call := func(handler func(w http.ResponseWriter, r *http.Request), method string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(method, "/", nil))
+			return rec
+		}
+
+		Convey("POST /pause pauses and shows in the stats", func() {
+			rec := call(PauseHandler(slow), "POST")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "{\"paused\":true}\n")
+			So(call(StatsHandler(slow), "GET").Body.String(), ShouldContainSubstring, `"paused":true`)
+
+			So(call(ResumeHandler(slow), "POST").Body.String(), ShouldEqual, "{\"paused\":false}\n")
+			So(slow.Paused(), ShouldBeFalse)
+		})
+
+		Convey("Other methods are rejected", func() {
+			rec := call(PauseHandler(slow), "GET")
+			So(rec.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(slow.Paused(), ShouldBeFalse)
+		})
+	})
+}
+
+// failingWriter is a response writer whose client has gone away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (f failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// stalledWriter is a response writer whose client stops reading, Write blocks until release is closed
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s stalledWriter) Write(b []byte) (int, error) {
+	close(s.writing)
+	<-s.release
+	return s.ResponseRecorder.Write(b)
+}
+
+func TestStalledClient(t *testing.T) {
+	Convey("Given a client that stops reading the running queries", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar")}, {}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		w := stalledWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+		done := make(chan struct{})
+		go func() {
+			SlowQueryHandler(slow)(w, httptest.NewRequest("GET", "/running.json", nil))
+			close(done)
+		}()
+		<-w.writing
+
+		Convey("The poll isn't blocked by the write", func() {
+			polled := make(chan error, 1)
+			go func() { polled <- slow.poll(context.Background()) }()
+			select {
+			case err := <-polled:
+				So(err, ShouldBeNil)
+			case <-time.After(time.Second):
+				So("poll blocked", ShouldBeEmpty)
+			}
+			close(w.release)
+			<-done
+			So(w.Body.String(), ShouldContainSubstring, "foo.bar")
+		})
+	})
+}
+
+func TestWriteJSON(t *testing.T) {
+	Convey("Given the log captured", t, func() {
+		var logs bytes.Buffer
+		defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+		log.Logger = zerolog.New(&logs)
+
+		Convey("A failed write is logged", func() {
+			slow := NewWithRunner(&fakeRunner{})
+			StatsHandler(slow)(failingWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/stats.json", nil))
+			So(logs.String(), ShouldContainSubstring, "failed to write json response")
+			So(logs.String(), ShouldContainSubstring, "broken pipe")
+			So(logs.String(), ShouldContainSubstring, "/stats.json")
+		})
+
+		Convey("An encode failure is logged and sent as a 500 with a JSON error", func() {
+			rec := httptest.NewRecorder()
+			writeJSON(rec, httptest.NewRequest("GET", "/running.json", nil), http.StatusOK, map[string]float64{"secs": math.Inf(1)})
+			So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+			So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+			var body map[string]string
+			So(json.Unmarshal(rec.Body.Bytes(), &body), ShouldBeNil)
+			So(body["error"], ShouldContainSubstring, "unsupported value")
+			So(logs.String(), ShouldContainSubstring, "failed to encode json response")
+		})
+
+		Convey("A template failure is sent as a 500 instead of a partial page", func() {
+			slow := NewWithRunner(&fakeRunner{})
+			slow.TableTemplate = template.Must(template.New("table").Parse(`<table>{{template "missing"}}</table>`))
+			rec := httptest.NewRecorder()
+			HistoryQueryTableHandler(slow)(rec, httptest.NewRequest("GET", "/history", nil))
+			So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+			So(rec.Body.String(), ShouldNotContainSubstring, "<table>")
+			So(logs.String(), ShouldContainSubstring, "failed to execute template")
+		})
+	})
+}
+
+func TestRawDocuments(t *testing.T) {
+	Convey("Given a running query and one in the history", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 2000000, "foo.bar")}}})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		slow.History(&Query{OperationID: 2, Namespace: "foo.baz", Raw: Document{"opid": int32(2)}})
+
+		get := func(handler func(w http.ResponseWriter, r *http.Request), url string) string {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", url, nil))
+			return rec.Body.String()
+		}
+
+		Convey("The raw documents are left out by default", func() {
+			So(get(SlowQueryHandler(slow), "/running.json"), ShouldNotContainSubstring, `"raw"`)
+			So(get(HistoryQueryHandler(slow), "/history.json"), ShouldNotContainSubstring, `"raw"`)
+			So(get(AllQueriesHandler(slow), "/all.json"), ShouldNotContainSubstring, `"raw"`)
+			So(slow.runningQueries[1].Raw, ShouldNotBeNil)
+		})
+
+		Convey("They are included when asked for", func() {
+			var running map[string]map[string]interface{}
+			So(json.Unmarshal([]byte(get(SlowQueryHandler(slow), "/running.json?raw=true")), &running), ShouldBeNil)
+			So(running["1"], ShouldContainKey, "raw")
+			So(get(HistoryQueryHandler(slow), "/history.json?raw=true"), ShouldContainSubstring, `"raw":{"opid":2}`)
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package mongoslow
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// currentOp entry types for idle cursors and sessions, as reported in the type field
+const (
+	typeIdleCursor  = "idleCursor"
+	typeIdleSession = "idleSession"
+)
+
+// IdleOptions selects the idle entries included in currentOp, used to look for leaked cursors and sessions
+type IdleOptions struct {
+	Cursors  bool // include idle cursors
+	Sessions bool // include idle sessions
+}
+
+// ErrIdleNotSupported is returned by IncludeIdle when the currentOp source can't include idle entries, e.g. a replay
+// file
+var ErrIdleNotSupported = errors.New("idle cursors and sessions are not supported by this currentOp source")
+
+// IdleRunner is a currentOp source that can include idle cursors and sessions, implemented by the mongo runner
+type IdleRunner interface {
+	SetIdle(opts IdleOptions)
+}
+
+func (m *mongoRunner) SetIdle(opts IdleOptions) {
+	m.idle = opts
+}
+
+// currentOpAggregate runs the $currentOp aggregation, the currentOp command can't include idle cursors and sessions
+func (m *mongoRunner) currentOpAggregate(ctx context.Context) ([]primitive.M, error) {
+	cursor, err := m.client.Database(m.monitorDatabase()).Aggregate(ctx, currentOpPipeline(m.idle))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var ops []primitive.M
+	for cursor.Next(ctx) {
+		op, err := decodeOperation(cursor.Current)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// currentOpPipeline builds the $currentOp pipeline, seeing the same operations as currentOp with $all plus the
+// selected idle entries. idleSessions defaults to true so is always set.
+func currentOpPipeline(opts IdleOptions) bson.A {
+	return bson.A{
+		bson.D{{Key: "$currentOp", Value: bson.D{
+			{Key: "allUsers", Value: true},
+			{Key: "idleConnections", Value: true},
+			{Key: "idleCursors", Value: opts.Cursors},
+			{Key: "idleSessions", Value: opts.Sessions},
+		}}},
+	}
+}
+
+// IncludeIdle includes idle cursors and sessions in currentOp, they are kept apart from the slow queries, see Idle
+func (s *MongoSlow) IncludeIdle(opts IdleOptions) error {
+	runner, ok := s.runner.(IdleRunner)
+	if !ok {
+		return ErrIdleNotSupported
+	}
+	runner.SetIdle(opts)
+	return nil
+}
+
+// IdleEntry is an idle cursor or session seen by currentOp
+type IdleEntry struct {
+	Type         string   `json:"type"` // idleCursor or idleSession
+	Namespace    string   `json:"ns,omitempty"`
+	ConnectionID int64    `json:"connection_id,omitempty"`
+	Raw          Document `json:"raw"`
+}
+
+// parseIdle returns the idle entry for a currentOp entry, or nil if it isn't an idle cursor or session
+func parseIdle(entry primitive.M) *IdleEntry {
+	kind, _ := entry["type"].(string)
+	if kind != typeIdleCursor && kind != typeIdleSession {
+		return nil
+	}
+	idle := &IdleEntry{Type: kind, Raw: Document(entry)}
+	idle.Namespace, _ = entry["ns"].(string)
+	idle.ConnectionID, _ = intValue(entry["connectionId"])
+	return idle
+}
+
+// Idle returns the idle cursors and sessions seen by the last poll
+func (s *MongoSlow) Idle() []*IdleEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idle
+}
+
+// IdleHandler will output the idle cursors and sessions seen by the last poll
+func IdleHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if initializing(w, r, slow) {
+			return
+		}
+		idle := slow.Idle()
+		if idle == nil {
+			idle = []*IdleEntry{}
+		}
+		writeJSON(w, r, http.StatusOK, idle)
+	}
+}
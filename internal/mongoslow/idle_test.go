@@ -0,0 +1,70 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCurrentOpPipeline(t *testing.T) {
+	Convey("Given idle cursors but not sessions", t, func() {
+		pipeline := currentOpPipeline(IdleOptions{Cursors: true})
+
+		Convey("The $currentOp stage sees all operations and only idle cursors", func() {
+			So(pipeline, ShouldResemble, bson.A{
+				bson.D{{Key: "$currentOp", Value: bson.D{
+					{Key: "allUsers", Value: true},
+					{Key: "idleConnections", Value: true},
+					{Key: "idleCursors", Value: true},
+					{Key: "idleSessions", Value: false},
+				}}},
+			})
+		})
+	})
+
+	Convey("Given the mongo runner", t, func() {
+		runner := &mongoRunner{}
+		slow := NewWithRunner(runner)
+
+		Convey("The idle options are passed on to it", func() {
+			So(slow.IncludeIdle(IdleOptions{Sessions: true}), ShouldBeNil)
+			So(runner.idle, ShouldResemble, IdleOptions{Sessions: true})
+		})
+	})
+
+	Convey("Given a replay source", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.IncludeIdle(IdleOptions{Cursors: true}), ShouldEqual, ErrIdleNotSupported)
+	})
+}
+
+func TestIdleEntries(t *testing.T) {
+	Convey("Given a poll with a running query, an idle cursor and an idle session", t, func() {
+		cursor := primitive.M{"type": "idleCursor", "ns": "foo.bar", "connectionId": int32(17), "cursor": primitive.M{"cursorId": int64(99)}}
+		session := primitive.M{"type": "idleSession", "lsid": primitive.M{"id": "abc"}}
+		counter := newTestCounter()
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar"), cursor, session}}})
+		slow.QueryCounter = counter
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("The idle entries are tagged and kept apart", func() {
+			So(slow.Idle(), ShouldResemble, []*IdleEntry{
+				{Type: "idleCursor", Namespace: "foo.bar", ConnectionID: 17, Raw: Document(cursor)},
+				{Type: "idleSession", Raw: Document(session)},
+			})
+			stats := slow.Stats()
+			So(stats.IdleCursors, ShouldEqual, 1)
+			So(stats.IdleSessions, ShouldEqual, 1)
+		})
+
+		Convey("They are not slow queries or parse failures", func() {
+			So(slow.runningQueries, ShouldHaveLength, 1)
+			So(testutil.CollectAndCount(counter), ShouldEqual, 1)
+			So(slow.Stats().ParseFailures, ShouldEqual, 0)
+		})
+	})
+}
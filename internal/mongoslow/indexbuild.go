@@ -0,0 +1,86 @@
+package mongoslow
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// isIndexBuild reports whether a currentOp entry is an index build, either the createIndexes command or the index
+// build thread, whose msg reads e.g. "Index Build: scanning collection"
+func isIndexBuild(query primitive.M) bool {
+	switch command := query["command"].(type) {
+	case primitive.M:
+		if _, ok := command["createIndexes"]; ok {
+			return true
+		}
+	case primitive.D:
+		if len(command) > 0 && command[0].Key == "createIndexes" {
+			return true
+		}
+	}
+	msg, _ := query["msg"].(string)
+	return strings.HasPrefix(msg, "Index Build")
+}
+
+// parseIndexBuild flags index builds, with the percentage done from the progress document if there is one
+func parseIndexBuild(q *Query, query primitive.M) {
+	if !isIndexBuild(query) {
+		return
+	}
+	q.IndexBuild = true
+	progress, ok := query["progress"].(primitive.M)
+	if !ok {
+		return
+	}
+	done, ok := intValue(progress["done"])
+	total, ok2 := intValue(progress["total"])
+	if ok && ok2 && total > 0 {
+		pct := float64(done) / float64(total) * 100
+		q.ProgressPct = &pct
+	}
+}
+
+// setIndexBuildGauges sets the index build gauges to the longest running index build of each namespace, removing
+// the namespaces that no longer have one
+func (s *MongoSlow) setIndexBuildGauges() {
+	if s.IndexBuildGauge == nil && s.IndexBuildProgress == nil {
+		return
+	}
+	builds := make(map[string]*Query)
+	for _, q := range s.runningQueries {
+		if !q.IndexBuild {
+			continue
+		}
+		if longest, ok := builds[q.Namespace]; !ok || q.RunningMicros > longest.RunningMicros {
+			builds[q.Namespace] = q
+		}
+	}
+	for ns := range s.indexBuilds {
+		if _, ok := builds[ns]; !ok {
+			deleteGauge(s.IndexBuildGauge, ns)
+			deleteGauge(s.IndexBuildProgress, ns)
+		}
+	}
+	s.indexBuilds = make(map[string]bool, len(builds))
+	for ns, q := range builds {
+		s.indexBuilds[ns] = true
+		if s.IndexBuildGauge != nil {
+			s.IndexBuildGauge.WithLabelValues(ns).Set(float64(q.RunningMicros) / 1000000)
+		}
+		if s.IndexBuildProgress != nil {
+			if q.ProgressPct != nil {
+				s.IndexBuildProgress.WithLabelValues(ns).Set(*q.ProgressPct)
+			} else {
+				s.IndexBuildProgress.DeleteLabelValues(ns)
+			}
+		}
+	}
+}
+
+func deleteGauge(gauge *prometheus.GaugeVec, values ...string) {
+	if gauge != nil {
+		gauge.DeleteLabelValues(values...)
+	}
+}
@@ -0,0 +1,80 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// indexBuildOp is a currentOp entry for a createIndexes with its progress
+func indexBuildOp(opid int32, micros int64, ns string, done, total int64) primitive.M {
+	entry := op(opid, micros, ns)
+	entry["op"] = "command"
+	entry["command"] = primitive.M{"createIndexes": "bar", "indexes": primitive.A{primitive.M{"key": primitive.M{"a": 1}, "name": "a_1"}}}
+	entry["msg"] = "Index Build: scanning collection"
+	entry["progress"] = primitive.M{"done": done, "total": total}
+	return entry
+}
+
+func TestParseIndexBuild(t *testing.T) {
+	Convey("Given a createIndexes op with its progress", t, func() {
+		q, err := Parse(indexBuildOp(1, 60000000, "foo.bar", 250, 1000))
+		So(err, ShouldBeNil)
+		So(q.IndexBuild, ShouldBeTrue)
+		So(*q.ProgressPct, ShouldEqual, 25)
+	})
+
+	Convey("Given the index build thread without a command", t, func() {
+		entry := op(1, 60000000, "foo.bar")
+		entry["msg"] = "Index Build (background): 1200/5000 24%"
+		q, err := Parse(entry)
+		So(err, ShouldBeNil)
+		So(q.IndexBuild, ShouldBeTrue)
+		So(q.ProgressPct, ShouldBeNil)
+	})
+
+	Convey("Given a regular query", t, func() {
+		q, err := Parse(op(1, 60000000, "foo.bar"))
+		So(err, ShouldBeNil)
+		So(q.IndexBuild, ShouldBeFalse)
+	})
+}
+
+func TestIndexBuildMetrics(t *testing.T) {
+	Convey("Given an index build running alongside a slow query", t, func() {
+		counter := newTestCounter()
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "index_build_secs"}, []string{"ns"})
+		progress := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "index_build_progress_pct"}, []string{"ns"})
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), indexBuildOp(2, 30000000, "foo.bar", 100, 400)},
+			{op(1, 2000000, "foo.bar"), indexBuildOp(2, 40000000, "foo.bar", 300, 400)},
+			{},
+		}})
+		slow.QueryCounter = counter
+		slow.IndexBuildGauge = gauge
+		slow.IndexBuildProgress = progress
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("The index build is left out of the slow query counter", func() {
+			So(testutil.CollectAndCount(counter), ShouldEqual, 1)
+			So(testutil.ToFloat64(counter.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 2000)
+		})
+
+		Convey("It has its own running time and progress", func() {
+			So(testutil.ToFloat64(gauge.WithLabelValues("foo.bar")), ShouldEqual, 40)
+			So(testutil.ToFloat64(progress.WithLabelValues("foo.bar")), ShouldEqual, 75)
+
+			Convey("Which are dropped once it completes", func() {
+				So(slow.poll(context.Background()), ShouldBeNil)
+				So(testutil.CollectAndCount(gauge), ShouldEqual, 0)
+				So(testutil.CollectAndCount(progress), ShouldEqual, 0)
+			})
+		})
+	})
+}
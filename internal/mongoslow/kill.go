@@ -0,0 +1,85 @@
+package mongoslow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultKillComment is the default KillComment template, it is executed with a KillInfo
+const DefaultKillComment = "killed by go-mongo-slow-queries: {{.Reason}}"
+
+// KillInfo is the data the kill comment template is executed with
+type KillInfo struct {
+	OperationID int32
+	Reason      string
+}
+
+// ErrKillNotSupported is returned by KillOp when the currentOp source can't run commands, e.g. a replay file
+var ErrKillNotSupported = errors.New("killOp is not supported by this currentOp source")
+
+// CommandRunner runs a command against the database currentOp is run against, admin unless set with
+// MonitorDatabase, implemented by the mongo runner
+type CommandRunner interface {
+	RunCommand(ctx context.Context, cmd bson.D) error
+}
+
+func (m *mongoRunner) RunCommand(ctx context.Context, cmd bson.D) error {
+	return m.client.Database(m.monitorDatabase()).RunCommand(ctx, cmd).Err()
+}
+
+// KillOp kills the operation with killOp, tagging the command with the KillComment so mongo's own logs record why.
+// killOp goes to the same database as currentOp, so services that only expose another database can kill too.
+func (s *MongoSlow) KillOp(ctx context.Context, opid int32, reason string) error {
+	runner, ok := s.runner.(CommandRunner)
+	if !ok {
+		return ErrKillNotSupported
+	}
+	comment, err := s.killComment(KillInfo{OperationID: opid, Reason: reason})
+	if err != nil {
+		return err
+	}
+	return runner.RunCommand(ctx, killOpCommand(opid, comment))
+}
+
+// killComment renders the comment for a killOp
+func (s *MongoSlow) killComment(info KillInfo) (string, error) {
+	tmpl := s.KillComment
+	if tmpl == nil {
+		tmpl = defaultKillComment
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var defaultKillComment = template.Must(ParseKillComment(DefaultKillComment))
+
+// ParseKillComment parses a KillComment template. It is test executed so a template referring to a field KillInfo
+// doesn't have is rejected up front rather than on the first kill.
+func ParseKillComment(text string) (*template.Template, error) {
+	t, err := template.New("kill").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(ioutil.Discard, KillInfo{}); err != nil {
+		return nil, fmt.Errorf("failed to execute kill comment template: %w", err)
+	}
+	return t, nil
+}
+
+// killOpCommand builds the killOp command, the comment needs mongo 4.4 or later to show up in the logs
+func killOpCommand(opid int32, comment string) bson.D {
+	return bson.D{
+		{Key: "killOp", Value: 1},
+		{Key: "op", Value: opid},
+		{Key: "comment", Value: comment},
+	}
+}
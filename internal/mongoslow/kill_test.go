@@ -0,0 +1,80 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// commandRecorder is a currentOp source that records the commands it is asked to run and the database they went to,
+// admin unless set like the mongo runner
+type commandRecorder struct {
+	fakeRunner
+	database  string
+	commands  []bson.D
+	databases []string
+}
+
+func (c *commandRecorder) SetDatabase(name string) {
+	c.database = name
+}
+
+func (c *commandRecorder) RunCommand(ctx context.Context, cmd bson.D) error {
+	database := c.database
+	if database == "" {
+		database = DefaultMonitorDatabase
+	}
+	c.commands = append(c.commands, cmd)
+	c.databases = append(c.databases, database)
+	return nil
+}
+
+func TestKillOp(t *testing.T) {
+	Convey("Given a source that can run commands", t, func() {
+		runner := &commandRecorder{}
+		slow := NewWithRunner(runner)
+
+		Convey("The killOp carries the default comment", func() {
+			So(slow.KillOp(context.Background(), 42, "exceeded 30m"), ShouldBeNil)
+			So(runner.commands, ShouldHaveLength, 1)
+			So(runner.commands[0], ShouldResemble, bson.D{
+				{Key: "killOp", Value: 1},
+				{Key: "op", Value: int32(42)},
+				{Key: "comment", Value: "killed by go-mongo-slow-queries: exceeded 30m"},
+			})
+		})
+
+		Convey("The comment template is configurable", func() {
+			comment, err := ParseKillComment("slow-query-bot opid={{.OperationID}} reason={{.Reason}}")
+			So(err, ShouldBeNil)
+			slow.KillComment = comment
+			So(slow.KillOp(context.Background(), 7, "manual"), ShouldBeNil)
+			So(runner.commands[0].Map()["comment"], ShouldEqual, "slow-query-bot opid=7 reason=manual")
+		})
+
+		Convey("The killOp goes to admin by default", func() {
+			So(slow.KillOp(context.Background(), 42, "manual"), ShouldBeNil)
+			So(runner.databases, ShouldResemble, []string{"admin"})
+		})
+
+		Convey("The killOp goes to the database set with MonitorDatabase, like currentOp", func() {
+			So(slow.MonitorDatabase("monitoring"), ShouldBeNil)
+			So(slow.KillOp(context.Background(), 42, "manual"), ShouldBeNil)
+			So(runner.databases, ShouldResemble, []string{"monitoring"})
+		})
+	})
+
+	Convey("Given invalid kill comment templates", t, func() {
+		_, err := ParseKillComment("killed: {{.Reason")
+		So(err, ShouldNotBeNil)
+		_, err = ParseKillComment("killed by {{.User}}")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a replay source", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.KillOp(context.Background(), 42, "manual"), ShouldEqual, ErrKillNotSupported)
+	})
+}
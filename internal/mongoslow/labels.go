@@ -0,0 +1,59 @@
+package mongoslow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricLabels are all the labels available on the query counter and histogram, in their default order
+var MetricLabels = []string{"user", "operation", "ns"}
+
+// ParseMetricLabels validates a list of metric labels to attach, each entry may itself be a comma separated list
+func ParseMetricLabels(labels []string) ([]string, error) {
+	var parsed []string
+	seen := make(map[string]bool)
+	for _, entry := range labels {
+		for _, label := range strings.Split(entry, ",") {
+			label = strings.TrimSpace(label)
+			if label == "" {
+				continue
+			}
+			if !isMetricLabel(label) {
+				return nil, fmt.Errorf("unknown metric label %q, available labels are %s", label, strings.Join(MetricLabels, ","))
+			}
+			if seen[label] {
+				continue
+			}
+			seen[label] = true
+			parsed = append(parsed, label)
+		}
+	}
+	return parsed, nil
+}
+
+func isMetricLabel(label string) bool {
+	for _, l := range MetricLabels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels builds the prometheus label set for the query, containing only the named labels
+func (q *Query) Labels(names []string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(names))
+	for _, name := range names {
+		switch name {
+		case "user":
+			labels[name] = q.EffectiveUser
+		case "operation":
+			labels[name] = q.Operation
+		case "ns":
+			labels[name] = q.labelNamespace()
+		}
+	}
+	return labels
+}
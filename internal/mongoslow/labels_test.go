@@ -0,0 +1,45 @@
+package mongoslow
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMetricLabels(t *testing.T) {
+	Convey("Given a list of metric labels", t, func() {
+		labels, err := ParseMetricLabels([]string{"operation,ns", "ns"})
+		So(err, ShouldBeNil)
+		So(labels, ShouldResemble, []string{"operation", "ns"})
+
+		_, err = ParseMetricLabels([]string{"user,connection"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given metrics configured without the user label", t, func() {
+		labels := []string{"operation", "ns"}
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar")},
+			{},
+		}})
+		slow.Labels = labels
+		slow.QueryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "slow_query_ms", Help: "slow query ms"}, labels)
+		slow.QueryHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "slow_query_secs"}, labels)
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		expected := `
+# HELP slow_query_ms slow query ms
+# TYPE slow_query_ms counter
+slow_query_ms{ns="foo.bar",operation="query"} 1000
+`
+		So(testutil.CollectAndCompare(slow.QueryCounter, strings.NewReader(expected)), ShouldBeNil)
+		So(testutil.CollectAndCount(slow.QueryHistogram), ShouldEqual, 1)
+	})
+}
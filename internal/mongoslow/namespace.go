@@ -0,0 +1,69 @@
+package mongoslow
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// NamespaceRule rewrites a namespace before it is used as a metric label, to keep the label cardinality down
+type NamespaceRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseNamespaceRules parses rules of the form regex=replacement, the replacement can use $1 style references and
+// may be empty to strip the match
+func ParseNamespaceRules(rules []string) ([]NamespaceRule, error) {
+	var parsed []NamespaceRule
+	for _, rule := range rules {
+		eq := strings.Index(rule, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid namespace rule %q: expected regex=replacement", rule)
+		}
+		pattern, err := regexp.Compile(rule[:eq])
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace rule %q: %v", rule, err)
+		}
+		parsed = append(parsed, NamespaceRule{Pattern: pattern, Replacement: rule[eq+1:]})
+	}
+	return parsed, nil
+}
+
+// normalizeNamespace applies each rule in order to the namespace
+func normalizeNamespace(ns string, rules []NamespaceRule) string {
+	for _, rule := range rules {
+		ns = rule.Pattern.ReplaceAllString(ns, rule.Replacement)
+	}
+	return ns
+}
+
+// ParseNamespaceGlobs validates a list of namespace globs, e.g. orders.* or *.sessions, each entry may itself be a
+// comma separated list
+func ParseNamespaceGlobs(globs []string) ([]string, error) {
+	var parsed []string
+	for _, entry := range globs {
+		for _, glob := range strings.Split(entry, ",") {
+			glob = strings.TrimSpace(glob)
+			if glob == "" {
+				continue
+			}
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid namespace glob %q: %v", glob, err)
+			}
+			parsed = append(parsed, glob)
+		}
+	}
+	return parsed, nil
+}
+
+// matchNamespace reports whether the namespace matches any of the globs
+func matchNamespace(ns string, globs []string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, ns); ok {
+			return true
+		}
+	}
+	return false
+}
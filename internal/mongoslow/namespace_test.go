@@ -0,0 +1,96 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNamespaceRules(t *testing.T) {
+	Convey("Given rules stripping date suffixes and tenant ids", t, func() {
+		rules, err := ParseNamespaceRules([]string{`_\d{4}_\d{2}$=`, `^tenant_\d+\.=tenant.`})
+		So(err, ShouldBeNil)
+		So(rules, ShouldHaveLength, 2)
+
+		So(normalizeNamespace("app.events_2024_06", rules), ShouldEqual, "app.events")
+		So(normalizeNamespace("app.events_2024_07", rules), ShouldEqual, "app.events")
+		So(normalizeNamespace("tenant_42.orders", rules), ShouldEqual, "tenant.orders")
+		So(normalizeNamespace("app.users", rules), ShouldEqual, "app.users")
+	})
+
+	Convey("Given invalid rules", t, func() {
+		_, err := ParseNamespaceRules([]string{"no-separator"})
+		So(err, ShouldNotBeNil)
+		_, err = ParseNamespaceRules([]string{"([a-z]=x"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given queries against monthly collections", t, func() {
+		rules, err := ParseNamespaceRules([]string{`_\d{4}_\d{2}$=`})
+		So(err, ShouldBeNil)
+
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "app.events_2024_06"), op(2, 2000000, "app.events_2024_07")},
+		}})
+		slow.QueryCounter = newTestCounter()
+		slow.DatabaseCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "db_slow_secs"}, []string{"db"})
+		slow.NamespaceRules = rules
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Both collapse into the same metric label", func() {
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 1)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "app.events")), ShouldEqual, 3000)
+			So(testutil.ToFloat64(slow.DatabaseCounter.WithLabelValues("app")), ShouldEqual, 3)
+		})
+
+		Convey("The raw namespace is kept in the JSON", func() {
+			rec := httptest.NewRecorder()
+			SlowQueryHandler(slow)(rec, httptest.NewRequest("GET", "/running.json", nil))
+			var running map[string]*Query
+			So(json.Unmarshal(rec.Body.Bytes(), &running), ShouldBeNil)
+			So(running["1"].Namespace, ShouldEqual, "app.events_2024_06")
+			So(running["2"].Namespace, ShouldEqual, "app.events_2024_07")
+		})
+	})
+}
+
+func TestMetricNamespaces(t *testing.T) {
+	Convey("Given invalid namespace globs", t, func() {
+		_, err := ParseNamespaceGlobs([]string{"orders.[a-"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a whitelist of the orders collections", t, func() {
+		globs, err := ParseNamespaceGlobs([]string{"orders.*, *.sessions"})
+		So(err, ShouldBeNil)
+		So(globs, ShouldResemble, []string{"orders.*", "*.sessions"})
+
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "orders.items"), op(2, 2000000, "carts.items"), op(3, 3000000, "app.sessions")},
+		}})
+		slow.QueryCounter = newTestCounter()
+		slow.MetricNamespaces = globs
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Only the whitelisted namespaces have series", func() {
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 2)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "orders.items")), ShouldEqual, 1000)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "app.sessions")), ShouldEqual, 3000)
+		})
+
+		Convey("The other namespaces are still visible in the handler", func() {
+			rec := httptest.NewRecorder()
+			SlowQueryHandler(slow)(rec, httptest.NewRequest("GET", "/running.json", nil))
+			var running map[string]*Query
+			So(json.Unmarshal(rec.Body.Bytes(), &running), ShouldBeNil)
+			So(running, ShouldHaveLength, 3)
+			So(running["2"].Namespace, ShouldEqual, "carts.items")
+		})
+	})
+}
@@ -0,0 +1,26 @@
+package mongoslow
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operations are the currentOp op types that get their own histogram when the histograms are split by operation,
+// aggregations and other commands are reported as command
+var Operations = []string{"query", "getmore", "insert", "update", "remove", "command"}
+
+// NewOperationHistograms creates one completed query histogram per operation, named slow_query_<op>_secs, so
+// dashboards can use a fixed metric name per operation type. opts supplies the namespace, subsystem and buckets.
+func NewOperationHistograms(reg prometheus.Registerer, opts prometheus.HistogramOpts, labels []string) (map[string]*prometheus.HistogramVec, error) {
+	histograms := make(map[string]*prometheus.HistogramVec, len(Operations))
+	for _, op := range Operations {
+		o := opts
+		o.Name = "slow_query_" + op + "_secs"
+		o.Help = "seconds of slow " + op + " histogram, use to get a view of completed slow queries of one operation type"
+		histogram := prometheus.NewHistogramVec(o, labels)
+		if err := reg.Register(histogram); err != nil {
+			return nil, err
+		}
+		histograms[op] = histogram
+	}
+	return histograms, nil
+}
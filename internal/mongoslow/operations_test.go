@@ -0,0 +1,46 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOperationHistograms(t *testing.T) {
+	Convey("Given histograms split by operation", t, func() {
+		reg := prometheus.NewRegistry()
+		histograms, err := NewOperationHistograms(reg, prometheus.HistogramOpts{Subsystem: "mongo"}, MetricLabels)
+		So(err, ShouldBeNil)
+		So(histograms, ShouldHaveLength, len(Operations))
+
+		update := op(2, 3000000, "foo.bar")
+		update["op"] = "update"
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 2000000, "foo.bar"), update},
+			{},
+		}}
+		slow := NewWithRunner(runner)
+		slow.OpHistograms = histograms
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Completed queries are observed in a metric family per operation", func() {
+			families, err := reg.Gather()
+			So(err, ShouldBeNil)
+			names := []string{}
+			for _, family := range families {
+				names = append(names, family.GetName())
+			}
+			So(names, ShouldResemble, []string{"mongo_slow_query_query_secs", "mongo_slow_query_update_secs"})
+		})
+
+		Convey("Registering the same histograms twice is an error", func() {
+			_, err := NewOperationHistograms(reg, prometheus.HistogramOpts{Subsystem: "mongo"}, MetricLabels)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
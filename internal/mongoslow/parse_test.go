@@ -0,0 +1,97 @@
+package mongoslow
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/currentop from the parsed fixtures")
+
+// loadFixture reads a single currentOp entry from an extended JSON file, as copied from db.currentOp() output, and
+// decodes it the way the mongo runner does
+func loadFixture(filename string) (primitive.M, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw bson.Raw
+	if err := bson.UnmarshalExtJSON(data, false, &raw); err != nil {
+		return nil, err
+	}
+	return decodeOperation(raw)
+}
+
+// TestParseFixtures parses each testdata/currentop/*.json fixture and compares the query, without the raw document,
+// to its .golden.json file. Run with -update after adding a fixture or changing Parse to rewrite the golden files.
+func TestParseFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/currentop/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	for _, fixture := range fixtures {
+		if strings.HasSuffix(fixture, ".golden.json") {
+			continue
+		}
+		count++
+		golden := strings.TrimSuffix(fixture, ".json") + ".golden.json"
+
+		Convey("Given the currentOp fixture "+filepath.Base(fixture), t, func() {
+			query, err := loadFixture(fixture)
+			So(err, ShouldBeNil)
+			q, err := Parse(query)
+			So(err, ShouldBeNil)
+
+			q.Raw = nil
+			got, err := json.MarshalIndent(q, "", "  ")
+			So(err, ShouldBeNil)
+			got = append(got, '\n')
+
+			if *update {
+				So(ioutil.WriteFile(golden, got, 0644), ShouldBeNil)
+			}
+
+			Convey("The query matches the golden file", func() {
+				want, err := ioutil.ReadFile(golden)
+				So(err, ShouldBeNil)
+				So(string(got), ShouldEqual, string(want))
+			})
+		})
+	}
+
+	Convey("Given the fixtures", t, func() {
+		So(count, ShouldBeGreaterThanOrEqualTo, 5)
+	})
+}
+
+func TestParseFixtureFields(t *testing.T) {
+	Convey("Given the find fixture", t, func() {
+		query, err := loadFixture("testdata/currentop/find.json")
+		So(err, ShouldBeNil)
+		q, err := Parse(query)
+		So(err, ShouldBeNil)
+
+		Convey("The fields are extracted", func() {
+			So(q.OperationID, ShouldEqual, 3189025)
+			So(q.RunningMicros, ShouldEqual, 7412093)
+			So(q.Operation, ShouldEqual, "query")
+			So(q.Namespace, ShouldEqual, "shop.orders")
+			So(q.EffectiveUser, ShouldEqual, "orders-api")
+			So(q.AppName, ShouldEqual, "orders-api")
+			So(q.ConnectionID, ShouldEqual, 48213)
+			So(q.NumYields, ShouldEqual, 5831)
+			So(q.StartTime.Format("2006-01-02T15:04:05.000Z07:00"), ShouldEqual, "2021-11-03T14:22:07.812Z")
+			So(bytes.Contains([]byte(q.Command), []byte(`{"$oid":"5f9b3c2e8a1d4e6f7a8b9c0d"}`)), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// historySnapshotVersion is bumped when the snapshot format changes, older snapshots are ignored
+const historySnapshotVersion = 1
+
+// historySnapshot is the history as saved to disk, oldest first
+type historySnapshot struct {
+	Version int       `json:"version"`
+	Saved   time.Time `json:"saved"`
+	History []*Query  `json:"history"`
+}
+
+// SaveHistory writes the history to filename, via a temporary file renamed over it so a crash mid write leaves the
+// previous snapshot intact
+func (s *MongoSlow) SaveHistory(filename string) error {
+	snapshot := historySnapshot{
+		Version: historySnapshotVersion,
+		Saved:   time.Now().UTC(),
+		History: s.filterHistory(func(*Query) bool { return true }),
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// LoadHistory adds the queries saved by SaveHistory to the history, a missing file is not an error. A corrupt file or
+// one from another version is rejected as a whole, leaving the history as it was.
+func (s *MongoSlow) LoadHistory(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snapshot historySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("corrupt history file %s: %w", filename, err)
+	}
+	if snapshot.Version != historySnapshotVersion {
+		return fmt.Errorf("history file %s has version %d, expected %d", filename, snapshot.Version, historySnapshotVersion)
+	}
+	for i, q := range snapshot.History {
+		if q == nil || q.Namespace == "" || q.RunningMicros < 0 {
+			return fmt.Errorf("corrupt history file %s: invalid query at %d", filename, i)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range snapshot.History {
+		s.addHistory(q)
+	}
+	log.Info().Str("filename", filename).Int("queries", len(snapshot.History)).Time("saved", snapshot.Saved).Msg("restored history")
+	return nil
+}
+
+// PersistHistory saves the history to filename every interval until the context is cancelled, save it once more
+// after Close to keep the queries since the last save
+func (s *MongoSlow) PersistHistory(ctx context.Context, filename string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SaveHistory(filename); err != nil {
+				log.Warn().Err(err).Str("filename", filename).Msg("failed to save history")
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package mongoslow
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPersistHistory(t *testing.T) {
+	Convey("Given a populated history saved to disk", t, func() {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "history.json")
+
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 6000000, "foo.a"), op(2, 1000000, "foo.b")},
+			{op(3, 7000000, "foo.c")},
+			{},
+		}})
+		for i := 0; i < 3; i++ {
+			So(slow.poll(context.Background()), ShouldBeNil)
+		}
+		saved := slow.filterHistory(func(*Query) bool { return true })
+		So(saved, ShouldHaveLength, 2)
+		So(slow.SaveHistory(filename), ShouldBeNil)
+
+		files, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(files, ShouldHaveLength, 1) // no temporary file left behind
+
+		Convey("A new MongoSlow restores it in order", func() {
+			restored := NewWithRunner(&fakeRunner{})
+			So(restored.LoadHistory(filename), ShouldBeNil)
+
+			history := restored.filterHistory(func(*Query) bool { return true })
+			So(history, ShouldHaveLength, 2)
+			for i, q := range history {
+				So(q.OperationID, ShouldEqual, saved[i].OperationID)
+				So(q.Namespace, ShouldEqual, saved[i].Namespace)
+				So(q.RunningMicros, ShouldEqual, saved[i].RunningMicros)
+				So(q.Command, ShouldEqual, saved[i].Command)
+			}
+			So(history[0].Raw["command"], ShouldResemble, primitive.M{"find": "bar"})
+		})
+
+		Convey("A corrupt file is ignored", func() {
+			So(ioutil.WriteFile(filename, []byte(`{"version":1,"history":[{"ns":`), 0644), ShouldBeNil)
+			restored := NewWithRunner(&fakeRunner{})
+			So(restored.LoadHistory(filename), ShouldNotBeNil)
+			So(restored.filterHistory(func(*Query) bool { return true }), ShouldBeEmpty)
+		})
+
+		Convey("A file from another version is ignored", func() {
+			So(ioutil.WriteFile(filename, []byte(`{"version":2,"history":[{"ns":"foo.a"}]}`), 0644), ShouldBeNil)
+			restored := NewWithRunner(&fakeRunner{})
+			So(restored.LoadHistory(filename), ShouldNotBeNil)
+			So(restored.filterHistory(func(*Query) bool { return true }), ShouldBeEmpty)
+		})
+
+		Convey("PersistHistory saves periodically", func() {
+			persisted := filepath.Join(dir, "persisted.json")
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				slow.PersistHistory(ctx, persisted, 10*time.Millisecond)
+				close(done)
+			}()
+			restored := NewWithRunner(&fakeRunner{})
+			So(func() error {
+				for i := 0; i < 100; i++ {
+					if restored.LoadHistory(persisted) == nil && len(restored.filterHistory(func(*Query) bool { return true })) > 0 {
+						return nil
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return context.DeadlineExceeded
+			}(), ShouldBeNil)
+			cancel()
+			<-done
+		})
+	})
+
+	Convey("Given no history file", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.LoadHistory(filepath.Join(t.TempDir(), "missing.json")), ShouldBeNil)
+	})
+}
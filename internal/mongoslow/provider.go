@@ -0,0 +1,236 @@
+package mongoslow
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Provider selects the parse profile for currentOp documents, managed services report a different shape than mongod
+type Provider string
+
+// supported providers, mongodb is the default
+const (
+	ProviderMongoDB    Provider = "mongodb"
+	ProviderDocumentDB Provider = "documentdb" // Amazon DocumentDB
+	ProviderCosmos     Provider = "cosmos"     // Azure Cosmos DB API for MongoDB
+)
+
+// Providers are all the supported providers
+var Providers = []Provider{ProviderMongoDB, ProviderDocumentDB, ProviderCosmos}
+
+// ParseProvider validates a provider name, empty selects mongodb
+func ParseProvider(name string) (Provider, error) {
+	if name == "" {
+		return ProviderMongoDB, nil
+	}
+	for _, provider := range Providers {
+		if strings.EqualFold(name, string(provider)) {
+			return provider, nil
+		}
+	}
+	return "", fmt.Errorf("unknown provider %q, expected one of %v", name, Providers)
+}
+
+// parser returns the function parsing currentOp documents from the provider
+func (p Provider) parser() func(primitive.M) (*Query, error) {
+	switch p {
+	case ProviderDocumentDB:
+		return ParseDocumentDB
+	case ProviderCosmos:
+		return ParseCosmos
+	}
+	return Parse
+}
+
+// parse parses a currentOp document with the configured provider's profile
+func (s *MongoSlow) parse(query primitive.M) (*Query, error) {
+	return s.Provider.parser()(query)
+}
+
+// ParseDocumentDB parses an Amazon DocumentDB currentOp document. DocumentDB has no effectiveUsers, so the client's
+// app name is used as the user, and only reports secs_running on some versions. It doesn't report numYields, so
+// NumYields is always zero.
+func ParseDocumentDB(query primitive.M) (*Query, error) {
+	q := &Query{}
+	q.Raw = Document(query)
+
+	opid, ok := intValue(query["opid"])
+	if !ok {
+		return nil, errors.New("missing opid field")
+	}
+	q.OperationID = int32(opid)
+
+	if err := parseRunningTime(q, query); err != nil {
+		return nil, err
+	}
+	if err := parseOperation(q, query); err != nil {
+		return nil, err
+	}
+
+	if appName, ok := query["clientAppName"].(string); ok {
+		q.AppName = appName
+		q.EffectiveUser = trimRandomBytes(appName)
+	}
+	if connectionID, ok := intValue(query["connectionId"]); ok {
+		q.ConnectionID = connectionID
+	}
+	q.KillPending, _ = query["killPending"].(bool)
+	parseCommand(q, query)
+	parseStartTime(q, query)
+	parseIndexBuild(q, query)
+	return q, nil
+}
+
+// ParseCosmos parses an Azure Cosmos DB currentOp document. Cosmos reports string opids, e.g. 10000003049:1603267417,
+// which are hashed down to the int32 used to track the query, the original is kept in the raw document. It reports
+// neither killPending nor connectionId, so KillPending and ConnectionID are always zero.
+func ParseCosmos(query primitive.M) (*Query, error) {
+	q := &Query{}
+	q.Raw = Document(query)
+
+	switch opid := query["opid"].(type) {
+	case string:
+		q.OperationID = hashOperationID(opid)
+	default:
+		n, ok := intValue(opid)
+		if !ok {
+			return nil, errors.New("missing opid field")
+		}
+		q.OperationID = int32(n)
+	}
+
+	if err := parseRunningTime(q, query); err != nil {
+		return nil, err
+	}
+	if err := parseOperation(q, query); err != nil {
+		return nil, err
+	}
+
+	if numYields, ok := intValue(query["numYields"]); ok {
+		q.NumYields = numYields
+	}
+
+	// cosmos reports effectiveUsers on some versions, the client's app name otherwise
+	if users, ok := query["effectiveUsers"].(primitive.A); ok && len(users) > 0 {
+		if user, ok := users[0].(primitive.M); ok {
+			name, _ := user["user"].(string)
+			q.EffectiveUser = trimRandomBytes(name)
+		}
+	} else if appName, ok := query["appName"].(string); ok {
+		q.EffectiveUser = trimRandomBytes(appName)
+	}
+	q.AppName, _ = query["appName"].(string)
+	parseCommand(q, query)
+	parseStartTime(q, query)
+	parseIndexBuild(q, query)
+	return q, nil
+}
+
+// parseRunningTime reads microsecs_running, falling back to the coarser secs_running
+func parseRunningTime(q *Query, query primitive.M) error {
+	if micros, ok := intValue(query["microsecs_running"]); ok {
+		q.RunningMicros = micros
+		return nil
+	}
+	if secs, ok := intValue(query["secs_running"]); ok {
+		q.RunningMicros = secs * 1000000
+		return nil
+	}
+	return errors.New("missing microseconds_running")
+}
+
+// parseOperation reads the op and ns fields
+func parseOperation(q *Query, query primitive.M) error {
+	var ok bool
+	if q.Operation, ok = query["op"].(string); !ok {
+		return errors.New("missing op")
+	}
+	if q.Namespace, ok = query["ns"].(string); !ok {
+		return errors.New("missing ns")
+	}
+	return nil
+}
+
+// parseCommand is a hacky way of showing the running command in the HTML table without having the parse this odd
+// mongo structure, extended JSON keeps ObjectIds, dates and regexes readable
+func parseCommand(q *Query, query primitive.M) {
+	command, err := bson.MarshalExtJSON(sortedDocument(query["command"]), false, false)
+	if err == nil {
+		q.Command, q.CommandTruncated = truncateCommand(string(command), MaxCommandLength)
+	}
+}
+
+// sortedDocument returns v with every primitive.M, which marshals in random order, replaced by a primitive.D sorted by
+// key the way json.Marshal orders maps. A primitive.D, e.g. the command as decoded by decodeOperation, keeps its order.
+func sortedDocument(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.M:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		doc := make(primitive.D, len(keys))
+		for i, key := range keys {
+			doc[i] = primitive.E{Key: key, Value: sortedDocument(v[key])}
+		}
+		return doc
+	case primitive.D:
+		doc := make(primitive.D, len(v))
+		for i, e := range v {
+			doc[i] = primitive.E{Key: e.Key, Value: sortedDocument(e.Value)}
+		}
+		return doc
+	case primitive.A:
+		a := make(primitive.A, len(v))
+		for i, e := range v {
+			a[i] = sortedDocument(e)
+		}
+		return a
+	}
+	return v
+}
+
+// parseStartTime reads currentOpTime, the start time of the operation, reported as a string by currentOp and as a
+// date by some replay files
+func parseStartTime(q *Query, query primitive.M) {
+	switch t := query["currentOpTime"].(type) {
+	case string:
+		if start, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			q.StartTime = start.UTC()
+		}
+	case primitive.DateTime:
+		q.StartTime = t.Time().UTC()
+	}
+}
+
+// truncatedMarker is appended to truncated commands
+const truncatedMarker = "…"
+
+// truncateCommand cuts the command to at most max bytes plus the marker, keeping the start where the operative part
+// is, e.g. the find and filter of a bulk write with a huge $in array
+func truncateCommand(command string, max int) (string, bool) {
+	if max <= 0 || len(command) <= max {
+		return command, false
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(command[cut]) { // don't split a multi byte character
+		cut--
+	}
+	return command[:cut] + truncatedMarker, true
+}
+
+// hashOperationID maps a string opid to an int32, collisions only merge the running time of two queries
+func hashOperationID(opid string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(opid))
+	return int32(h.Sum32())
+}
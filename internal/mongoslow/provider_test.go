@@ -0,0 +1,114 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentDBOp is a currentOp entry as returned by Amazon DocumentDB
+func documentDBOp() primitive.M {
+	return primitive.M{
+		"desc":              "Conn",
+		"active":            true,
+		"killPending":       false,
+		"opid":              int32(195),
+		"ns":                "shop.orders",
+		"command":           primitive.D{{Key: "find", Value: "orders"}, {Key: "filter", Value: primitive.M{"status": "open"}}},
+		"op":                "query",
+		"$db":               "shop",
+		"secs_running":      int32(12),
+		"microsecs_running": int64(12345678),
+		"clientAppName":     "orders-api-92c989781b97",
+		"WaitState":         "Other",
+	}
+}
+
+func TestParseProvider(t *testing.T) {
+	Convey("Given provider names", t, func() {
+		provider, err := ParseProvider("")
+		So(err, ShouldBeNil)
+		So(provider, ShouldEqual, ProviderMongoDB)
+
+		provider, err = ParseProvider("DocumentDB")
+		So(err, ShouldBeNil)
+		So(provider, ShouldEqual, ProviderDocumentDB)
+
+		_, err = ParseProvider("dynamodb")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseDocumentDB(t *testing.T) {
+	Convey("Given a DocumentDB currentOp document", t, func() {
+		q, err := ParseDocumentDB(documentDBOp())
+		So(err, ShouldBeNil)
+
+		Convey("The fields are mapped into the query", func() {
+			So(q.OperationID, ShouldEqual, 195)
+			So(q.Namespace, ShouldEqual, "shop.orders")
+			So(q.Operation, ShouldEqual, "query")
+			So(q.RunningMicros, ShouldEqual, 12345678)
+			So(q.EffectiveUser, ShouldEqual, "orders-api")
+			So(q.Command, ShouldEqual, `{"find":"orders","filter":{"status":"open"}}`)
+		})
+
+		Convey("NumYields, which DocumentDB doesn't report, is left zero", func() {
+			So(q.NumYields, ShouldEqual, 0)
+		})
+
+		Convey("The mongodb profile can't parse it", func() {
+			_, err := Parse(documentDBOp())
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a DocumentDB document with only secs_running", t, func() {
+		entry := documentDBOp()
+		delete(entry, "microsecs_running")
+		q, err := ParseDocumentDB(entry)
+		So(err, ShouldBeNil)
+		So(q.RunningMicros, ShouldEqual, 12000000)
+	})
+
+	Convey("Given a poll against DocumentDB", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{documentDBOp()}}})
+		slow.Provider = ProviderDocumentDB
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		So(slow.Stats().ParseFailures, ShouldEqual, 0)
+		So(slow.runningQueries, ShouldContainKey, int32(195))
+	})
+}
+
+func TestParseCosmos(t *testing.T) {
+	Convey("Given a Cosmos currentOp document with a string opid", t, func() {
+		entry := primitive.M{
+			"active":            true,
+			"type":              "op",
+			"opid":              "10000003049:1603267417",
+			"secs_running":      int32(20),
+			"microsecs_running": int64(20000000),
+			"op":                "query",
+			"ns":                "shop.carts",
+			"command":           primitive.M{"find": "carts"},
+		}
+		q, err := ParseCosmos(entry)
+		So(err, ShouldBeNil)
+
+		Convey("The opid is hashed and the rest mapped into the query", func() {
+			So(q.OperationID, ShouldEqual, hashOperationID("10000003049:1603267417"))
+			So(q.OperationID, ShouldNotEqual, hashOperationID("10000003049:1603267418"))
+			So(q.Namespace, ShouldEqual, "shop.carts")
+			So(q.RunningMicros, ShouldEqual, 20000000)
+			So(q.EffectiveUser, ShouldEqual, "")
+		})
+
+		Convey("KillPending and ConnectionID, which Cosmos doesn't report, are left zero", func() {
+			So(q.KillPending, ShouldBeFalse)
+			So(q.ConnectionID, ShouldEqual, 0)
+		})
+	})
+}
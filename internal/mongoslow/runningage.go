@@ -0,0 +1,84 @@
+package mongoslow
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RunningAgeHistogram is a histogram of how long the operations running at the last poll had been running. Unlike a
+// prometheus.Histogram it is replaced by every poll rather than accumulated, so an operation seen by many polls is
+// only counted once, e.g. running_age_seconds_bucket{le="60"} is the operations running for at most a minute right now.
+type RunningAgeHistogram struct {
+	desc    *prometheus.Desc
+	buckets []float64
+
+	mu     sync.Mutex
+	count  uint64
+	sum    float64
+	counts []uint64 // cumulative, one per bucket
+}
+
+// NewRunningAgeHistogram creates a running age histogram, opts supplies the name, help and buckets in seconds
+func NewRunningAgeHistogram(opts prometheus.HistogramOpts) *RunningAgeHistogram {
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &RunningAgeHistogram{
+		desc:    prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, nil, opts.ConstLabels),
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Set replaces the histogram with the ages, in seconds, of the currently running operations
+func (h *RunningAgeHistogram) Set(ages []float64) {
+	counts := make([]uint64, len(h.buckets))
+	var sum float64
+	for _, age := range ages {
+		sum += age
+		for i, upper := range h.buckets {
+			if age <= upper {
+				counts[i]++
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count, h.sum, h.counts = uint64(len(ages)), sum, counts
+}
+
+// Describe implements prometheus.Collector
+func (h *RunningAgeHistogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+// Collect implements prometheus.Collector
+func (h *RunningAgeHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[float64]uint64, len(h.buckets))
+	for i, upper := range h.buckets {
+		buckets[upper] = h.counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, buckets)
+}
+
+// setRunningAge sets the running age histogram to the ages of the running queries that produce metrics
+func (s *MongoSlow) setRunningAge() {
+	if s.RunningAge == nil {
+		return
+	}
+	ages := make([]float64, 0, len(s.runningQueries))
+	for _, q := range s.runningQueries {
+		if s.emitsMetrics(q) {
+			ages = append(ages, float64(q.RunningMicros)/1000000)
+		}
+	}
+	s.RunningAge.Set(ages)
+}
@@ -0,0 +1,57 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// runningAgeBuckets gathers the histogram, returning the sample count, sum and cumulative count per upper bound
+func runningAgeBuckets(h *RunningAgeHistogram) (uint64, float64, map[float64]uint64) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(h)
+	families, err := reg.Gather()
+	So(err, ShouldBeNil)
+	So(families, ShouldHaveLength, 1)
+	histogram := families[0].GetMetric()[0].GetHistogram()
+	buckets := make(map[float64]uint64)
+	for _, b := range histogram.GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return histogram.GetSampleCount(), histogram.GetSampleSum(), buckets
+}
+
+func TestRunningAge(t *testing.T) {
+	Convey("Given queries running across polls", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.a"), op(2, 30000000, "foo.b"), op(3, 90000000, "foo.c")},
+			{op(1, 3000000, "foo.a"), op(3, 92000000, "foo.c")},
+			{},
+		}})
+		slow.RunningAge = NewRunningAgeHistogram(prometheus.HistogramOpts{Name: "running_age_seconds", Buckets: []float64{60, 10}})
+
+		Convey("Each poll observes the current age of every running query", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			count, sum, buckets := runningAgeBuckets(slow.RunningAge)
+			So(count, ShouldEqual, 3)
+			So(sum, ShouldEqual, 121)
+			So(buckets, ShouldResemble, map[float64]uint64{10: 1, 60: 2})
+
+			Convey("And the next poll replaces rather than adds to them", func() {
+				So(slow.poll(context.Background()), ShouldBeNil)
+				count, sum, buckets := runningAgeBuckets(slow.RunningAge)
+				So(count, ShouldEqual, 2)
+				So(sum, ShouldEqual, 95)
+				So(buckets, ShouldResemble, map[float64]uint64{10: 1, 60: 1})
+
+				So(slow.poll(context.Background()), ShouldBeNil)
+				count, _, buckets = runningAgeBuckets(slow.RunningAge)
+				So(count, ShouldEqual, 0)
+				So(buckets, ShouldResemble, map[float64]uint64{10: 0, 60: 0})
+			})
+		})
+	})
+}
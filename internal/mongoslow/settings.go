@@ -0,0 +1,72 @@
+package mongoslow
+
+// Settings are the MongoSlow options that are safe to change while the poll loop is running
+type Settings struct {
+	MinDeltaMicros   int64
+	MinObserveMicros int64
+	NamespaceRules   []NamespaceRule
+	MetricNamespaces []string
+}
+
+// Settings returns the current hot reloadable settings
+func (s *MongoSlow) Settings() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Settings{
+		MinDeltaMicros:   s.MinDeltaMicros,
+		MinObserveMicros: s.MinObserveMicros,
+		NamespaceRules:   s.NamespaceRules,
+		MetricNamespaces: s.MetricNamespaces,
+	}
+}
+
+// Apply swaps in new settings between polls and returns the names of the settings that changed
+func (s *MongoSlow) Apply(settings Settings) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []string
+	if settings.MinDeltaMicros != s.MinDeltaMicros {
+		s.MinDeltaMicros = settings.MinDeltaMicros
+		changed = append(changed, "min_delta_micros")
+	}
+	if settings.MinObserveMicros != s.MinObserveMicros {
+		s.MinObserveMicros = settings.MinObserveMicros
+		changed = append(changed, "min_observe_micros")
+	}
+	if !sameNamespaceRules(settings.NamespaceRules, s.NamespaceRules) {
+		s.NamespaceRules = settings.NamespaceRules
+		changed = append(changed, "ns_normalize")
+	}
+	if !sameStrings(settings.MetricNamespaces, s.MetricNamespaces) {
+		s.MetricNamespaces = settings.MetricNamespaces
+		changed = append(changed, "namespace_metric_whitelist")
+	}
+	return changed
+}
+
+// sameStrings compares two lists in order, nil and empty are the same
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameNamespaceRules compares rules by their pattern source and replacement
+func sameNamespaceRules(a, b []NamespaceRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Replacement != b[i].Replacement || a[i].Pattern.String() != b[i].Pattern.String() {
+			return false
+		}
+	}
+	return true
+}
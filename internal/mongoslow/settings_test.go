@@ -0,0 +1,58 @@
+package mongoslow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApplySettings(t *testing.T) {
+	Convey("Given a running query below the minimum delta", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 20000, "foo.bar")},
+			{op(1, 40000, "foo.bar")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.QueryCounter = newTestCounter()
+		slow.MinDeltaMicros = 30000
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 0)
+
+		Convey("A reloaded threshold takes effect on the next poll", func() {
+			settings := slow.Settings()
+			settings.MinDeltaMicros = 10000
+			So(slow.Apply(settings), ShouldResemble, []string{"min_delta_micros"})
+
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 20)
+		})
+
+		Convey("Applying the same settings reports no changes", func() {
+			So(slow.Apply(slow.Settings()), ShouldBeEmpty)
+		})
+
+		Convey("Changed namespace rules are reported", func() {
+			rules, err := ParseNamespaceRules([]string{`_\d+$=`})
+			So(err, ShouldBeNil)
+			settings := slow.Settings()
+			settings.NamespaceRules = rules
+			So(slow.Apply(settings), ShouldResemble, []string{"ns_normalize"})
+			So(slow.Apply(settings), ShouldBeEmpty)
+		})
+
+		Convey("A reloaded namespace metric whitelist takes effect on the next poll", func() {
+			settings := slow.Settings()
+			settings.MinDeltaMicros = 10000
+			settings.MetricNamespaces = []string{"orders.*"}
+			So(slow.Apply(settings), ShouldResemble, []string{"min_delta_micros", "namespace_metric_whitelist"})
+			So(slow.Apply(settings), ShouldBeEmpty)
+
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 0)
+		})
+	})
+}
@@ -3,16 +3,20 @@ package mongoslow
 import (
 	"container/ring"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -21,198 +25,903 @@ var (
 	// length of history of slow queries to keep
 	HistoryLen            int   = 1000    // number of items
 	HistoryQueryThreshold int64 = 5000000 // microsecs, think this is 5s
+
+	// noise filtering defaults
+	DefaultMinDeltaMicros   int64 = 10000  // microsecs, deltas smaller than this are not counted
+	DefaultMinObserveMicros int64 = 500000 // microsecs, completed queries faster than this are not observed
+
+	// MaxCommandLength bounds the command string kept for each query, longer commands are truncated keeping the start,
+	// zero for no limit
+	MaxCommandLength = 4096 // bytes
+
+	// DefaultCommandTimeout bounds each currentOp command so a stalled server can't wedge the poll loop
+	DefaultCommandTimeout = 5 * time.Second
+
+	// ConnectRetries and ConnectBackoff retry connecting in New while mongo isn't up yet, e.g. when started alongside
+	// it, waiting the backoff before the first retry and doubling it for each retry after
+	ConnectRetries = 3
+	ConnectBackoff = time.Second
+
+	// ping checks a new client can reach mongo, replaced in tests
+	ping = func(ctx context.Context, c *mongo.Client) error { return c.Ping(ctx, nil) }
+
+	// UserTrim matches the random suffix stripped from effective user names, by default everything from the last
+	// hyphen, so auto-default-some-user-name-92c989781b97 becomes auto-default-some-user-name
+	UserTrim = regexp.MustCompile(DefaultUserTrimRegex)
 )
 
+// DefaultUserTrimRegex is the default UserTrim pattern
+const DefaultUserTrimRegex = `-[^-]*$`
+
 // MongoSlow holds the state of slow queries, we have to keep state as we poll every x seconds and want to emit the
 // cumulative slow query time for each user/connection/query.
 type MongoSlow struct {
-	ThresholdMicros   int
-	QueryCounter      *prometheus.CounterVec   // prometheus counter, for running queries
-	QueryHistogram    *prometheus.HistogramVec // prometheus histogram, for completed queries
-	client            *mongo.Client
-	runningQueryTimes map[int32]int64 // opid to microsecs_running map so we can measure how long something is running for
-	runningQueries    map[int32]*Query
-	history           *ring.Ring // history of slow queries
+	ThresholdMicros    int
+	MinDeltaMicros     int64                               // running deltas below this are skipped, filters out just executed queries
+	MinObserveMicros   int64                               // completed queries at or below this are not added to the histogram
+	MaxQueriesPerPoll  int                                 // only process this many of the longest running queries per poll, zero for all
+	MaxHistoryBytes    int                                 // history entries keep this much of the command and drop bigger raw documents, zero for all
+	KillComment        *template.Template                  // comment attached to killOp commands, executed with a KillInfo
+	TableTemplate      *template.Template                  // running and history table page, the embedded queries.html if nil
+	SlowLog            *SlowLog                            // queries entering the history are also appended to this file, if set
+	CommandTimeout     time.Duration                       // deadline for each currentOp command, zero for no deadline
+	NamespaceRules     []NamespaceRule                     // rewrites applied to the ns metric label, the raw ns is kept on the query
+	MetricNamespaces   []string                            // globs of the namespaces that produce metrics, all if empty, the rest are still shown
+	Labels             []string                            // labels attached to the query counter and histogram, see MetricLabels
+	Provider           Provider                            // parse profile for the currentOp documents, mongodb if empty
+	ExcludeAppName     string                              // operations from clients with this appName are kept out of the metrics, e.g. the monitor's own
+	QueryCounter       *prometheus.CounterVec              // deprecated prometheus counter, milliseconds of running queries, use QuerySeconds
+	QuerySeconds       *prometheus.CounterVec              // prometheus counter, seconds of running queries
+	QueryHistogram     *prometheus.HistogramVec            // prometheus histogram, for completed queries
+	OpHistograms       map[string]*prometheus.HistogramVec // per operation histograms, completed queries are also observed in the one for their op
+	DatabaseCounter    *prometheus.CounterVec              // prometheus counter, running queries rolled up per database
+	RunningGauge       *prometheus.GaugeVec                // prometheus gauge, seconds the currently running queries have been running
+	RunningAge         *RunningAgeHistogram                // prometheus histogram, seconds the queries running at the last poll had been running
+	YieldsGauge        *prometheus.GaugeVec                // prometheus gauge, numYields of the currently running queries, a contention signal
+	IndexBuildGauge    *prometheus.GaugeVec                // prometheus gauge, seconds the longest running index build per ns has been running
+	IndexBuildProgress *prometheus.GaugeVec                // prometheus gauge, percentage done of that index build, when reported
+	ActiveOpsGauge     *prometheus.GaugeVec                // prometheus gauge, operations currentOp reports per user, a saturation signal
+	AuthErrors         prometheus.Counter                  // prometheus counter, currentOp polls rejected for missing privileges
+	SkippedQueries     prometheus.Counter                  // prometheus counter, queries left out by MaxQueriesPerPoll
+	InterruptedQueries prometheus.Counter                  // prometheus counter, queries that were killPending when last seen, killed or timed out rather than completed
+	PollDuration       prometheus.Observer                 // prometheus histogram, seconds each poll took including the command, parsing and metrics
+	PollOps            prometheus.Gauge                    // prometheus gauge, operations returned by currentOp in the last successful poll
+	TrackedOpIDs       prometheus.Gauge                    // prometheus gauge, running queries tracked between polls, a leak if it keeps growing
+	MaxTrackedOpIDs    int                                 // log a warning each poll tracking more running queries than this, zero to never warn
+	client             *mongo.Client
+	runner             CurrentOpRunner // where the in progress operations are read from
+	mu                 sync.RWMutex    // guards the running queries, history and stats between the poll loop and handlers
+	runningQueryTimes  map[int32]int64 // opid to microsecs_running map so we can measure how long something is running for
+	runningQueries     map[int32]*Query
+	idle               []*IdleEntry                 // idle cursors and sessions seen by the last poll
+	gaugeLabels        map[string]prometheus.Labels // running gauge label sets set by the last poll, to delete the stale ones
+	indexBuilds        map[string]bool              // namespaces with an index build in the last poll
+	activeUsers        map[string]bool              // users with operations in the last poll
+	history            *ring.Ring                   // history of slow queries
+	slowLogPending     []*Query                     // history entries to write to the SlowLog once the poll releases mu
+	stats              Stats
+	lastErr            error         // error from the last poll, nil if it succeeded
+	ready              chan struct{} // closed when the first poll has succeeded, see Ready
+	readyOnce          sync.Once
+	cancel             context.CancelFunc // stops a running Run loop
+	done               chan struct{}      // closed when the Run loop has returned
+	closed             bool
+	closeOnce          sync.Once
+	closeErr           error
+}
+
+// ErrClosed is returned by Run when the MongoSlow has already been closed
+var ErrClosed = errors.New("mongoslow: closed")
+
+// Stats holds the internal counters of the poll loop, for self monitoring
+type Stats struct {
+	Polls               uint64  `json:"polls"`                      // number of currentOp polls run
+	LastPollDurationSec float64 `json:"last_poll_duration_seconds"` // how long the last poll took
+	TrackedOpIDs        int     `json:"tracked_opids"`              // number of running queries currently tracked
+	ParseFailures       uint64  `json:"parse_failures"`             // currentOp entries that could not be parsed
+	Reconnects          uint64  `json:"reconnects"`                 // times the driver dropped its connections and reconnected
+	Timeouts            uint64  `json:"timeouts"`                   // polls where currentOp did not return within the command timeout
+	SkippedQueries      uint64  `json:"skipped_queries"`            // queries left out of a poll by the max queries per poll
+	MalformedResponses  uint64  `json:"malformed_responses"`        // currentOp responses skipped for missing the inprog array
+	InterruptedQueries  uint64  `json:"interrupted_queries"`        // queries that disappeared while killPending
+	IdleCursors         int     `json:"idle_cursors"`               // idle cursors seen by the last poll, see IncludeIdle
+	IdleSessions        int     `json:"idle_sessions"`              // idle sessions seen by the last poll, see IncludeIdle
+	Paused              bool    `json:"paused"`                     // polling is paused, see Pause
+}
+
+// ClientOptionFunc is a function that is called on the mongo client options before connecting
+type ClientOptionFunc func(clientOptions *options.ClientOptions) error
+
+// WithDialer sets the dialer used by the mongo driver to create connections
+func WithDialer(dialer options.ContextDialer) ClientOptionFunc {
+	return func(clientOptions *options.ClientOptions) error {
+		clientOptions.SetDialer(dialer)
+		return nil
+	}
+}
+
+// WithProxy dials all mongo connections through the given socks5 or http proxy, see ParseProxy
+func WithProxy(proxyURL string) ClientOptionFunc {
+	return func(clientOptions *options.ClientOptions) error {
+		dialer, err := ParseProxy(proxyURL)
+		if err != nil {
+			return err
+		}
+		clientOptions.SetDialer(dialer)
+		return nil
+	}
+}
+
+// DefaultAppName is the appName the monitor connects with, so its own operations can be spotted in currentOp
+const DefaultAppName = "go-mongo-slow-queries"
+
+// WithAppName sets the appName reported by the monitor's connections, shown in currentOp and the server logs
+func WithAppName(appName string) ClientOptionFunc {
+	return func(clientOptions *options.ClientOptions) error {
+		clientOptions.SetAppName(appName)
+		return nil
+	}
+}
+
+// Compressors are the wire compressors supported by the mongo driver
+var Compressors = []string{"snappy", "zlib", "zstd"}
+
+// WithCompressors asks the server to compress the wire traffic with the first of the compressors it also supports,
+// shrinking large currentOp responses when monitoring across regions
+func WithCompressors(compressors []string) ClientOptionFunc {
+	return func(clientOptions *options.ClientOptions) error {
+		if err := ValidateCompressors(compressors); err != nil {
+			return err
+		}
+		clientOptions.SetCompressors(compressors)
+		return nil
+	}
+}
+
+// ValidateCompressors checks each compressor is one of Compressors
+func ValidateCompressors(compressors []string) error {
+	for _, compressor := range compressors {
+		supported := false
+		for _, c := range Compressors {
+			if compressor == c {
+				supported = true
+			}
+		}
+		if !supported {
+			return fmt.Errorf("unknown compressor %q, expected one of %v", compressor, Compressors)
+		}
+	}
+	return nil
 }
 
-func New(ctx context.Context, uri, host, user, pass string, port int32) (*MongoSlow, error) {
+func clientOptions(uri, host, user, pass string, port int32, opts ...ClientOptionFunc) (*options.ClientOptions, error) {
 	if uri == "" {
 		uri = fmt.Sprintf("mongodb://%s:%s@%s:%d/?directConnection=true", user, pass, host, port)
 	}
 	clientOptions := options.Client().ApplyURI(uri)
 
+	for _, opt := range opts {
+		if err := opt(clientOptions); err != nil {
+			return nil, err
+		}
+	}
+	return clientOptions, nil
+}
+
+func New(ctx context.Context, uri, host, user, pass string, port int32, opts ...ClientOptionFunc) (*MongoSlow, error) {
+	clientOptions, err := clientOptions(uri, host, user, pass, port, opts...)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid mongo client options")
+		return nil, err
+	}
+
+	s := NewWithRunner(nil)
+	clientOptions.SetPoolMonitor(&event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			if e.Type == event.PoolCleared {
+				log.Warn().Str("address", e.Address).Msg("mongo connection pool cleared, reconnecting")
+				s.mu.Lock()
+				s.stats.Reconnects++
+				s.mu.Unlock()
+			}
+		},
+	})
+
+	var c *mongo.Client
+	backoff := ConnectBackoff
+	for attempt := 0; ; attempt++ {
+		c, err = connect(ctx, clientOptions)
+		if err == nil || attempt >= ConnectRetries {
+			break
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("mongo not reachable yet, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.runner = &mongoRunner{client: c}
+	s.client = c
+	return s, nil
+}
+
+// connect connects to mongo and pings it, disconnecting again if the ping fails
+func connect(ctx context.Context, clientOptions *options.ClientOptions) (*mongo.Client, error) {
 	c, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Error().Str("uri", uri).Err(err).Msg("failed to connect to mongo")
+		log.Error().Err(err).Msg("failed to connect to mongo")
 		return nil, err
 	}
 
-	err = c.Ping(ctx, nil)
+	err = ping(ctx, c)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to ping mongo")
+		c.Disconnect(ctx)
 		return nil, err
 	}
+	return c, nil
+}
+
+// NewReplay creates a MongoSlow that replays recorded currentOp responses from a file instead of polling mongo
+func NewReplay(filename string) (*MongoSlow, error) {
+	source, err := NewReplaySource(filename)
+	if err != nil {
+		log.Error().Str("filename", filename).Err(err).Msg("failed to load replay file")
+		return nil, err
+	}
+	return NewWithRunner(source), nil
+}
 
+// NewWithRunner creates a MongoSlow that polls the given runner for the in progress operations
+func NewWithRunner(runner CurrentOpRunner) *MongoSlow {
 	s := &MongoSlow{}
 	s.runningQueryTimes = make(map[int32]int64)
 	s.runningQueries = make(map[int32]*Query)
 	s.history = ring.New(HistoryLen)
-	s.client = c
-	return s, nil
+	s.runner = runner
+	s.ready = make(chan struct{})
+	s.MinDeltaMicros = DefaultMinDeltaMicros
+	s.MinObserveMicros = DefaultMinObserveMicros
+	s.CommandTimeout = DefaultCommandTimeout
+	s.Labels = MetricLabels
+	return s
 }
 
-func (s *MongoSlow) Run(interval time.Duration) error {
-	var runningQueries bson.M
+// Run polls currentOp every interval until the context is cancelled, Close is called or a poll fails
+func (s *MongoSlow) Run(ctx context.Context, interval time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	cmd := bson.D{{Key: "currentOp", Value: 1}, {Key: "$all", Value: true}}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	defer close(s.done)
+	s.mu.Unlock()
 
 	for {
-		r := s.client.Database("admin").RunCommand(context.TODO(), cmd)
-		err := r.Decode(&runningQueries)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to run query")
-			return err
+		if s.Paused() {
+			log.Debug().Msg("monitoring paused, skipping poll")
+		} else if err := s.poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			switch {
+			case IsAuthError(err):
+				// keep polling, the privilege can be granted without restarting
+				log.Error().Err(err).Msg(authErrorMessage)
+				if s.AuthErrors != nil {
+					s.AuthErrors.Inc()
+				}
+			case errors.Is(err, ErrNoInProgress):
+				// keep polling, skip just this response
+				log.Warn().Err(err).Msg("skipping malformed currentOp response")
+			case isTimeout(err):
+				// keep polling, the driver reconnects if the connection was lost
+				log.Warn().Err(err).Dur("timeout", s.CommandTimeout).Msg("currentOp timed out")
+			default:
+				log.Error().Err(err).Msg("failed to run query")
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
 		}
+	}
+}
+
+// Pause stops the Run loop polling, e.g. during a maintenance window, keeping the last running queries, history and
+// metrics until Resume is called
+func (s *MongoSlow) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Paused = true
+}
 
-		queries := runningQueries["inprog"].(primitive.A)
-		currentQueryOpIDs := make(map[int32]bool)
+// Resume restarts polling after Pause
+func (s *MongoSlow) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Paused = false
+}
+
+// Paused reports whether polling is paused
+func (s *MongoSlow) Paused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stats.Paused
+}
+
+// Close stops the Run loop, waiting for it to return, and then disconnects from mongo. It is safe to call more than
+// once and when Run was never started.
+func (s *MongoSlow) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		cancel, done := s.cancel, s.done
+		s.mu.Unlock()
 
-		for _, query := range queries {
-			q, err := Parse(query.(primitive.M))
-			if err != nil {
-				log.Debug().Err(err).Interface("query", query).Msg("failed to parse query")
-				continue
+		if cancel != nil {
+			cancel()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				s.closeErr = ctx.Err()
+				return
 			}
+		}
 
-			lastMicrosecs, ok := s.runningQueryTimes[q.OperationID]
-			if ok {
-				q.DeltaMicros = q.RunningMicros - lastMicrosecs
-				log.Info().
-					Str("user", q.EffectiveUser).
-					Str("op", q.Operation).
-					Int32("opid", q.OperationID).
-					Int64("last_microsecs_running", lastMicrosecs).
-					Int64("microsecs_running", q.RunningMicros).
-					Int64("delta", q.DeltaMicros).
-					Msg("query still running")
+		if s.client != nil {
+			s.closeErr = s.client.Disconnect(ctx)
+		}
+	})
+	return s.closeErr
+}
+
+// poll runs a single currentOp and updates the running queries, metrics and history
+func (s *MongoSlow) poll(ctx context.Context) error {
+	start := time.Now()
+	queries, err := s.currentOp(ctx)
+
+	defer s.flushSlowLog() // runs after the unlock, so a slow disk doesn't stall the handlers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		s.stats.Polls++
+		s.stats.LastPollDurationSec = time.Since(start).Seconds()
+		s.stats.TrackedOpIDs = len(s.runningQueryTimes)
+		if s.TrackedOpIDs != nil {
+			s.TrackedOpIDs.Set(float64(s.stats.TrackedOpIDs))
+		}
+		if s.MaxTrackedOpIDs > 0 && s.stats.TrackedOpIDs > s.MaxTrackedOpIDs {
+			log.Warn().Int("tracked_opids", s.stats.TrackedOpIDs).Int("max_tracked_opids", s.MaxTrackedOpIDs).
+				Msg("tracking more running queries than expected, finished queries may not be being pruned")
+		}
+		if s.PollDuration != nil {
+			s.PollDuration.Observe(s.stats.LastPollDurationSec)
+		}
+	}()
+
+	s.lastErr = err
+
+	if err != nil {
+		if isTimeout(err) && ctx.Err() == nil {
+			s.stats.Timeouts++
+		}
+		if errors.Is(err, ErrNoInProgress) {
+			s.stats.MalformedResponses++
+		}
+		return err
+	}
+
+	if s.PollOps != nil {
+		s.PollOps.Set(float64(len(queries)))
+	}
+
+	currentQueryOpIDs := make(map[int32]bool)
+
+	parsed := make([]*Query, 0, len(queries))
+	s.idle = nil
+	s.stats.IdleCursors, s.stats.IdleSessions = 0, 0
+	for _, query := range queries {
+		// idle cursors and sessions aren't running, keep them out of the slow query metrics
+		if idle := parseIdle(query); idle != nil {
+			s.idle = append(s.idle, idle)
+			if idle.Type == typeIdleCursor {
+				s.stats.IdleCursors++
 			} else {
-				log.Debug().Str("user", q.EffectiveUser).
-					Str("op", q.Operation).
-					Int32("opid", q.OperationID).Msg("new query started")
-				q.DeltaMicros = q.RunningMicros
+				s.stats.IdleSessions++
 			}
+			continue
+		}
+		q, err := s.parse(query)
+		if err != nil {
+			log.Debug().Err(err).Interface("query", query).Msg("failed to parse query")
+			s.stats.ParseFailures++
+			continue
+		}
+		parsed = append(parsed, q)
+	}
+	s.setActiveOpsGauge(parsed)
 
-			q.Inc(s.QueryCounter)
-
-			s.runningQueryTimes[q.OperationID] = q.RunningMicros
-			s.runningQueries[q.OperationID] = q
+	if s.MaxQueriesPerPoll > 0 && len(parsed) > s.MaxQueriesPerPoll {
+		// only process the slowest queries, the skipped ones are still running so must not be completed
+		sort.SliceStable(parsed, func(i, j int) bool {
+			return parsed[i].RunningMicros > parsed[j].RunningMicros
+		})
+		for _, q := range parsed[s.MaxQueriesPerPoll:] {
 			currentQueryOpIDs[q.OperationID] = true
 		}
+		skipped := len(parsed) - s.MaxQueriesPerPoll
+		s.stats.SkippedQueries += uint64(skipped)
+		if s.SkippedQueries != nil {
+			s.SkippedQueries.Add(float64(skipped))
+		}
+		parsed = parsed[:s.MaxQueriesPerPoll]
+	}
 
-		for opid, microsecs := range s.runningQueryTimes {
-			_, ok := currentQueryOpIDs[opid]
-			if !ok {
-				log.Debug().Int32("opid", opid).Msg("query no longer running")
-				// see if we should add it to the history
-				q := s.runningQueries[opid]
-				q.Observe(s.QueryHistogram)
-				if microsecs > HistoryQueryThreshold {
-					if q.Namespace != "admin.$cmd" { // skip system queries in the history
-						log.Info().Int32("opid", opid).Msg("adding query to history")
-						s.History(q)
-					}
-				}
-				delete(s.runningQueryTimes, opid)
-				delete(s.runningQueries, opid)
+	for _, q := range parsed {
+		q.metricNamespace = normalizeNamespace(q.Namespace, s.NamespaceRules)
+		if q.StartTime.IsZero() {
+			// no currentOpTime, e.g. before mongo 3.6, estimate it from the running time
+			q.StartTime = start.Add(-time.Duration(q.RunningMicros) * time.Microsecond).Truncate(time.Millisecond)
+		}
+
+		lastMicrosecs, ok := s.runningQueryTimes[q.OperationID]
+		if ok && q.RunningMicros < lastMicrosecs {
+			// running time went backwards, the opid has been reused by a new operation so the previous one finished
+			log.Debug().Int32("opid", q.OperationID).
+				Int64("last_microsecs_running", lastMicrosecs).
+				Int64("microsecs_running", q.RunningMicros).
+				Msg("opid reused by a new query")
+			s.complete(q.OperationID)
+			ok = false
+		}
+		if ok {
+			q.DeltaMicros = q.RunningMicros - lastMicrosecs
+			log.Info().
+				Str("user", q.EffectiveUser).
+				Str("op", q.Operation).
+				Int32("opid", q.OperationID).
+				Int64("last_microsecs_running", lastMicrosecs).
+				Int64("microsecs_running", q.RunningMicros).
+				Int64("delta", q.DeltaMicros).
+				Msg("query still running")
+		} else {
+			log.Debug().Str("user", q.EffectiveUser).
+				Str("op", q.Operation).
+				Int32("opid", q.OperationID).Msg("new query started")
+			q.DeltaMicros = q.RunningMicros
+		}
+
+		if s.emitsMetrics(q) {
+			q.Inc(s.QueryCounter, s.Labels, s.MinDeltaMicros)
+			q.IncSeconds(s.QuerySeconds, s.Labels, s.MinDeltaMicros)
+			q.IncDatabase(s.DatabaseCounter, s.MinDeltaMicros)
+		}
+
+		s.runningQueryTimes[q.OperationID] = q.RunningMicros
+		s.runningQueries[q.OperationID] = q
+		currentQueryOpIDs[q.OperationID] = true
+	}
+
+	for opid := range s.runningQueryTimes {
+		_, ok := currentQueryOpIDs[opid]
+		if !ok {
+			log.Debug().Int32("opid", opid).Msg("query no longer running")
+			s.complete(opid)
+		}
+	}
+
+	s.setRunningGauge()
+	s.setRunningAge()
+	s.setIndexBuildGauges()
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	return nil
+}
+
+// Ready reports whether the first currentOp poll has succeeded, until then there are no running queries to show
+func (s *MongoSlow) Ready() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// setActiveOpsGauge sets the active ops gauge to the number of operations of each user, removing the users that no
+// longer have any
+func (s *MongoSlow) setActiveOpsGauge(queries []*Query) {
+	if s.ActiveOpsGauge == nil {
+		return
+	}
+	counts := make(map[string]int)
+	for _, q := range queries {
+		counts[q.EffectiveUser]++
+	}
+	for user := range s.activeUsers {
+		if _, ok := counts[user]; !ok {
+			s.ActiveOpsGauge.DeleteLabelValues(user)
+		}
+	}
+	s.activeUsers = make(map[string]bool, len(counts))
+	for user, count := range counts {
+		s.activeUsers[user] = true
+		s.ActiveOpsGauge.WithLabelValues(user).Set(float64(count))
+	}
+}
+
+// setRunningGauge sets the running and yields gauges to the totals of the running queries per label set, removing
+// the label sets that no longer have a running query
+func (s *MongoSlow) setRunningGauge() {
+	if s.RunningGauge == nil && s.YieldsGauge == nil {
+		return
+	}
+	running := make(map[string]float64)
+	yields := make(map[string]float64)
+	labels := make(map[string]prometheus.Labels)
+	for _, q := range s.runningQueries {
+		if !s.emitsMetrics(q) {
+			continue
+		}
+		l := q.Labels(s.Labels)
+		key := labelKey(l, s.Labels)
+		running[key] += float64(q.RunningMicros) / 1000000
+		yields[key] += float64(q.NumYields)
+		labels[key] = l
+	}
+	for key, l := range s.gaugeLabels {
+		if _, ok := labels[key]; !ok {
+			if s.RunningGauge != nil {
+				s.RunningGauge.Delete(l)
+			}
+			if s.YieldsGauge != nil {
+				s.YieldsGauge.Delete(l)
 			}
 		}
+	}
+	for key, l := range labels {
+		if s.RunningGauge != nil {
+			s.RunningGauge.With(l).Set(running[key])
+		}
+		if s.YieldsGauge != nil {
+			s.YieldsGauge.With(l).Set(yields[key])
+		}
+	}
+	s.gaugeLabels = labels
+}
+
+// labelKey joins the label values in name order, to use a label set as a map key
+func labelKey(labels prometheus.Labels, names []string) string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, "\xff")
+}
+
+// currentOp runs the currentOp command with the command timeout
+func (s *MongoSlow) currentOp(ctx context.Context) ([]primitive.M, error) {
+	if s.CommandTimeout <= 0 {
+		return s.runner.CurrentOp(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.CommandTimeout)
+	defer cancel()
+	return s.runner.CurrentOp(ctx)
+}
+
+// isTimeout reports whether err is a command that ran out of time, rather than a failure of the command itself
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// complete records a query that is no longer running in the histogram and, if it was slow enough, the history
+func (s *MongoSlow) complete(opid int32) {
+	microsecs := s.runningQueryTimes[opid]
+	q := s.runningQueries[opid]
+	if s.emitsMetrics(q) {
+		q.Observe(s.QueryHistogram, s.Labels, s.MinObserveMicros)
+		q.Observe(s.OpHistograms[q.Operation], s.Labels, s.MinObserveMicros)
+	}
+	if q.KillPending {
+		// interrupted by killOp or maxTimeMS, it didn't complete
+		s.stats.InterruptedQueries++
+		if s.InterruptedQueries != nil {
+			s.InterruptedQueries.Inc()
+		}
+	}
+	if microsecs > HistoryQueryThreshold {
+		if q.Namespace != "admin.$cmd" && !s.isOwnOperation(q) { // skip system queries in the history
+			log.Info().Int32("opid", opid).Msg("adding query to history")
+			entry := historyEntry(q, s.MaxHistoryBytes)
+			s.addHistory(entry)
+			if s.SlowLog != nil {
+				s.slowLogPending = append(s.slowLogPending, entry)
+			}
+		}
+	}
+	delete(s.runningQueryTimes, opid)
+	delete(s.runningQueries, opid)
+}
+
+// emitsMetrics reports whether the query's namespace is one of the MetricNamespaces, index builds are legitimately
+// slow so have their own metrics instead
+func (s *MongoSlow) emitsMetrics(q *Query) bool {
+	if q.IndexBuild {
+		return false
+	}
+	if s.isOwnOperation(q) {
+		return false
+	}
+	return len(s.MetricNamespaces) == 0 || matchNamespace(q.Namespace, s.MetricNamespaces)
+}
+
+// isOwnOperation reports whether the query is the monitor measuring itself, either from a client with the
+// ExcludeAppName or a currentOp command, which shows up in the next poll when currentOp is slow
+func (s *MongoSlow) isOwnOperation(q *Query) bool {
+	if s.ExcludeAppName != "" && q.AppName == s.ExcludeAppName {
+		return true
+	}
+	return isCurrentOp(q.Raw["command"])
+}
 
-		time.Sleep(interval)
+// isCurrentOp reports whether a command is the currentOp command or an aggregate starting with $currentOp
+func isCurrentOp(command interface{}) bool {
+	var pipeline interface{}
+	switch command := command.(type) {
+	case primitive.M:
+		if _, ok := command["currentOp"]; ok {
+			return true
+		}
+		pipeline = command["pipeline"]
+	case primitive.D:
+		if len(command) > 0 && command[0].Key == "currentOp" {
+			return true
+		}
+		pipeline = command.Map()["pipeline"]
+	}
+	stages, ok := pipeline.(primitive.A)
+	if !ok || len(stages) == 0 {
+		return false
+	}
+	switch stage := stages[0].(type) {
+	case primitive.M:
+		_, ok = stage["$currentOp"]
+	case primitive.D:
+		ok = len(stage) > 0 && stage[0].Key == "$currentOp"
 	}
+	return ok
 }
 
+// Stats returns a snapshot of the poll loop counters
+func (s *MongoSlow) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stats
+}
+
+// History adds a query to the history of slow queries
 func (s *MongoSlow) History(query *Query) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addHistory(query)
+}
+
+// historyEntry copies the query for the history, bounding the memory held by the history ring. The command is cut to
+// max bytes and the raw document dropped if its bson is bigger, the running query is left whole.
+func historyEntry(q *Query, max int) *Query {
+	if max <= 0 {
+		return q
+	}
+	entry := *q
+	if command, truncated := truncateCommand(entry.Command, max); truncated {
+		entry.Command, entry.CommandTruncated = command, true
+	}
+	if raw, err := bson.Marshal(primitive.M(entry.Raw)); err != nil || len(raw) > max {
+		entry.Raw = nil
+	}
+	return &entry
+}
+
+func (s *MongoSlow) addHistory(query *Query) {
 	s.history.Value = query
 	s.history = s.history.Next()
 }
 
 // Query object to hold current query details for feeding to Prometheus metrics
 type Query struct {
-	OperationID   int32       `json:"opid"`           // opid
-	EffectiveUser string      `json:"effective_user"` // effectiveUsers:[map[db:admin user:auto-default-some-user-name-92c989781b97]]
-	RunningMicros int64       `json:"running_micros"` // microseconds_running (with state to get delta)
-	DeltaMicros   int64       `json:"delta_micros"`   // delta from last check in microseconds
-	Operation     string      `json:"op"`             // op
-	Namespace     string      `json:"ns"`             // ns
-	Command       string      `json:"command"`        // string representation of the command
-	Raw           primitive.M `json:"raw"`
+	OperationID      int32     `json:"opid" label:"Op ID"`                            // opid
+	EffectiveUser    string    `json:"effective_user" label:"User"`                   // effectiveUsers:[map[db:admin user:auto-default-some-user-name-92c989781b97]]
+	RunningMicros    int64     `json:"running_micros" label:"us"`                     // microseconds_running (with state to get delta)
+	DeltaMicros      int64     `json:"delta_micros" label:"Delta us"`                 // delta from last check in microseconds
+	Operation        string    `json:"op" label:"Op"`                                 // op
+	Namespace        string    `json:"ns" label:"Namespace"`                          // ns
+	Command          string    `json:"command" label:"Command"`                       // string representation of the command
+	CommandTruncated bool      `json:"command_truncated,omitempty" label:"Truncated"` // command was cut to MaxCommandLength
+	StartTime        time.Time `json:"start_time" label:"Started"`                    // currentOpTime, estimated from the running time if missing
+	IndexBuild       bool      `json:"index_build,omitempty" label:"Index Build"`     // createIndexes or the index build thread, kept out of the slow query metrics
+	ProgressPct      *float64  `json:"progress_pct,omitempty" label:"Progress %"`     // index build percentage done, when reported
+	ConnectionID     int64     `json:"connection_id,omitempty" label:"Connection"`    // connectionId, missing for internal operations
+	NumYields        int64     `json:"num_yields" label:"Yields"`                     // numYields, times the op yielded to other operations, zero if not reported
+	AppName          string    `json:"app_name,omitempty" label:"App"`                // appName the client connected with
+	KillPending      bool      `json:"kill_pending,omitempty" label:"Kill Pending"`   // killPending, the op has been interrupted and is being killed
+	Raw              Document  `json:"raw,omitempty" label:"Raw"`                     // the currentOp document, only in responses asking for ?raw=true
+
+	metricNamespace string // normalized ns used as the metric label
+}
+
+// Document is a bson document that marshals to relaxed extended JSON, so ObjectIds, dates and regexes stay readable
+type Document primitive.M
+
+// MarshalJSON marshals the document as relaxed extended JSON
+func (d Document) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+	return bson.MarshalExtJSON(primitive.M(d), false, false)
+}
+
+// UnmarshalJSON unmarshals relaxed extended JSON back into bson types, e.g. for a history restored from disk
+func (d *Document) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = nil
+		return nil
+	}
+	var m primitive.M
+	if err := bson.UnmarshalExtJSON(data, false, &m); err != nil {
+		return err
+	}
+	*d = Document(m)
+	return nil
 }
 
 // Observe updates the histogram with completed queries - use to get a view of slow completed queries
-func (q *Query) Observe(histogram *prometheus.HistogramVec) {
-	if q.RunningMicros > 500000 {
-		histogram.WithLabelValues(q.EffectiveUser, q.Operation, q.Namespace).Observe(float64(q.RunningMicros) / 1000000)
+func (q *Query) Observe(histogram *prometheus.HistogramVec, labels []string, minObserveMicros int64) {
+	if histogram == nil {
+		return
+	}
+	if q.RunningMicros > minObserveMicros {
+		histogram.With(q.Labels(labels)).Observe(float64(q.RunningMicros) / 1000000)
+	}
+}
+
+// Inc updates the query counter for running queries with milliseconds - use to get real time data on running slow
+// queries
+//
+// Deprecated: use IncSeconds, the milliseconds counter is only kept for dashboards not yet moved to seconds
+func (q *Query) Inc(counter *prometheus.CounterVec, labels []string, minDeltaMicros int64) {
+	if counter == nil || q.DeltaMicros < minDeltaMicros { // if we are just picking up just executed queries, skip them
+		return
 	}
+	counter.With(q.Labels(labels)).Add(float64(q.DeltaMicros) / 1000) // change to milliseconds
 }
 
-// Inc updates the query counter for running queries - use to get real time data on running slow queries
-func (q *Query) Inc(counter *prometheus.CounterVec) {
-	if q.DeltaMicros < 10000 { // if we are just picking up just executed queries, skip them
+// IncSeconds updates the counter with the seconds the query has run since the last poll, the unit every other
+// metric uses
+func (q *Query) IncSeconds(counter *prometheus.CounterVec, labels []string, minDeltaMicros int64) {
+	if counter == nil || q.DeltaMicros < minDeltaMicros {
 		return
 	}
-	counter.WithLabelValues(q.EffectiveUser, q.Operation, q.Namespace).Add(float64(q.DeltaMicros) / 1000) // change to milliseconds
+	counter.With(q.Labels(labels)).Add(float64(q.DeltaMicros) / 1000000) // change to seconds
 }
 
+// IncDatabase updates the per database counter for running queries - use to get a rollup of slow time per database
+func (q *Query) IncDatabase(counter *prometheus.CounterVec, minDeltaMicros int64) {
+	if counter == nil || q.DeltaMicros < minDeltaMicros {
+		return
+	}
+	counter.WithLabelValues(databaseName(q.labelNamespace())).Add(float64(q.DeltaMicros) / 1000000) // change to seconds
+}
+
+// labelNamespace is the namespace to use as a metric label, normalized if any namespace rules are configured
+func (q *Query) labelNamespace() string {
+	if q.metricNamespace != "" {
+		return q.metricNamespace
+	}
+	return q.Namespace
+}
+
+// Database returns the database part of the namespace, namespaces without a collection are returned as is
+func (q *Query) Database() string {
+	return databaseName(q.Namespace)
+}
+
+func databaseName(ns string) string {
+	dot := strings.Index(ns, ".")
+	if dot < 0 {
+		return ns
+	}
+	return ns[:dot]
+}
+
+// trimRandomBytes strips the UserTrim match from the user, users that don't match are left untouched
 func trimRandomBytes(user string) string {
-	last := strings.LastIndex(user, "-")
-	if last < 0 {
+	if UserTrim == nil {
+		return user
+	}
+	loc := UserTrim.FindStringIndex(user)
+	if loc == nil {
 		return user
 	}
-	return user[:last]
+	return user[:loc[0]] + user[loc[1]:]
 }
 
 func Parse(query primitive.M) (*Query, error) {
 	q := &Query{}
-	q.Raw = query
+	q.Raw = Document(query)
 
-	opid, ok := query["opid"]
+	opid, ok := intValue(query["opid"])
 	if !ok {
 		return nil, errors.New("missing opid field")
 	}
-	q.OperationID = opid.(int32)
+	q.OperationID = int32(opid)
 
-	microSecsRunning, ok := query["microsecs_running"]
+	microSecsRunning, ok := intValue(query["microsecs_running"])
 	if !ok {
 		return nil, errors.New("missing microseconds_running")
 	}
-	q.RunningMicros = microSecsRunning.(int64)
+	q.RunningMicros = microSecsRunning
 
-	op, ok := query["op"]
-	if !ok {
-		return nil, errors.New("missing op")
+	if err := parseOperation(q, query); err != nil {
+		return nil, err
 	}
-	q.Operation = op.(string)
 
-	ns, ok := query["ns"]
+	users, ok := query["effectiveUsers"].(primitive.A)
+	if !ok || len(users) == 0 {
+		return nil, errors.New("missing effective user field")
+	}
+	user, ok := users[0].(primitive.M)
 	if !ok {
-		return nil, errors.New("missing ns")
+		return nil, errors.New("invalid effective user field")
 	}
-	q.Namespace = ns.(string)
-
-	effectiveUsers, ok := query["effectiveUsers"]
+	name, ok := user["user"].(string)
 	if !ok {
-		return nil, errors.New("missing effective user field")
+		return nil, errors.New("missing effective user name")
 	}
-	user := effectiveUsers.(primitive.A)[0]
-	q.EffectiveUser = user.(primitive.M)["user"].(string)
-	q.EffectiveUser = trimRandomBytes(q.EffectiveUser)
+	q.EffectiveUser = trimRandomBytes(name)
 
-	// hacky way of showing the running command in the HTML table without
-	// having the parse this odd mongo structure
-	command, err := json.Marshal(query["command"])
-	if err == nil {
-		q.Command = string(command)
+	// not every operation has a client connection, e.g. internal replication ops
+	if connectionID, ok := intValue(query["connectionId"]); ok {
+		q.ConnectionID = connectionID
 	}
 
+	if numYields, ok := intValue(query["numYields"]); ok {
+		q.NumYields = numYields
+	}
+
+	q.AppName, _ = query["appName"].(string)
+	q.KillPending, _ = query["killPending"].(bool)
+
+	parseCommand(q, query)
+	parseStartTime(q, query)
+	parseIndexBuild(q, query)
+
 	return q, nil
 }
+
+// intValue returns a bson number as an int64, the type depends on the server version and the replay file format
+func intValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,757 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// fakeRunner returns one canned currentOp poll per call, repeating the last one when it runs out
+type fakeRunner struct {
+	polls [][]primitive.M
+	err   error
+	calls int
+}
+
+func (f *fakeRunner) CurrentOp(ctx context.Context) ([]primitive.M, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.polls) == 0 {
+		return nil, nil
+	}
+	i := f.calls - 1
+	if i >= len(f.polls) {
+		i = len(f.polls) - 1
+	}
+	return f.polls[i], nil
+}
+
+// op builds a minimal currentOp document
+func op(opid int32, micros int64, ns string) primitive.M {
+	return primitive.M{
+		"opid":              opid,
+		"op":                "query",
+		"ns":                ns,
+		"microsecs_running": micros,
+		"effectiveUsers":    primitive.A{primitive.M{"user": "app-92c989781b97", "db": "admin"}},
+		"command":           primitive.M{"find": "bar"},
+	}
+}
+
+// decodedOp is op with the command as the mongo runner decodes it, from bson in the server's field order
+func decodedOp(opid int32, micros int64, ns string, command primitive.D) primitive.M {
+	entry := op(opid, micros, ns)
+	entry["command"] = command
+	raw, err := bson.Marshal(entry)
+	So(err, ShouldBeNil)
+	decoded, err := decodeOperation(raw)
+	So(err, ShouldBeNil)
+	return decoded
+}
+
+func newTestCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "slow_query_ms"}, []string{"user", "operation", "ns"})
+}
+
+func TestDeltaAccounting(t *testing.T) {
+	Convey("Given a query that is still running across two polls", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar")},
+			{op(1, 3000000, "foo.bar")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.QueryCounter = newTestCounter()
+		counter := slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.runningQueries[1].DeltaMicros, ShouldEqual, 1000000)
+		So(testutil.ToFloat64(counter), ShouldEqual, 1000)
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.runningQueries[1].DeltaMicros, ShouldEqual, 2000000)
+		So(testutil.ToFloat64(counter), ShouldEqual, 3000)
+		So(runner.calls, ShouldEqual, 2)
+	})
+}
+
+func TestSecondsCounter(t *testing.T) {
+	Convey("Given the legacy milliseconds counter and the seconds counter", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1500000, "foo.bar")},
+			{op(1, 4250000, "foo.bar")},
+		}})
+		slow.QueryCounter = newTestCounter()
+		slow.QuerySeconds = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "slow_query_seconds_total"}, []string{"user", "operation", "ns"})
+		ms := slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")
+		secs := slow.QuerySeconds.WithLabelValues("app", "query", "foo.bar")
+
+		Convey("The seconds counter is the milliseconds counter / 1000 after every poll", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(secs), ShouldEqual, 1.5)
+			So(testutil.ToFloat64(secs), ShouldAlmostEqual, testutil.ToFloat64(ms)/1000)
+
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(secs), ShouldAlmostEqual, 4.25)
+			So(testutil.ToFloat64(secs), ShouldAlmostEqual, testutil.ToFloat64(ms)/1000)
+		})
+
+		Convey("Without the legacy counter only seconds are counted", func() {
+			slow.QueryCounter = nil
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(secs), ShouldEqual, 1.5)
+		})
+	})
+}
+
+func TestOpIDReuse(t *testing.T) {
+	Convey("Given an opid that is reused by a new query with a smaller running time", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 10000000, "foo.bar")},
+			{op(1, 2000000, "foo.bar")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.QueryCounter = newTestCounter()
+		counter := slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("The new query starts from its own running time", func() {
+			So(slow.runningQueries[1].DeltaMicros, ShouldEqual, 2000000)
+			So(slow.runningQueryTimes[1], ShouldEqual, 2000000)
+			So(testutil.ToFloat64(counter), ShouldEqual, 12000)
+		})
+
+		Convey("The previous query is treated as completed", func() {
+			So(slow.history.Prev().Value.(*Query).RunningMicros, ShouldEqual, 10000000)
+		})
+	})
+}
+
+func TestNoiseThresholds(t *testing.T) {
+	Convey("Given a configured minimum delta", t, func() {
+		counter := newTestCounter()
+		labels := []string{"app", "query", "foo.bar"}
+
+		(&Query{EffectiveUser: "app", Operation: "query", Namespace: "foo.bar", DeltaMicros: 49999}).Inc(counter, MetricLabels, 50000)
+		So(testutil.CollectAndCount(counter), ShouldEqual, 0)
+
+		(&Query{EffectiveUser: "app", Operation: "query", Namespace: "foo.bar", DeltaMicros: 50000}).Inc(counter, MetricLabels, 50000)
+		So(testutil.ToFloat64(counter.WithLabelValues(labels...)), ShouldEqual, 50)
+	})
+
+	Convey("Given a configured minimum observe time", t, func() {
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "slow_query_secs"}, []string{"user", "operation", "ns"})
+
+		(&Query{EffectiveUser: "app", Operation: "query", Namespace: "foo.bar", RunningMicros: 2000000}).Observe(histogram, MetricLabels, 2000000)
+		So(testutil.CollectAndCount(histogram), ShouldEqual, 0)
+
+		(&Query{EffectiveUser: "app", Operation: "query", Namespace: "foo.bar", RunningMicros: 2000001}).Observe(histogram, MetricLabels, 2000000)
+		So(testutil.CollectAndCount(histogram), ShouldEqual, 1)
+	})
+
+	Convey("Given the thresholds are set on MongoSlow", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 20000, "foo.bar")},
+			{},
+		}}
+		slow := NewWithRunner(runner)
+		So(slow.MinDeltaMicros, ShouldEqual, DefaultMinDeltaMicros)
+		So(slow.MinObserveMicros, ShouldEqual, DefaultMinObserveMicros)
+
+		slow.QueryCounter = newTestCounter()
+		slow.QueryHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "slow_query_secs"}, []string{"user", "operation", "ns"})
+		slow.MinDeltaMicros = 30000
+		slow.MinObserveMicros = 10000
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 0)
+		So(testutil.CollectAndCount(slow.QueryHistogram), ShouldEqual, 1)
+	})
+}
+
+func TestClose(t *testing.T) {
+	Convey("Given a MongoSlow that was never run", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+
+		Convey("Close is safe to call and idempotent", func() {
+			So(slow.Close(context.Background()), ShouldBeNil)
+			So(slow.Close(context.Background()), ShouldBeNil)
+			So(slow.Run(context.Background(), time.Millisecond), ShouldEqual, ErrClosed)
+		})
+	})
+
+	Convey("Given a running MongoSlow", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar")}}})
+		result := make(chan error, 1)
+		go func() {
+			result <- slow.Run(context.Background(), time.Millisecond)
+		}()
+		for slow.Stats().Polls == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		Convey("Close stops the run loop before returning", func() {
+			So(slow.Close(context.Background()), ShouldBeNil)
+			select {
+			case err := <-result:
+				So(err, ShouldBeNil)
+			case <-time.After(time.Second):
+				So("run loop still running after close", ShouldBeEmpty)
+			}
+			So(slow.Close(context.Background()), ShouldBeNil)
+		})
+	})
+}
+
+func TestDatabaseRollup(t *testing.T) {
+	Convey("Given queries against two collections in the same database", t, func() {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "db_slow_secs"}, []string{"db"})
+		queries := []*Query{
+			{Namespace: "foo.bar", DeltaMicros: 2000000},
+			{Namespace: "foo.baz", DeltaMicros: 3000000},
+			{Namespace: "admin", DeltaMicros: 1000000},
+		}
+		for _, q := range queries {
+			q.IncDatabase(counter, DefaultMinDeltaMicros)
+		}
+
+		So(testutil.ToFloat64(counter.WithLabelValues("foo")), ShouldEqual, 5)
+		So(testutil.ToFloat64(counter.WithLabelValues("admin")), ShouldEqual, 1)
+		So(testutil.CollectAndCount(counter), ShouldEqual, 2)
+	})
+
+	Convey("Given namespaces with and without a collection", t, func() {
+		So((&Query{Namespace: "foo.bar.baz"}).Database(), ShouldEqual, "foo")
+		So((&Query{Namespace: "admin"}).Database(), ShouldEqual, "admin")
+		So((&Query{Namespace: ""}).Database(), ShouldEqual, "")
+	})
+}
+
+func TestTrimRandomBytes(t *testing.T) {
+	Convey("Given the default user trim regex", t, func() {
+		So(trimRandomBytes("auto-default-some-user-name-92c989781b97"), ShouldEqual, "auto-default-some-user-name")
+		So(trimRandomBytes("root"), ShouldEqual, "root")
+	})
+
+	Convey("Given a user trim regex that only matches a hex suffix", t, func() {
+		defer func(trim *regexp.Regexp) { UserTrim = trim }(UserTrim)
+		UserTrim = regexp.MustCompile(`-[0-9a-f]{12}$`)
+
+		So(trimRandomBytes("auto-default-some-user-name-92c989781b97"), ShouldEqual, "auto-default-some-user-name")
+		So(trimRandomBytes("read-only-svc"), ShouldEqual, "read-only-svc")
+	})
+}
+
+// blockingRunner stalls every currentOp until its context is done, like a server that stopped responding
+type blockingRunner struct{}
+
+func (blockingRunner) CurrentOp(ctx context.Context) ([]primitive.M, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCommandTimeout(t *testing.T) {
+	Convey("Given a server that never answers currentOp", t, func() {
+		slow := NewWithRunner(blockingRunner{})
+		slow.CommandTimeout = 10 * time.Millisecond
+		So(NewWithRunner(nil).CommandTimeout, ShouldEqual, DefaultCommandTimeout)
+
+		Convey("A poll returns a timeout error instead of hanging", func() {
+			result := make(chan error, 1)
+			go func() {
+				result <- slow.poll(context.Background())
+			}()
+			select {
+			case err := <-result:
+				So(isTimeout(err), ShouldBeTrue)
+				So(slow.Stats().Timeouts, ShouldEqual, 1)
+			case <-time.After(time.Second):
+				So("poll still running after the command timeout", ShouldBeEmpty)
+			}
+		})
+
+		Convey("The run loop keeps polling after a timeout", func() {
+			go slow.Run(context.Background(), time.Millisecond)
+			deadline := time.Now().Add(time.Second)
+			for slow.Stats().Timeouts < 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			So(slow.Stats().Timeouts, ShouldBeGreaterThanOrEqualTo, 2)
+			So(slow.Close(context.Background()), ShouldBeNil)
+		})
+	})
+}
+
+func TestMaxQueriesPerPoll(t *testing.T) {
+	Convey("Given more running queries than the per poll cap", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.a"), op(2, 4000000, "foo.b"), op(3, 2000000, "foo.c"), op(4, 3000000, "foo.d")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.QueryCounter = newTestCounter()
+		slow.SkippedQueries = prometheus.NewCounter(prometheus.CounterOpts{Name: "queries_skipped_total"})
+		slow.MaxQueriesPerPoll = 2
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Only the slowest queries are processed", func() {
+			So(slow.runningQueries, ShouldHaveLength, 2)
+			So(slow.runningQueries, ShouldContainKey, int32(2))
+			So(slow.runningQueries, ShouldContainKey, int32(4))
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 2)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "foo.b")), ShouldEqual, 4000)
+		})
+
+		Convey("The skipped queries are counted", func() {
+			So(testutil.ToFloat64(slow.SkippedQueries), ShouldEqual, 2)
+			So(slow.Stats().SkippedQueries, ShouldEqual, 2)
+		})
+
+		Convey("A tracked query that falls out of the cap is not completed", func() {
+			runner.polls = append(runner.polls, []primitive.M{
+				op(2, 5000000, "foo.b"), op(4, 3500000, "foo.d"), op(5, 9000000, "foo.e"), op(6, 8000000, "foo.f"),
+			})
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(slow.runningQueries, ShouldContainKey, int32(2))
+			So(slow.runningQueries, ShouldContainKey, int32(4))
+			So(slow.history.Prev().Value, ShouldBeNil)
+		})
+	})
+}
+
+func TestParseConnectionID(t *testing.T) {
+	Convey("Given currentOp entries with and without a connectionId", t, func() {
+		withInt32 := op(1, 1000000, "foo.bar")
+		withInt32["connectionId"] = int32(4521)
+		withInt64 := op(2, 1000000, "foo.bar")
+		withInt64["connectionId"] = int64(4522)
+		without := op(3, 1000000, "local.oplog.rs")
+
+		Convey("The connection id is parsed whatever its number type", func() {
+			q, err := Parse(withInt32)
+			So(err, ShouldBeNil)
+			So(q.ConnectionID, ShouldEqual, 4521)
+
+			q, err = Parse(withInt64)
+			So(err, ShouldBeNil)
+			So(q.ConnectionID, ShouldEqual, 4522)
+		})
+
+		Convey("A missing connection id is left empty", func() {
+			q, err := Parse(without)
+			So(err, ShouldBeNil)
+			So(q.ConnectionID, ShouldEqual, 0)
+
+			out, err := json.Marshal(q)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldNotContainSubstring, "connection_id")
+		})
+	})
+}
+
+func TestParseExtendedJSON(t *testing.T) {
+	Convey("Given a query filtering on an ObjectId", t, func() {
+		id, _ := primitive.ObjectIDFromHex("5f1d7a2b9c3e4d5f6a7b8c9d")
+		entry := op(1, 1000000, "foo.bar")
+		entry["command"] = primitive.M{"find": "bar", "filter": primitive.M{"_id": id}}
+
+		q, err := Parse(entry)
+		So(err, ShouldBeNil)
+
+		Convey("The command renders the ObjectId as $oid", func() {
+			So(q.Command, ShouldContainSubstring, `"_id":{"$oid":"5f1d7a2b9c3e4d5f6a7b8c9d"}`)
+		})
+
+		Convey("The raw document in the json does too", func() {
+			out, err := json.Marshal(q)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, `"filter":{"_id":{"$oid":"5f1d7a2b9c3e4d5f6a7b8c9d"}}`)
+		})
+	})
+}
+
+func TestCommandTruncation(t *testing.T) {
+	Convey("Given a command longer than the max command length", t, func() {
+		defer func(max int) { MaxCommandLength = max }(MaxCommandLength)
+		MaxCommandLength = 40
+
+		ids := make(primitive.A, 100)
+		for i := range ids {
+			ids[i] = int32(i)
+		}
+		entry := decodedOp(1, 1000000, "foo.bar", primitive.D{
+			{Key: "find", Value: "bar"},
+			{Key: "filter", Value: primitive.D{{Key: "_id", Value: primitive.D{{Key: "$in", Value: ids}}}}},
+			{Key: "lsid", Value: primitive.D{{Key: "id", Value: "session"}}},
+			{Key: "$db", Value: "foo"},
+		})
+
+		q, err := Parse(entry)
+		So(err, ShouldBeNil)
+
+		Convey("The start is kept with an ellipsis and the query is flagged", func() {
+			So(q.Command, ShouldEqual, `{"find":"bar","filter":{"_id":{"$in":[0,`+"…")
+			So(q.CommandTruncated, ShouldBeTrue)
+
+			out, err := json.Marshal(q)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, `"command_truncated":true`)
+		})
+
+		Convey("A command decoded as a map is cut at the same place on every poll", func() {
+			entry["command"] = primitive.M{"find": "bar", "filter": primitive.M{"_id": primitive.M{"$in": ids}}, "$db": "foo"}
+			for i := 0; i < 20; i++ {
+				q, err := Parse(entry)
+				So(err, ShouldBeNil)
+				So(q.Command, ShouldEqual, `{"$db":"foo","filter":{"_id":{"$in":[0,1`+"…")
+				So(q.CommandTruncated, ShouldBeTrue)
+			}
+		})
+
+		Convey("A short command is left alone", func() {
+			entry["command"] = primitive.M{"find": "bar"}
+			q, err := Parse(entry)
+			So(err, ShouldBeNil)
+			So(q.Command, ShouldEqual, `{"find":"bar"}`)
+			So(q.CommandTruncated, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a multi byte character at the cut", t, func() {
+		command, truncated := truncateCommand(`{"ns":"é"}`, 8)
+		So(truncated, ShouldBeTrue)
+		So(command, ShouldEqual, `{"ns":"`+"…")
+	})
+}
+
+func TestRunningGauge(t *testing.T) {
+	Convey("Given a query that runs for two polls and then completes", t, func() {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "running_query_secs"}, []string{"user", "operation", "ns"})
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.bar"), op(2, 500000, "foo.baz")},
+			{op(1, 3000000, "foo.bar")},
+			{},
+		}})
+		slow.RunningGauge = gauge
+
+		Convey("The gauge tracks the live running time", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.CollectAndCount(gauge), ShouldEqual, 2)
+			So(testutil.ToFloat64(gauge.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 1)
+
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.CollectAndCount(gauge), ShouldEqual, 1)
+			So(testutil.ToFloat64(gauge.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 3)
+
+			Convey("And drops the series once the query completes", func() {
+				So(slow.poll(context.Background()), ShouldBeNil)
+				So(testutil.CollectAndCount(gauge), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMaxHistoryBytes(t *testing.T) {
+	Convey("Given a slow query with a large command that completes", t, func() {
+		ids := make(primitive.A, 1000)
+		for i := range ids {
+			ids[i] = int32(i)
+		}
+		entry := decodedOp(1, 10000000, "foo.bar", primitive.D{
+			{Key: "find", Value: "bar"},
+			{Key: "filter", Value: primitive.D{{Key: "_id", Value: primitive.D{{Key: "$in", Value: ids}}}}},
+			{Key: "$db", Value: "foo"},
+		})
+
+		runner := &fakeRunner{polls: [][]primitive.M{{entry}, {}}}
+		slow := NewWithRunner(runner)
+		slow.MaxHistoryBytes = 64
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("The running query keeps its raw document and whole command", func() {
+			running := slow.runningQueries[1]
+			So(running.Raw, ShouldNotBeNil)
+			So(len(running.Command), ShouldBeGreaterThan, 64)
+			So(running.CommandTruncated, ShouldBeFalse)
+
+			Convey("The history entry drops the raw document and truncates the command", func() {
+				So(slow.poll(context.Background()), ShouldBeNil)
+				stored := slow.history.Prev().Value.(*Query)
+				So(stored.Raw, ShouldBeNil)
+				So(stored.Command, ShouldStartWith, `{"find":"bar","filter":`)
+				So(len(stored.Command), ShouldBeLessThanOrEqualTo, 64+len(truncatedMarker))
+				So(stored.CommandTruncated, ShouldBeTrue)
+				So(running.Raw, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a small query and a limit it fits in", t, func() {
+		q := &Query{Command: `{"find":"bar"}`, Raw: Document{"opid": int32(1)}}
+		So(historyEntry(q, 1024), ShouldResemble, q)
+		So(historyEntry(q, 0), ShouldEqual, q)
+	})
+}
+
+func TestNumYields(t *testing.T) {
+	Convey("Given a query that has yielded", t, func() {
+		entry := op(1, 1000000, "foo.bar")
+		entry["numYields"] = int32(42)
+		q, err := Parse(entry)
+		So(err, ShouldBeNil)
+		So(q.NumYields, ShouldEqual, 42)
+
+		Convey("It is in the json", func() {
+			out, err := json.Marshal(q)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, `"num_yields":42`)
+		})
+	})
+
+	Convey("Given a query without numYields", t, func() {
+		q, err := Parse(op(1, 1000000, "foo.bar"))
+		So(err, ShouldBeNil)
+		So(q.NumYields, ShouldEqual, 0)
+	})
+
+	Convey("Given the yields gauge", t, func() {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "running_query_yields"}, []string{"user", "operation", "ns"})
+		first, second := op(1, 1000000, "foo.bar"), op(2, 1000000, "foo.bar")
+		first["numYields"], second["numYields"] = int64(10), int64(5)
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{first, second}, {}}})
+		slow.YieldsGauge = gauge
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(testutil.ToFloat64(gauge.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 15)
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(testutil.CollectAndCount(gauge), ShouldEqual, 0)
+	})
+}
+
+func TestPollMetrics(t *testing.T) {
+	Convey("Given two poll cycles", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.a"), op(2, 2000000, "foo.b"), op(3, 3000000, "foo.c")},
+			{op(1, 2000000, "foo.a")},
+		}}
+		slow := NewWithRunner(runner)
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "poll_duration_seconds"})
+		slow.PollDuration = histogram
+		slow.PollOps = prometheus.NewGauge(prometheus.GaugeOpts{Name: "poll_ops"})
+
+		So(slow.poll(context.Background()), ShouldBeNil)
+		So(testutil.ToFloat64(slow.PollOps), ShouldEqual, 3)
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Each cycle is observed and the gauge has the ops of the last one", func() {
+			So(testutil.CollectAndCount(histogram), ShouldEqual, 1)
+			So(testutil.ToFloat64(slow.PollOps), ShouldEqual, 1)
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(histogram)
+			families, err := reg.Gather()
+			So(err, ShouldBeNil)
+			So(families[0].GetMetric()[0].GetHistogram().GetSampleCount(), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestExcludeAppName(t *testing.T) {
+	Convey("Given a poll including the monitor's own currentOp", t, func() {
+		self := op(1, 2000000, "admin.$cmd")
+		self["appName"] = DefaultAppName
+		other := op(2, 2000000, "foo.bar")
+		other["appName"] = "orders-api"
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{self, other}}})
+		slow.QueryCounter = newTestCounter()
+		slow.ExcludeAppName = DefaultAppName
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("Its own operation is shown but left out of the metrics", func() {
+			So(slow.runningQueries[1].AppName, ShouldEqual, DefaultAppName)
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 1)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 2000)
+		})
+	})
+}
+
+func TestOwnCurrentOp(t *testing.T) {
+	Convey("Given the monitor's own slow currentOp commands", t, func() {
+		command := op(1, 6000000, "admin.$cmd")
+		command["command"] = primitive.M{"currentOp": int32(1), "$all": true, "$db": "admin"}
+		aggregate := op(2, 6000000, "admin.$cmd.aggregate")
+		aggregate["command"] = primitive.D{
+			{Key: "aggregate", Value: int32(1)},
+			{Key: "pipeline", Value: primitive.A{primitive.D{{Key: "$currentOp", Value: primitive.M{"allUsers": true}}}}},
+		}
+		runner := &fakeRunner{polls: [][]primitive.M{{command, aggregate, op(3, 6000000, "foo.bar")}, {}}}
+		slow := NewWithRunner(runner)
+		slow.QueryCounter = newTestCounter()
+		slow.QueryHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "slow_query_secs"}, []string{"user", "operation", "ns"})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("They produce no metrics", func() {
+			So(testutil.CollectAndCount(slow.QueryCounter), ShouldEqual, 1)
+			So(testutil.ToFloat64(slow.QueryCounter.WithLabelValues("app", "query", "foo.bar")), ShouldEqual, 6000)
+		})
+
+		Convey("Only the real query is observed and kept in the history once they complete", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.CollectAndCount(slow.QueryHistogram), ShouldEqual, 1)
+			var history []int32
+			slow.history.Do(func(p interface{}) {
+				if p != nil {
+					history = append(history, p.(*Query).OperationID)
+				}
+			})
+			So(history, ShouldResemble, []int32{3})
+		})
+	})
+}
+
+func TestTrackedOpIDs(t *testing.T) {
+	Convey("Given queries starting and completing", t, func() {
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.a"), op(2, 2000000, "foo.b"), op(3, 3000000, "foo.c")},
+			{op(2, 3000000, "foo.b")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.TrackedOpIDs = prometheus.NewGauge(prometheus.GaugeOpts{Name: "tracked_opids"})
+		slow.MaxTrackedOpIDs = 2
+
+		Convey("The gauge follows the tracked count", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(slow.TrackedOpIDs), ShouldEqual, 3)
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.ToFloat64(slow.TrackedOpIDs), ShouldEqual, 1)
+			So(slow.Stats().TrackedOpIDs, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestInterruptedQueries(t *testing.T) {
+	Convey("Given a query marked killPending that then disappears", t, func() {
+		killed := op(1, 3000000, "foo.bar")
+		killed["killPending"] = true
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 2000000, "foo.bar"), op(2, 2000000, "foo.baz")},
+			{killed, op(2, 3000000, "foo.baz")},
+			{},
+		}}
+		slow := NewWithRunner(runner)
+		slow.InterruptedQueries = prometheus.NewCounter(prometheus.CounterOpts{Name: "interrupted_queries_total"})
+
+		for i := 0; i < 3; i++ {
+			So(slow.poll(context.Background()), ShouldBeNil)
+		}
+
+		Convey("Only it is counted as interrupted", func() {
+			So(testutil.ToFloat64(slow.InterruptedQueries), ShouldEqual, 1)
+			So(slow.Stats().InterruptedQueries, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestConnectRetries(t *testing.T) {
+	defer func(retries int, backoff time.Duration, p func(context.Context, *mongo.Client) error) {
+		ConnectRetries, ConnectBackoff, ping = retries, backoff, p
+	}(ConnectRetries, ConnectBackoff, ping)
+	ConnectBackoff = time.Millisecond
+
+	uri := "mongodb://localhost:27017/?directConnection=true"
+	var pings int
+	ping = func(ctx context.Context, c *mongo.Client) error {
+		pings++
+		if pings <= 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	Convey("Given mongo comes up on the third ping", t, func() {
+		pings = 0
+
+		Convey("New retries until it connects", func() {
+			ConnectRetries = 3
+			slow, err := New(context.Background(), uri, "", "", "", 0)
+			So(err, ShouldBeNil)
+			So(pings, ShouldEqual, 3)
+			So(slow.Close(context.Background()), ShouldBeNil)
+		})
+
+		Convey("New gives up when out of retries", func() {
+			ConnectRetries = 1
+			_, err := New(context.Background(), uri, "", "", "", 0)
+			So(err, ShouldNotBeNil)
+			So(pings, ShouldEqual, 2)
+		})
+	})
+}
+
+func TestActiveOpsByUser(t *testing.T) {
+	Convey("Given operations from two users", t, func() {
+		reporting := op(3, 1000000, "foo.c")
+		reporting["effectiveUsers"] = primitive.A{primitive.M{"user": "reporting", "db": "admin"}}
+		runner := &fakeRunner{polls: [][]primitive.M{
+			{op(1, 1000000, "foo.a"), op(2, 1000000, "foo.b"), reporting},
+			{op(1, 2000000, "foo.a")},
+		}}
+		slow := NewWithRunner(runner)
+		slow.ActiveOpsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "active_ops_by_user"}, []string{"user"})
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("The gauge counts the ops of each user", func() {
+			So(testutil.CollectAndCount(slow.ActiveOpsGauge), ShouldEqual, 2)
+			So(testutil.ToFloat64(slow.ActiveOpsGauge.WithLabelValues("app")), ShouldEqual, 2)
+			So(testutil.ToFloat64(slow.ActiveOpsGauge.WithLabelValues("reporting")), ShouldEqual, 1)
+		})
+
+		Convey("Users without ops are removed on the next poll", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(testutil.CollectAndCount(slow.ActiveOpsGauge), ShouldEqual, 1)
+			So(testutil.ToFloat64(slow.ActiveOpsGauge.WithLabelValues("app")), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestPause(t *testing.T) {
+	Convey("Given a running poll loop", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 1000000, "foo.bar")}}})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go slow.Run(ctx, time.Millisecond)
+		for slow.Stats().Polls < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		Convey("Polling stops while paused and starts again on resume", func() {
+			slow.Pause()
+			time.Sleep(10 * time.Millisecond) // let a poll already under way finish
+			paused := slow.Stats()
+			So(paused.Paused, ShouldBeTrue)
+			time.Sleep(20 * time.Millisecond)
+			So(slow.Stats().Polls, ShouldEqual, paused.Polls)
+			So(slow.runningQueries, ShouldContainKey, int32(1))
+
+			slow.Resume()
+			So(slow.Stats().Paused, ShouldBeFalse)
+			for slow.Stats().Polls <= paused.Polls {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	})
+}
@@ -0,0 +1,119 @@
+package mongoslow
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SlowLog appends the queries entering the history to a file as newline delimited JSON, for offline analysis. The
+// file is rotated to filename.1, replacing the previous one, when a line would take it past MaxSize.
+type SlowLog struct {
+	MaxSize int64 // bytes, zero to never rotate
+
+	mu       sync.Mutex
+	filename string
+	f        *os.File // nil after Close, or while a failed rotation couldn't reopen the file
+	size     int64
+	closed   bool
+}
+
+// OpenSlowLog opens filename for appending, creating it if needed
+func OpenSlowLog(filename string, maxSize int64) (*SlowLog, error) {
+	l := &SlowLog{MaxSize: maxSize, filename: filename}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *SlowLog) open() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the full file to filename.1 and starts a new one. If the move fails filename is reopened as it is, so
+// writes carry on appending to it and the next one tries to rotate again.
+func (l *SlowLog) rotate() error {
+	err := l.f.Close()
+	if err == nil {
+		err = os.Rename(l.filename, l.filename+".1")
+	}
+	l.f = nil
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Write appends the query as one JSON line
+func (l *SlowLog) Write(q *Query) error {
+	line, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return os.ErrClosed
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			if l.f == nil {
+				return err
+			}
+			log.Warn().Err(err).Str("filename", l.filename).Msg("failed to rotate the slow log, appending to it until a rotation succeeds")
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close syncs and closes the file, later writes fail with os.ErrClosed
+func (l *SlowLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	l.f = nil
+	return err
+}
+
+// flushSlowLog writes the history entries added by the last poll to the SlowLog, called without holding mu
+func (s *MongoSlow) flushSlowLog() {
+	s.mu.Lock()
+	pending := s.slowLogPending
+	s.slowLogPending = nil
+	s.mu.Unlock()
+
+	for _, q := range pending {
+		if err := s.SlowLog.Write(q); err != nil {
+			log.Warn().Err(err).Int32("opid", q.OperationID).Msg("failed to write query to the slow log")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package mongoslow
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSlowLogStalledDisk(t *testing.T) {
+	Convey("Given a slow log that stops accepting writes", t, func() {
+		// a fifo nobody reads from blocks the writer once the pipe buffer is full, like a stalled disk
+		filename := filepath.Join(t.TempDir(), "slow.ndjson")
+		So(syscall.Mkfifo(filename, 0644), ShouldBeNil)
+		reader, err := os.OpenFile(filename, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		So(err, ShouldBeNil)
+		defer reader.Close()
+		So(syscall.SetNonblock(int(reader.Fd()), false), ShouldBeNil)
+		slowLog, err := OpenSlowLog(filename, 0)
+		So(err, ShouldBeNil)
+		defer slowLog.Close()
+		defer func() { go io.Copy(io.Discard, reader) }() // unblock the write, even if an assertion failed
+
+		big := op(1, 6000000, "foo.bar")
+		big["padding"] = strings.Repeat("x", 1<<20) // bigger than the pipe buffer
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{big}, {}}})
+		slow.SlowLog = slowLog
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		polled := make(chan error, 1)
+		go func() { polled <- slow.poll(context.Background()) }()
+
+		Convey("The handlers aren't blocked while the poll waits on the write", func() {
+			stats := make(chan Stats, 1)
+			go func() {
+				time.Sleep(50 * time.Millisecond) // let the poll reach the write
+				stats <- slow.Stats()
+			}()
+			select {
+			case <-stats:
+			case <-time.After(2 * time.Second):
+				So("handlers blocked", ShouldBeEmpty)
+			}
+			So(slow.filterHistory(func(*Query) bool { return true }), ShouldHaveLength, 1)
+
+			go io.Copy(io.Discard, reader)
+			So(<-polled, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package mongoslow
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// readNDJSON decodes each line of the file as a query
+func readNDJSON(filename string) ([]*Query, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var queries []*Query
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var q Query
+		if err := json.Unmarshal(scanner.Bytes(), &q); err != nil {
+			return nil, err
+		}
+		queries = append(queries, &q)
+	}
+	return queries, scanner.Err()
+}
+
+func TestSlowLog(t *testing.T) {
+	Convey("Given a slow log receiving the history", t, func() {
+		filename := filepath.Join(t.TempDir(), "slow.ndjson")
+		slowLog, err := OpenSlowLog(filename, 0)
+		So(err, ShouldBeNil)
+
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{
+			{op(1, 6000000, "foo.a"), op(2, 7000000, "foo.b"), op(3, 1000000, "foo.c")},
+			{op(4, 8000000, "foo.d")},
+			{},
+		}})
+		slow.SlowLog = slowLog
+		for i := 0; i < 3; i++ {
+			So(slow.poll(context.Background()), ShouldBeNil)
+		}
+		So(slowLog.Close(), ShouldBeNil)
+
+		Convey("Each history entry is a valid JSON line", func() {
+			queries, err := readNDJSON(filename)
+			So(err, ShouldBeNil)
+			So(queries, ShouldHaveLength, 3)
+			var namespaces []string
+			for _, q := range queries {
+				namespaces = append(namespaces, q.Namespace)
+			}
+			So(namespaces, ShouldContain, "foo.a")
+			So(namespaces, ShouldContain, "foo.b")
+			So(namespaces[2], ShouldEqual, "foo.d")
+		})
+
+		Convey("Reopening appends", func() {
+			slowLog, err := OpenSlowLog(filename, 0)
+			So(err, ShouldBeNil)
+			So(slowLog.Write(&Query{OperationID: 5, Namespace: "foo.e"}), ShouldBeNil)
+			So(slowLog.Close(), ShouldBeNil)
+			So(slowLog.Write(&Query{OperationID: 6}), ShouldEqual, os.ErrClosed)
+
+			queries, err := readNDJSON(filename)
+			So(err, ShouldBeNil)
+			So(queries, ShouldHaveLength, 4)
+		})
+	})
+
+	Convey("Given a slow log with room for two lines", t, func() {
+		line, _ := json.Marshal(&Query{OperationID: 1, Namespace: "foo.bar"})
+		maxSize := int64(2 * (len(line) + 1))
+		filename := filepath.Join(t.TempDir(), "slow.ndjson")
+		slowLog, err := OpenSlowLog(filename, maxSize)
+		So(err, ShouldBeNil)
+		for i := int32(1); i <= 4; i++ {
+			So(slowLog.Write(&Query{OperationID: i, Namespace: "foo.bar"}), ShouldBeNil)
+		}
+		So(slowLog.Close(), ShouldBeNil)
+
+		Convey("It rotates to .1 instead of growing past it", func() {
+			data, err := ioutil.ReadFile(filename)
+			So(err, ShouldBeNil)
+			So(len(data), ShouldBeLessThanOrEqualTo, maxSize)
+			rotated, err := readNDJSON(filename + ".1")
+			So(err, ShouldBeNil)
+			current, err := readNDJSON(filename)
+			So(err, ShouldBeNil)
+			So(rotated, ShouldHaveLength, 2)
+			So(current, ShouldHaveLength, 2)
+			So(current[1].OperationID, ShouldEqual, 4)
+		})
+	})
+
+	Convey("Given a slow log whose rotation can't rename the file", t, func() {
+		line, _ := json.Marshal(&Query{OperationID: 1, Namespace: "foo.bar"})
+		maxSize := int64(2 * (len(line) + 1))
+		filename := filepath.Join(t.TempDir(), "slow.ndjson")
+		// a file can't be renamed over a directory
+		So(os.Mkdir(filename+".1", 0755), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(filename+".1", "in-the-way"), nil, 0644), ShouldBeNil)
+		slowLog, err := OpenSlowLog(filename, maxSize)
+		So(err, ShouldBeNil)
+		defer slowLog.Close()
+
+		Convey("Writes keep appending to the file past the max size", func() {
+			for i := int32(1); i <= 4; i++ {
+				So(slowLog.Write(&Query{OperationID: i, Namespace: "foo.bar"}), ShouldBeNil)
+			}
+			current, err := readNDJSON(filename)
+			So(err, ShouldBeNil)
+			So(current, ShouldHaveLength, 4)
+
+			Convey("And rotate once the rename works again", func() {
+				So(os.RemoveAll(filename+".1"), ShouldBeNil)
+				So(slowLog.Write(&Query{OperationID: 5, Namespace: "foo.bar"}), ShouldBeNil)
+				rotated, err := readNDJSON(filename + ".1")
+				So(err, ShouldBeNil)
+				So(rotated, ShouldHaveLength, 4)
+				current, err := readNDJSON(filename)
+				So(err, ShouldBeNil)
+				So(current, ShouldHaveLength, 1)
+				So(current[0].OperationID, ShouldEqual, 5)
+			})
+		})
+	})
+}
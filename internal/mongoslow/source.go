@@ -0,0 +1,275 @@
+package mongoslow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CurrentOpRunner returns the operations currently in progress, as reported by db.currentOp(). The mongo client and
+// the replay file both implement it, tests can supply their own.
+type CurrentOpRunner interface {
+	CurrentOp(ctx context.Context) ([]primitive.M, error)
+}
+
+// DefaultMonitorDatabase is the database currentOp is run against unless set with MonitorDatabase
+const DefaultMonitorDatabase = "admin"
+
+// mongoRunner runs currentOp against a live mongo server
+type mongoRunner struct {
+	client   *mongo.Client
+	idle     IdleOptions // idle entries to include, needs the $currentOp aggregation
+	database string      // database currentOp is run against, DefaultMonitorDatabase if empty
+}
+
+// ErrDatabaseNotSupported is returned by MonitorDatabase when the currentOp source isn't a database, e.g. a replay
+// file
+var ErrDatabaseNotSupported = errors.New("setting the database is not supported by this currentOp source")
+
+// DatabaseRunner is a currentOp source run against a configurable database, implemented by the mongo runner
+type DatabaseRunner interface {
+	SetDatabase(name string)
+}
+
+func (m *mongoRunner) SetDatabase(name string) {
+	m.database = name
+}
+
+// monitorDatabase is the database currentOp is run against
+func (m *mongoRunner) monitorDatabase() string {
+	if m.database == "" {
+		return DefaultMonitorDatabase
+	}
+	return m.database
+}
+
+// MonitorDatabase runs currentOp against the named database instead of admin, for services that don't expose admin
+func (s *MongoSlow) MonitorDatabase(name string) error {
+	if name == "" {
+		return errors.New("monitor database name must not be empty")
+	}
+	runner, ok := s.runner.(DatabaseRunner)
+	if !ok {
+		return ErrDatabaseNotSupported
+	}
+	runner.SetDatabase(name)
+	return nil
+}
+
+func (m *mongoRunner) CurrentOp(ctx context.Context) ([]primitive.M, error) {
+	if m.idle.Cursors || m.idle.Sessions {
+		return m.currentOpAggregate(ctx)
+	}
+
+	cmd := bson.D{{Key: "currentOp", Value: 1}, {Key: "$all", Value: true}}
+
+	r := m.client.Database(m.monitorDatabase()).RunCommand(ctx, cmd)
+	raw, err := r.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	runningQueries, err := decodeResponse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return inProgress(runningQueries)
+}
+
+// decodeResponse decodes a currentOp response, see decodeOperation for the command of each operation
+func decodeResponse(raw bson.Raw) (primitive.M, error) {
+	var response primitive.M
+	if err := bson.Unmarshal(raw, &response); err != nil {
+		return nil, err
+	}
+	ops, ok := response["inprog"].(primitive.A)
+	if !ok {
+		return response, nil
+	}
+	values, err := raw.Lookup("inprog").Array().Values()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			continue
+		}
+		if op, ok := ops[i].(primitive.M); ok {
+			if err := orderCommand(op, doc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return response, nil
+}
+
+// decodeOperation decodes a currentOp entry with its command as a primitive.D. Decoded as a primitive.M the command's
+// fields come back in random order, so the Command shown would change from one poll to the next and truncation could
+// cut off the command name, which mongo puts first.
+func decodeOperation(raw bson.Raw) (primitive.M, error) {
+	var op primitive.M
+	if err := bson.Unmarshal(raw, &op); err != nil {
+		return nil, err
+	}
+	if err := orderCommand(op, raw); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// orderCommand replaces the command decoded into op with one decoded from raw in the server's order
+func orderCommand(op primitive.M, raw bson.Raw) error {
+	command, ok := raw.Lookup("command").DocumentOK()
+	if !ok {
+		return nil
+	}
+	var ordered primitive.D
+	if err := bson.Unmarshal(command, &ordered); err != nil {
+		return err
+	}
+	op["command"] = ordered
+	return nil
+}
+
+// ErrNoInProgress is returned for a currentOp response without the inprog array, the poll is skipped
+var ErrNoInProgress = errors.New("currentOp response is missing the inprog array")
+
+// inProgress pulls the list of operations out of a currentOp response, skipping any entries that aren't documents
+func inProgress(response primitive.M) ([]primitive.M, error) {
+	queries, ok := response["inprog"].(primitive.A)
+	if !ok {
+		return nil, ErrNoInProgress
+	}
+	ops := make([]primitive.M, 0, len(queries))
+	for _, query := range queries {
+		if op, ok := query.(primitive.M); ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+// ReplaySource replays recorded currentOp responses, looping back to the first once all have been returned
+type ReplaySource struct {
+	mu        sync.Mutex
+	responses []primitive.M
+	next      int
+}
+
+// NewReplaySource loads recorded currentOp responses from a file. Files ending in .bson hold a sequence of BSON
+// documents, anything else is read as extended JSON, either an array of responses or one response after another.
+func NewReplaySource(filename string) (*ReplaySource, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []primitive.M
+	if filepath.Ext(filename) == ".bson" {
+		responses, err = readBSONResponses(data)
+	} else {
+		responses, err = readJSONResponses(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay file %s: %w", filename, err)
+	}
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("replay file %s has no currentOp responses", filename)
+	}
+
+	for i, response := range responses {
+		if _, ok := response["inprog"].(primitive.A); !ok {
+			return nil, fmt.Errorf("replay file %s: response %d is missing the inprog array", filename, i)
+		}
+	}
+
+	return &ReplaySource{responses: responses}, nil
+}
+
+func (r *ReplaySource) CurrentOp(ctx context.Context) ([]primitive.M, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	response := r.responses[r.next]
+	r.next = (r.next + 1) % len(r.responses)
+	return inProgress(response)
+}
+
+func readJSONResponses(data []byte) ([]primitive.M, error) {
+	var raw []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc json.RawMessage
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, doc)
+		}
+	}
+
+	responses := make([]primitive.M, 0, len(raw))
+	for _, doc := range raw {
+		var ordered bson.Raw
+		if err := bson.UnmarshalExtJSON(doc, false, &ordered); err != nil {
+			return nil, err
+		}
+		response, err := decodeResponse(ordered)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// maxBSONDocumentSize bounds each document read from a .bson replay file, a corrupt length header would otherwise
+// allocate whatever it claims. Mongo limits documents to 16MiB.
+const maxBSONDocumentSize = 16 * 1024 * 1024
+
+func readBSONResponses(data []byte) ([]primitive.M, error) {
+	var responses []primitive.M
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		header, err := r.Peek(4)
+		if err == io.EOF && len(header) == 0 {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("truncated bson document")
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if size < 5 || size > maxBSONDocumentSize {
+			return nil, fmt.Errorf("invalid bson document length %d", size)
+		}
+		doc := make([]byte, size)
+		if _, err := io.ReadFull(r, doc); err != nil {
+			return nil, errors.New("truncated bson document")
+		}
+		response, err := decodeResponse(doc)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
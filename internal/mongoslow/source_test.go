@@ -0,0 +1,219 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReplaySource(t *testing.T) {
+	Convey("Given a recorded currentOp fixture", t, func() {
+		slow, err := NewReplay("testdata/replay.json")
+		So(err, ShouldBeNil)
+
+		Convey("The first poll shows both queries as running", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+
+			rec := httptest.NewRecorder()
+			SlowQueryHandler(slow)(rec, httptest.NewRequest("GET", "/running.json", nil))
+			var running map[string]*Query
+			So(json.Unmarshal(rec.Body.Bytes(), &running), ShouldBeNil)
+			So(running, ShouldHaveLength, 2)
+			So(running["101"].Namespace, ShouldEqual, "shop.orders")
+			So(running["101"].EffectiveUser, ShouldEqual, "app-orders")
+			So(running["102"].Operation, ShouldEqual, "update")
+			So(running["101"].Command, ShouldEqual, `{"find":"orders","filter":{"status":"pending"}}`)
+
+			Convey("The second poll moves the completed slow query into the history", func() {
+				So(slow.poll(context.Background()), ShouldBeNil)
+
+				rec := httptest.NewRecorder()
+				HistoryQueryHandler(slow)(rec, httptest.NewRequest("GET", "/history.json", nil))
+				var history []*Query
+				So(json.Unmarshal(rec.Body.Bytes(), &history), ShouldBeNil)
+				So(history, ShouldHaveLength, 1)
+				So(history[0].OperationID, ShouldEqual, 102)
+
+				rec = httptest.NewRecorder()
+				RunningQueryTableHandler(slow)(rec, httptest.NewRequest("GET", "/running", nil))
+				So(rec.Body.String(), ShouldContainSubstring, "shop.orders")
+				So(rec.Body.String(), ShouldNotContainSubstring, "shop.carts")
+
+				Convey("The replay loops back to the first response", func() {
+					ops, err := slow.runner.CurrentOp(context.Background())
+					So(err, ShouldBeNil)
+					So(ops, ShouldHaveLength, 2)
+				})
+			})
+		})
+	})
+
+	Convey("Given a recorded currentOp fixture in bson", t, func() {
+		doc, err := bson.Marshal(primitive.M{"inprog": primitive.A{primitive.M{"opid": int32(1)}}})
+		So(err, ShouldBeNil)
+		filename := filepath.Join(t.TempDir(), "replay.bson")
+		So(ioutil.WriteFile(filename, append(doc, doc...), 0644), ShouldBeNil)
+
+		source, err := NewReplaySource(filename)
+		So(err, ShouldBeNil)
+		So(source.responses, ShouldHaveLength, 2)
+	})
+
+	Convey("Given a bson replay file with a corrupt length header", t, func() {
+		filename := filepath.Join(t.TempDir(), "replay.bson")
+		So(ioutil.WriteFile(filename, []byte{0xff, 0xff, 0xff, 0x7f, 0x00}, 0644), ShouldBeNil)
+
+		_, err := NewReplaySource(filename)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid bson document length")
+	})
+
+	Convey("Given a replay with relaxed extended JSON numbers and an empty effectiveUsers", t, func() {
+		filename := filepath.Join(t.TempDir(), "replay.json")
+		So(ioutil.WriteFile(filename, []byte(`{"inprog": [
+			{"opid": 1, "op": "query", "ns": "shop.orders", "microsecs_running": 2000000,
+			 "effectiveUsers": [{"user": "app-orders-1a2b", "db": "admin"}]},
+			{"opid": 2, "op": "query", "ns": "shop.carts", "microsecs_running": 2000000, "effectiveUsers": []}
+		]}`), 0644), ShouldBeNil)
+		slow, err := NewReplay(filename)
+		So(err, ShouldBeNil)
+
+		Convey("The poll parses the int32 numbers and counts the bad entry as a parse failure", func() {
+			So(slow.poll(context.Background()), ShouldBeNil)
+			So(slow.runningQueries, ShouldContainKey, int32(1))
+			So(slow.runningQueries[1].RunningMicros, ShouldEqual, 2000000)
+			So(slow.runningQueries, ShouldNotContainKey, int32(2))
+			So(slow.Stats().ParseFailures, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a replay file without any inprog array", t, func() {
+		filename := filepath.Join(t.TempDir(), "replay.json")
+		So(ioutil.WriteFile(filename, []byte(`{"ok": 1}`), 0644), ShouldBeNil)
+
+		_, err := NewReplaySource(filename)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMalformedResponse(t *testing.T) {
+	Convey("Given currentOp responses with a missing or wrong typed inprog", t, func() {
+		_, err := inProgress(primitive.M{"ok": 1.0})
+		So(err, ShouldEqual, ErrNoInProgress)
+		_, err = inProgress(primitive.M{"inprog": "none", "ok": 1.0})
+		So(err, ShouldEqual, ErrNoInProgress)
+
+		ops, err := inProgress(primitive.M{"inprog": primitive.A{op(1, 1000000, "foo.bar"), "junk"}})
+		So(err, ShouldBeNil)
+		So(ops, ShouldHaveLength, 1)
+	})
+
+	Convey("Given a source returning a response without inprog", t, func() {
+		source := &ReplaySource{responses: []primitive.M{
+			{"ok": 1.0},
+			{"inprog": primitive.A{op(1, 1000000, "foo.bar")}, "ok": 1.0},
+		}}
+		slow := NewWithRunner(source)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- slow.Run(ctx, time.Millisecond)
+		}()
+		for slow.Stats().Polls < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		Convey("The run loop survives the cycle and counts it", func() {
+			So(<-result, ShouldBeNil)
+			So(slow.Stats().MalformedResponses, ShouldBeGreaterThanOrEqualTo, 1)
+		})
+	})
+}
+
+func TestMonitorDatabase(t *testing.T) {
+	Convey("Given the mongo runner", t, func() {
+		runner := &mongoRunner{}
+		slow := NewWithRunner(runner)
+
+		Convey("currentOp is run against admin by default", func() {
+			So(runner.monitorDatabase(), ShouldEqual, DefaultMonitorDatabase)
+		})
+
+		Convey("The configured database is passed on to it", func() {
+			So(slow.MonitorDatabase("monitoring"), ShouldBeNil)
+			So(runner.monitorDatabase(), ShouldEqual, "monitoring")
+		})
+
+		Convey("An empty database name is rejected", func() {
+			So(slow.MonitorDatabase(""), ShouldNotBeNil)
+			So(runner.monitorDatabase(), ShouldEqual, DefaultMonitorDatabase)
+		})
+	})
+
+	Convey("Given a replay source", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.MonitorDatabase("monitoring"), ShouldEqual, ErrDatabaseNotSupported)
+	})
+}
+
+func TestDecodeResponse(t *testing.T) {
+	Convey("Given a currentOp response as the server sends it", t, func() {
+		raw, err := bson.Marshal(bson.D{
+			{Key: "inprog", Value: bson.A{
+				bson.D{
+					{Key: "opid", Value: int32(1)},
+					{Key: "op", Value: "query"},
+					{Key: "ns", Value: "shop.orders"},
+					{Key: "microsecs_running", Value: int64(2000000)},
+					{Key: "effectiveUsers", Value: bson.A{bson.D{{Key: "user", Value: "app"}, {Key: "db", Value: "admin"}}}},
+					{Key: "command", Value: bson.D{
+						{Key: "find", Value: "orders"},
+						{Key: "filter", Value: bson.D{{Key: "status", Value: "open"}, {Key: "amount", Value: bson.D{{Key: "$gt", Value: int32(10)}}}}},
+						{Key: "lsid", Value: bson.D{{Key: "id", Value: "session"}}},
+						{Key: "$db", Value: "shop"},
+					}},
+				},
+				"junk",
+			}},
+			{Key: "ok", Value: 1.0},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("The command keeps the server's field order on every poll", func() {
+			want := `{"find":"orders","filter":{"status":"open","amount":{"$gt":10}},"lsid":{"id":"session"},"$db":"shop"}`
+			for i := 0; i < 20; i++ {
+				response, err := decodeResponse(raw)
+				So(err, ShouldBeNil)
+				ops, err := inProgress(response)
+				So(err, ShouldBeNil)
+				So(ops, ShouldHaveLength, 1)
+				q, err := Parse(ops[0])
+				So(err, ShouldBeNil)
+				So(q.Command, ShouldEqual, want)
+			}
+		})
+	})
+
+	Convey("Given a command decoded as a map", t, func() {
+		entry := op(1, 1000000, "shop.orders")
+		entry["command"] = primitive.M{"find": "orders", "filter": primitive.M{"status": "open", "amount": primitive.M{"$gt": int32(10)}}, "$db": "shop"}
+
+		Convey("The command is marshalled with sorted keys on every poll", func() {
+			for i := 0; i < 20; i++ {
+				q, err := Parse(entry)
+				So(err, ShouldBeNil)
+				So(q.Command, ShouldEqual, `{"$db":"shop","filter":{"amount":{"$gt":10},"status":"open"},"find":"orders"}`)
+			}
+		})
+	})
+}
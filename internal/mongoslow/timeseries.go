@@ -0,0 +1,91 @@
+package mongoslow
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultTimeseriesBucket is the bucket width of the history timeseries unless set with ?bucket=
+const DefaultTimeseriesBucket = time.Minute
+
+// minTimeseriesBucket and maxTimeseriesBuckets stop a tiny bucket producing millions of empty buckets, only the most
+// recent buckets are returned
+const (
+	minTimeseriesBucket  = time.Second
+	maxTimeseriesBuckets = 10000
+)
+
+// TimeseriesBucket is the slow queries that started within one bucket of the history timeseries
+type TimeseriesBucket struct {
+	Time      time.Time `json:"t"`          // start of the bucket
+	Count     int       `json:"count"`      // slow queries started in the bucket
+	TotalSecs float64   `json:"total_secs"` // total running time of those queries
+}
+
+// timeseries buckets the queries by their start time, oldest first, with empty buckets filled in so the series is
+// evenly spaced. Queries older than maxTimeseriesBuckets before the newest are left out.
+func timeseries(queries []*Query, bucket time.Duration) []*TimeseriesBucket {
+	if len(queries) == 0 {
+		return []*TimeseriesBucket{}
+	}
+
+	first, last := queries[0].StartTime.Truncate(bucket), queries[0].StartTime.Truncate(bucket)
+	for _, q := range queries {
+		t := q.StartTime.Truncate(bucket)
+		if t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+
+	if last.Sub(first)/bucket >= maxTimeseriesBuckets {
+		first = last.Add(-(maxTimeseriesBuckets - 1) * bucket)
+	}
+
+	buckets := make([]*TimeseriesBucket, last.Sub(first)/bucket+1)
+	for i := range buckets {
+		buckets[i] = &TimeseriesBucket{Time: first.Add(time.Duration(i) * bucket)}
+	}
+	for _, q := range queries {
+		t := q.StartTime.Truncate(bucket)
+		if t.Before(first) {
+			continue
+		}
+		b := buckets[t.Sub(first)/bucket]
+		b.Count++
+		b.TotalSecs += float64(q.RunningMicros) / 1000000
+	}
+	return buckets
+}
+
+// HistoryTimeseriesHandler will output the number of slow queries in the history per ?bucket= (default 1m) of their
+// start time, for trend graphs without prometheus
+func HistoryTimeseriesHandler(slow *MongoSlow) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if initializing(w, r, slow) {
+			return
+		}
+		bucket := DefaultTimeseriesBucket
+		if param := r.URL.Query().Get("bucket"); param != "" {
+			var err error
+			bucket, err = time.ParseDuration(param)
+			if err != nil || bucket < minTimeseriesBucket {
+				http.Error(w, "bucket must be a duration of at least 1s, e.g. 1m", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var queries []*Query
+		slow.mu.RLock()
+		slow.history.Do(func(p interface{}) {
+			if p != nil {
+				queries = append(queries, p.(*Query))
+			}
+		})
+		slow.mu.RUnlock()
+
+		writeJSON(w, r, http.StatusOK, timeseries(queries, bucket))
+	}
+}
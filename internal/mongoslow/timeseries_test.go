@@ -0,0 +1,95 @@
+package mongoslow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestHistoryTimeseries(t *testing.T) {
+	Convey("Given slow queries in the history with seeded start times", t, func() {
+		base := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		for _, q := range []*Query{
+			{OperationID: 1, RunningMicros: 6000000, StartTime: base.Add(5 * time.Second)},
+			{OperationID: 2, RunningMicros: 10000000, StartTime: base.Add(50 * time.Second)},
+			{OperationID: 3, RunningMicros: 7500000, StartTime: base.Add(3*time.Minute + 10*time.Second)},
+		} {
+			slow.History(q)
+		}
+
+		get := func(url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			HistoryTimeseriesHandler(slow)(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		Convey("The queries are counted per minute with the gaps filled in", func() {
+			rec := get("/history/timeseries.json")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("content-type"), ShouldEqual, "application/json")
+
+			var series []TimeseriesBucket
+			So(json.Unmarshal(rec.Body.Bytes(), &series), ShouldBeNil)
+			So(series, ShouldHaveLength, 4)
+			So(series[0].Time, ShouldEqual, base)
+			So(series[0].Count, ShouldEqual, 2)
+			So(series[0].TotalSecs, ShouldEqual, 16)
+			So(series[1].Count, ShouldEqual, 0)
+			So(series[2].Count, ShouldEqual, 0)
+			So(series[3].Time, ShouldEqual, base.Add(3*time.Minute))
+			So(series[3].Count, ShouldEqual, 1)
+			So(series[3].TotalSecs, ShouldEqual, 7.5)
+		})
+
+		Convey("The bucket width can be set", func() {
+			var series []TimeseriesBucket
+			So(json.Unmarshal(get("/history/timeseries.json?bucket=30s").Body.Bytes(), &series), ShouldBeNil)
+			So(series, ShouldHaveLength, 7)
+			So(series[0].Count, ShouldEqual, 1)
+			So(series[1].Count, ShouldEqual, 1)
+			So(series[6].Count, ShouldEqual, 1)
+		})
+
+		Convey("An invalid or too small bucket is rejected", func() {
+			So(get("/history/timeseries.json?bucket=soon").Code, ShouldEqual, http.StatusBadRequest)
+			So(get("/history/timeseries.json?bucket=1ms").Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+
+	Convey("Given an empty history", t, func() {
+		slow := NewWithRunner(&fakeRunner{})
+		So(slow.poll(context.Background()), ShouldBeNil)
+		rec := httptest.NewRecorder()
+		HistoryTimeseriesHandler(slow)(rec, httptest.NewRequest("GET", "/history/timeseries.json", nil))
+		So(rec.Body.String(), ShouldEqual, "[]\n")
+	})
+}
+
+func TestStartTime(t *testing.T) {
+	Convey("Given a currentOp entry with a currentOpTime", t, func() {
+		entry := op(1, 1000000, "foo.bar")
+		entry["currentOpTime"] = "2021-06-01T08:00:05.250-04:00"
+		q, err := Parse(entry)
+		So(err, ShouldBeNil)
+		So(q.StartTime, ShouldEqual, time.Date(2021, 6, 1, 12, 0, 5, 250000000, time.UTC))
+	})
+
+	Convey("Given a currentOp entry without one", t, func() {
+		slow := NewWithRunner(&fakeRunner{polls: [][]primitive.M{{op(1, 60000000, "foo.bar")}}})
+		before := time.Now()
+		So(slow.poll(context.Background()), ShouldBeNil)
+
+		Convey("It is estimated from the running time", func() {
+			started := slow.runningQueries[1].StartTime
+			So(started, ShouldHappenWithin, time.Second, before.Add(-time.Minute))
+		})
+	})
+}
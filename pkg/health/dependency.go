@@ -1,6 +1,10 @@
 package health
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 // Depender defines the interface for all concrete dependency implementations.
 type Depender interface {
@@ -12,7 +16,17 @@ type Dependency struct {
 	Name string   `json:"-"`
 	Desc string   `json:"desc"`
 	Item Depender `json:"item"`
-	key  string   // Unique, as lowercase Name.
+
+	// MaxBackoff opts in to backing off a failing dependency, doubling its check interval for each consecutive
+	// failure up to MaxBackoff, and going back to CheckInterval once it passes again.
+	MaxBackoff time.Duration `json:"-"`
+
+	key      string // Unique, as lowercase Name.
+	mu       sync.Mutex
+	failures int  // Consecutive failed checks.
+	skip     int  // Check cycles left to skip while backing off.
+	checked  bool // Completed a check, ready holds its result.
+	ready    bool
 }
 
 func (d *Dependency) String() string {
@@ -21,3 +35,64 @@ func (d *Dependency) String() string {
 		d, d.Name, d.Desc, d.Item,
 	)
 }
+
+// checkInterval returns the effective interval between checks of the dependency, base while it isn't backing off.
+func (d *Dependency) checkInterval(base time.Duration) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.interval(base)
+}
+
+func (d *Dependency) interval(base time.Duration) time.Duration {
+	interval := base
+	if d.MaxBackoff <= base {
+		return interval
+	}
+	for i := 0; i < d.failures && interval < d.MaxBackoff; i++ {
+		interval *= 2
+	}
+	if interval > d.MaxBackoff {
+		interval = d.MaxBackoff
+	}
+	return interval
+}
+
+// backoff records a check result, skipping check cycles of length base while the dependency keeps failing.
+func (d *Dependency) backoff(base time.Duration, healthy bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.MaxBackoff <= base {
+		return
+	}
+	if healthy {
+		d.failures = 0
+	} else {
+		d.failures++
+	}
+	d.skip = int(d.interval(base)/base) - 1
+}
+
+// due reports whether the dependency should be checked this cycle, counting down the cycles skipped by backing off.
+func (d *Dependency) due() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.skip > 0 {
+		d.skip--
+		return false
+	}
+	return true
+}
+
+// transition records whether the dependency passed its check, reporting whether that changed its state. The first
+// check always counts as a change.
+func (d *Dependency) transition(ready bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := !d.checked || d.ready != ready
+	d.checked = true
+	d.ready = ready
+	return changed
+}
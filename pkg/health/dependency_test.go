@@ -0,0 +1,62 @@
+package health
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dueCycles counts the check cycles until the dependency is next checked
+func dueCycles(d *Dependency) int {
+	cycles := 1
+	for !d.due() {
+		cycles++
+	}
+	return cycles
+}
+
+func TestDependencyBackoff(t *testing.T) {
+	base := 15 * time.Second
+
+	Convey("Given a dependency backing off up to 4 check intervals", t, func() {
+		d := &Dependency{Name: "mongo", Item: healthyDep{}, MaxBackoff: 4 * base}
+
+		Convey("It is checked every interval while healthy", func() {
+			d.backoff(base, true)
+			So(d.checkInterval(base), ShouldEqual, base)
+			So(dueCycles(d), ShouldEqual, 1)
+		})
+
+		Convey("The interval doubles with each failure up to the max", func() {
+			d.backoff(base, false)
+			So(d.checkInterval(base), ShouldEqual, 2*base)
+			So(dueCycles(d), ShouldEqual, 2)
+
+			d.backoff(base, false)
+			So(d.checkInterval(base), ShouldEqual, 4*base)
+			So(dueCycles(d), ShouldEqual, 4)
+
+			d.backoff(base, false)
+			So(d.checkInterval(base), ShouldEqual, 4*base)
+			So(dueCycles(d), ShouldEqual, 4)
+
+			Convey("And resets after a success", func() {
+				d.backoff(base, true)
+				So(d.checkInterval(base), ShouldEqual, base)
+				So(dueCycles(d), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given a dependency without backoff", t, func() {
+		d := &Dependency{Name: "mongo", Item: healthyDep{}}
+
+		Convey("It is checked every interval even while failing", func() {
+			d.backoff(base, false)
+			d.backoff(base, false)
+			So(d.checkInterval(base), ShouldEqual, base)
+			So(dueCycles(d), ShouldEqual, 1)
+		})
+	})
+}
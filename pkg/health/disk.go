@@ -0,0 +1,48 @@
+package health
+
+import (
+	"fmt"
+)
+
+// diskUsage is the space of the filesystem holding a path, in bytes
+type diskUsage struct {
+	Free  uint64 // available to unprivileged users
+	Total uint64
+}
+
+// statfs reads the disk usage of the filesystem holding path, replaced in tests
+var statfs = statfsPath
+
+// DiskSpaceCheck is a Depender checking the free space of the filesystem a file is written to.
+type DiskSpaceCheck struct {
+	Path         string
+	MinFreeBytes uint64
+}
+
+// NewDiskSpaceDependency creates a dependency checking the filesystem holding path, e.g. the directory of the slow
+// log, has at least minFreeBytes free, reporting the free and used bytes in its state.
+func NewDiskSpaceDependency(name, path string, minFreeBytes uint64) *Dependency {
+	return &Dependency{
+		Name: name,
+		Desc: "free disk space",
+		Item: &DiskSpaceCheck{Path: path, MinFreeBytes: minFreeBytes},
+	}
+}
+
+// Check stats the filesystem, unhealthy when it can't be read or has less than MinFreeBytes free.
+func (c *DiskSpaceCheck) Check() (map[string]interface{}, error) {
+	state := map[string]interface{}{
+		"path":           c.Path,
+		"min_free_bytes": c.MinFreeBytes,
+	}
+	usage, err := statfs(c.Path)
+	if err != nil {
+		return state, err
+	}
+	state["free_bytes"] = usage.Free
+	state["used_bytes"] = usage.Total - usage.Free
+	if usage.Free < c.MinFreeBytes {
+		return state, fmt.Errorf("%s has %d bytes free, below the minimum of %d", c.Path, usage.Free, c.MinFreeBytes)
+	}
+	return state, nil
+}
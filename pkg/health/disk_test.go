@@ -0,0 +1,54 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiskSpaceDependency(t *testing.T) {
+	Convey("Given a temp dir", t, func() {
+		dir := t.TempDir()
+
+		Convey("The real filesystem is read", func() {
+			state, err := NewDiskSpaceDependency("slowlog", dir, 1).Item.Check()
+			So(err, ShouldBeNil)
+			So(state["free_bytes"], ShouldBeGreaterThan, 0)
+			So(state, ShouldContainKey, "used_bytes")
+		})
+
+		Convey("With a stubbed filesystem", func() {
+			defer func(f func(string) (diskUsage, error)) { statfs = f }(statfs)
+			var statted string
+			statfs = func(path string) (diskUsage, error) {
+				statted = path
+				return diskUsage{Free: 400, Total: 1000}, nil
+			}
+
+			Convey("It is healthy at or above the threshold", func() {
+				state, err := NewDiskSpaceDependency("slowlog", dir, 400).Item.Check()
+				So(err, ShouldBeNil)
+				So(statted, ShouldEqual, dir)
+				So(state, ShouldResemble, map[string]interface{}{
+					"path":           dir,
+					"min_free_bytes": uint64(400),
+					"free_bytes":     uint64(400),
+					"used_bytes":     uint64(600),
+				})
+			})
+
+			Convey("It is unhealthy below the threshold", func() {
+				state, err := NewDiskSpaceDependency("slowlog", dir, 401).Item.Check()
+				So(err, ShouldNotBeNil)
+				So(state["free_bytes"], ShouldEqual, uint64(400))
+			})
+
+			Convey("It is unhealthy when the filesystem can't be read", func() {
+				statfs = func(string) (diskUsage, error) { return diskUsage{}, errors.New("no such file or directory") }
+				_, err := NewDiskSpaceDependency("slowlog", dir, 1).Item.Check()
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
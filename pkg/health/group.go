@@ -0,0 +1,77 @@
+package health
+
+import (
+	"fmt"
+	"sync"
+)
+
+// GroupCheck is a Depender made up of member Dependers, healthy when enough of the members are.
+type GroupCheck struct {
+	Quorum  int `json:"quorum"` // Members that must pass, all of them if zero.
+	members []Depender
+}
+
+// NewGroupDependency creates a dependency that is healthy only when all of members are, e.g. a primary and its
+// read replicas.
+func NewGroupDependency(name string, members ...Depender) *Dependency {
+	return NewQuorumDependency(name, 0, members...)
+}
+
+// NewQuorumDependency creates a dependency that is healthy when at least quorum of members are, all of them if
+// quorum is zero.
+func NewQuorumDependency(name string, quorum int, members ...Depender) *Dependency {
+	return &Dependency{
+		Name: name,
+		Desc: fmt.Sprintf("group of %d", len(members)),
+		Item: &GroupCheck{Quorum: quorum, members: members},
+	}
+}
+
+// Check checks the members concurrently, reporting each member's result under members in the state.
+func (g *GroupCheck) Check() (map[string]interface{}, error) {
+	results := make([]map[string]interface{}, len(g.members))
+	errs := make([]error, len(g.members))
+
+	var wg sync.WaitGroup
+	for i, member := range g.members {
+		wg.Add(1)
+		go func(i int, member Depender) {
+			defer wg.Done()
+			state, err := member.Check()
+			result := map[string]interface{}{"ready": err == nil}
+			if state != nil {
+				result["state"] = state
+			}
+			if err != nil {
+				result["error"] = err.Error()
+			}
+			results[i] = result
+			errs[i] = err
+		}(i, member)
+	}
+	wg.Wait()
+
+	passed := 0
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			passed++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	quorum := g.Quorum
+	if quorum <= 0 || quorum > len(g.members) {
+		quorum = len(g.members)
+	}
+	state := map[string]interface{}{
+		"members": results,
+		"passed":  passed,
+		"quorum":  quorum,
+	}
+	if passed < quorum {
+		return state, fmt.Errorf("%d of %d members healthy, need %d: %v", passed, len(g.members), quorum, firstErr)
+	}
+	return state, nil
+}
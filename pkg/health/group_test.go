@@ -0,0 +1,48 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failingDep is a dependency that always fails its check
+type failingDep struct {
+	err error
+}
+
+func (f failingDep) Check() (map[string]interface{}, error) {
+	return nil, f.err
+}
+
+func TestGroupDependency(t *testing.T) {
+	errDown := errors.New("connection refused")
+	members := []Depender{healthyDep{}, failingDep{errDown}, healthyDep{}}
+
+	Convey("Given a group where one of three members fails", t, func() {
+		Convey("It is unhealthy when all members must pass", func() {
+			state, err := NewGroupDependency("replicas", members...).Item.Check()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "2 of 3 members healthy, need 3: connection refused")
+			So(state["passed"], ShouldEqual, 2)
+			So(state["members"], ShouldResemble, []map[string]interface{}{
+				{"ready": true},
+				{"ready": false, "error": "connection refused"},
+				{"ready": true},
+			})
+		})
+
+		Convey("It is healthy with a quorum of two", func() {
+			state, err := NewQuorumDependency("replicas", 2, members...).Item.Check()
+			So(err, ShouldBeNil)
+			So(state["quorum"], ShouldEqual, 2)
+		})
+
+		Convey("It is unhealthy when a second member fails the quorum", func() {
+			members := []Depender{healthyDep{}, failingDep{errDown}, failingDep{errDown}}
+			_, err := NewQuorumDependency("replicas", 2, members...).Item.Check()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
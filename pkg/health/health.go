@@ -6,19 +6,32 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	// Dependencies holds all registered concrete dependencies.
+	// Dependencies holds all registered concrete dependencies, use RegisterDependencies rather than writing to it.
 	Dependencies = map[string]*Dependency{}
+
+	// dependenciesMu guards Dependencies.
+	dependenciesMu sync.RWMutex
 )
 
-// RegisterDependencies registers one or more Dependencies. When setting up metrics please also use duration_seconds not duration_ms
+// RegisterDependencies registers one or more Dependencies, it is safe to call concurrently. When setting up metrics please also use duration_seconds not duration_ms
+//
+// Late registration, after Serve, is allowed: the dependency is unhealthy by default until it is checked on the next
+// check interval.
 func RegisterDependencies(dependencies ...*Dependency) {
+	dependenciesMu.Lock()
+	defer dependenciesMu.Unlock()
+
+	_, started := Health.Status.Load("started")
+
 	for _, dependency := range dependencies {
 		logger := log.With().Interface("dependency", dependency).Logger()
 
@@ -46,9 +59,28 @@ func RegisterDependencies(dependencies ...*Dependency) {
 		}
 
 		Dependencies[dependency.key] = dependency
+
+		if started {
+			setDep(depCheck{
+				dependency: dependency,
+				err:        errUnhealthyDefault,
+			})
+		}
 	}
 }
 
+// registeredDependencies returns a snapshot of the registered dependencies.
+func registeredDependencies() []*Dependency {
+	dependenciesMu.RLock()
+	defer dependenciesMu.RUnlock()
+
+	dependencies := make([]*Dependency, 0, len(Dependencies))
+	for _, dependency := range Dependencies {
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies
+}
+
 var (
 	// Served indicates whether health has been served.
 	Served bool
@@ -56,7 +88,7 @@ var (
 
 // Serve sets up and serves, forking checker.
 func Serve() {
-	if len(Dependencies) == 0 {
+	if len(registeredDependencies()) == 0 {
 		log.Warn().Msg("no health dependencies detected, use health.Register")
 	}
 
@@ -65,12 +97,18 @@ func Serve() {
 	Served = true
 }
 
+// SchemaVersion is the version of the health response shape, bump it whenever a field is renamed, removed or changes
+// type so consumers can detect the breaking change.
+const SchemaVersion = 1
+
 var (
 	// Config holds the health configuration.
 	Config = &struct {
 		StatusUnhealthy int           `json:"status_unhealthy"`  // Status code for an unhealthy state (at least one dependency with error).
 		CheckInterval   time.Duration `json:"check_interval"`    // How often dependencies must be checked.
 		CheckMaxTimeout time.Duration `json:"check_max_timeout"` // Maximum timeout for each dependency check.
+		StartupGrace    time.Duration `json:"startup_grace"`     // How long after starting dependencies not yet checked don't fail readiness.
+		FailUnhealthy   bool          `json:"fail_unhealthy"`    // Answer with StatusUnhealthy instead of 200 when unhealthy, the state is reported either way.
 
 		LogChecks               bool          `json:"log_checks"`                // Log check infos.
 		MinimumCheckInterval    time.Duration `json:"min_check_interval"`        // Minimum duration to wait between health checks.
@@ -86,10 +124,18 @@ var (
 
 	// Health holds the status of all checked dependencies.
 	Health = struct {
-		Version      map[string]string `json:"version"`      // Map for version/build info.
-		Dependencies *SyncMap          `json:"dependencies"` // Map for all dependencies.
-		Status       *SyncMap          `json:"status"`       // Map for single health state.
+		SchemaVersion int               `json:"schema_version"`          // Shape of this response, see SchemaVersion.
+		Version       map[string]string `json:"version"`                 // Map for version/build info.
+		Dependencies  *SyncMap          `json:"dependencies"`            // Map for all dependencies.
+		Status        *SyncMap          `json:"status"`                  // Map for single health state.
+		RecentErrors  *recentLines      `json:"recent_errors,omitempty"` // Recent error log lines, see IncludeRecentErrors.
 	}{
+		SchemaVersion: SchemaVersion,
+		Version: map[string]string{
+			"version":  options.Version,
+			"git_hash": options.GitHash,
+			"build":    options.Build,
+		},
 		Dependencies: NewSyncMap(),
 		Status:       NewSyncMap(),
 	}
@@ -110,6 +156,60 @@ var (
 	errMsgCheckTimeout  = "Health dependency check has timed out after %v"
 )
 
+var (
+	// stateChangeFuncs are called when a dependency's state changes, see OnStateChange.
+	stateChangeFuncs   []func(dep string, healthy bool, err error)
+	stateChangeFuncsMu sync.RWMutex
+)
+
+// OnStateChange registers f to be called with the dependency Name and check error when a dependency completes its
+// first check, and after that only when it flips between healthy and unhealthy. f is called from the checker so
+// should return quickly, e.g. fire a webhook in its own goroutine.
+func OnStateChange(f func(dep string, healthy bool, err error)) {
+	stateChangeFuncsMu.Lock()
+	defer stateChangeFuncsMu.Unlock()
+	stateChangeFuncs = append(stateChangeFuncs, f)
+}
+
+// notifyStateChange calls the OnStateChange funcs.
+func notifyStateChange(dep string, healthy bool, err error) {
+	stateChangeFuncsMu.RLock()
+	defer stateChangeFuncsMu.RUnlock()
+	for _, f := range stateChangeFuncs {
+		f(dep, healthy, err)
+	}
+}
+
+// recentLines marshals as the lines returned by its source at the time of the health request.
+type recentLines struct {
+	source func() []string
+}
+
+// MarshalJSON generates json from the current lines.
+func (l *recentLines) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.source())
+}
+
+// IncludeRecentErrors embeds the lines returned by source, e.g. the last few error log lines, under recent_errors
+// in the health response. Off by default so log content isn't exposed, a nil source turns it off again.
+// Call it before Serve.
+func IncludeRecentErrors(source func() []string) {
+	if source == nil {
+		Health.RecentErrors = nil
+		return
+	}
+	Health.RecentErrors = &recentLines{source: source}
+}
+
+// ResetStats zeroes the health statistics, so the counters only cover the time since the reset.
+func ResetStats() {
+	atomic.StoreUint64(&Stats.Total, 0)
+	atomic.StoreUint64(&Stats.Fails, 0)
+	atomic.StoreUint64(&Stats.TotalRequests, 0)
+	atomic.StoreUint64(&Stats.TotalChecks, 0)
+	atomic.StoreInt64(&Stats.CheckDurationMS, 0)
+}
+
 type depCheck struct {
 	dependency *Dependency
 	duration   time.Duration
@@ -126,18 +226,7 @@ func StartChecker() {
 			Msg("Invalid interval - too short")
 	}
 
-	// Initialize all as unhealthy.
-	for _, dependency := range Dependencies {
-		setDep(depCheck{
-			dependency: dependency,
-			err:        errUnhealthyDefault,
-		})
-	}
-
-	// Started must be set AFTER initialization above,
-	// used for overall healthy status in WebHandler.
-	started := time.Now()
-	Health.Status.Store("started", started)
+	started := initDependencies()
 
 	timeout := Config.CheckInterval - Config.CheckIntervalSubtrahend
 	if timeout > Config.CheckMaxTimeout {
@@ -150,54 +239,83 @@ func StartChecker() {
 	for {
 		atomic.AddUint64(&Stats.TotalChecks, 1)
 
-		for _, dependency := range Dependencies {
-			go func(dependency *Dependency) {
-				chChecked := make(chan time.Duration, 1) // buffer=1 to avoid goroutine leak
-
-				go func(dependency *Dependency) {
-					dependencyStart := time.Now()
-					state, err := dependency.Item.Check()
-					elapsedDuration := time.Since(dependencyStart)
-					setDep(depCheck{
-						dependency: dependency,
-						duration:   elapsedDuration,
-						state:      state,
-						err:        err,
-					})
-					chChecked <- elapsedDuration
-				}(dependency)
-
-				// Watch timeout.
-				select {
-				case elapsedDuration := <-chChecked:
-					if Config.LogChecks {
-						log.Info().Interface("dependency", dependency).
-							Dur("duration", elapsedDuration).
-							Msg("health dependency check completed")
-					}
-				case <-time.After(timeout):
-					emsg := fmt.Sprintf(errMsgCheckTimeout, timeout)
-					log.Warn().Interface("dependency", dependency).
-						Dur("timeout", timeout).Msg(emsg)
-					setDep(depCheck{
-						dependency: dependency,
-						duration:   timeout,
-						err:        errors.New(emsg),
-					})
-				}
-			}(dependency)
-		}
+		checkDependencies(timeout)
 
 		last := time.Now()
 		Health.Status.Store("last", last)
 
-		Stats.CheckDurationMS = ElapsedMillis(started, last)
+		atomic.StoreInt64(&Stats.CheckDurationMS, ElapsedMillis(started, last))
 		Health.Status.Store("duration_seconds", last.Sub(started).Seconds())
 
 		time.Sleep(Config.CheckInterval)
 	}
 }
 
+// initDependencies marks all dependencies unhealthy by default and sets started, holding the lock so a concurrent
+// registration is either initialized here or by RegisterDependencies.
+func initDependencies() time.Time {
+	dependenciesMu.Lock()
+	defer dependenciesMu.Unlock()
+
+	// Initialize all as unhealthy.
+	for _, dependency := range Dependencies {
+		setDep(depCheck{
+			dependency: dependency,
+			err:        errUnhealthyDefault,
+		})
+	}
+
+	// Started must be set AFTER initialization above,
+	// used for overall healthy status in WebHandler.
+	started := time.Now()
+	Health.Status.Store("started", started)
+	return started
+}
+
+// checkDependencies checks each registered dependency in the background, failing those that take longer than timeout.
+func checkDependencies(timeout time.Duration) {
+	for _, dependency := range registeredDependencies() {
+		if !dependency.due() {
+			continue
+		}
+		go func(dependency *Dependency) {
+			chChecked := make(chan time.Duration, 1) // buffer=1 to avoid goroutine leak
+
+			go func(dependency *Dependency) {
+				dependencyStart := time.Now()
+				state, err := dependency.Item.Check()
+				elapsedDuration := time.Since(dependencyStart)
+				setDep(depCheck{
+					dependency: dependency,
+					duration:   elapsedDuration,
+					state:      state,
+					err:        err,
+				})
+				chChecked <- elapsedDuration
+			}(dependency)
+
+			// Watch timeout.
+			select {
+			case elapsedDuration := <-chChecked:
+				if Config.LogChecks {
+					log.Info().Interface("dependency", dependency).
+						Dur("duration", elapsedDuration).
+						Msg("health dependency check completed")
+				}
+			case <-time.After(timeout):
+				emsg := fmt.Sprintf(errMsgCheckTimeout, timeout)
+				log.Warn().Interface("dependency", dependency).
+					Dur("timeout", timeout).Msg(emsg)
+				setDep(depCheck{
+					dependency: dependency,
+					duration:   timeout,
+					err:        errors.New(emsg),
+				})
+			}
+		}(dependency)
+	}
+}
+
 func setDep(dc depCheck) {
 
 	dv := map[string]interface{}{
@@ -211,6 +329,11 @@ func setDep(dc depCheck) {
 
 	ready := dc.err == nil
 	dv["ready"] = ready
+
+	if dc.err != errUnhealthyDefault && dc.dependency.MaxBackoff > 0 {
+		dc.dependency.backoff(Config.CheckInterval, ready)
+		dv["check_interval_seconds"] = dc.dependency.checkInterval(Config.CheckInterval).Seconds()
+	}
 	atomic.AddUint64(&Stats.Total, 1)
 
 	if !ready {
@@ -219,10 +342,16 @@ func setDep(dc depCheck) {
 
 		if dc.err != errUnhealthyDefault {
 			log.Error().Interface("dependency", dv).Msg("unhealthy dependency")
+		} else {
+			dv["starting"] = true
 		}
 	}
 
 	Health.Dependencies.Store(dc.dependency.key, dv)
+
+	if dc.err != errUnhealthyDefault && dc.dependency.transition(ready) {
+		notifyStateChange(dc.dependency.Name, ready, dc.err)
+	}
 }
 
 const (
@@ -231,6 +360,8 @@ const (
 
 	stateHealthy   = "healthy"
 	stateUnhealthy = "unhealthy"
+	stateStarting  = "starting"
+	stateStarted   = "started"
 
 	errMsgUnhealthy     = "Unhealthy"
 	errMsgFailedMarshal = "Failed to marshal Health"
@@ -269,6 +400,25 @@ var (
 	errCheckerNotStarted = errors.New("checker NOT yet started")
 )
 
+// inStartupGrace reports whether the checker started less than StartupGrace ago.
+func inStartupGrace() bool {
+	started, ok := Health.Status.Load("started")
+	if !ok {
+		return false
+	}
+	return time.Since(started.(time.Time)) < Config.StartupGrace
+}
+
+// pendingDependencies reports whether any dependency hasn't completed its first check yet.
+func pendingDependencies() bool {
+	pending := false
+	Health.Dependencies.Range(func(_, d interface{}) bool {
+		_, pending = d.(map[string]interface{})["starting"]
+		return !pending
+	})
+	return pending
+}
+
 // WebHandler provides web handler.
 func WebHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -282,18 +432,28 @@ func WebHandler() http.Handler {
 			return
 		}
 
-		// Unhealthy if any dependency contains error.
+		// Unhealthy if any dependency contains error, except those not yet checked during the startup grace.
 		healthy := true
+		grace := inStartupGrace()
+		starting := false
 
 		Health.Dependencies.Range(func(_, d interface{}) bool {
 			hdep := d.(map[string]interface{})
 
+			if _, found := hdep["starting"]; found && grace {
+				starting = true
+				return true
+			}
+
 			if _, found := hdep["error"]; found {
 				// Even if unhealthy, do NOT fail and return, but instead
 				// let it generate the usual json contents BUT with unhealthy header.
 				log.Info().Interface("dependency", hdep).
 					Msg("unhealthy dependencies (breaking on first)")
-				setStatus(Config.StatusUnhealthy)
+				status := setStatus(Config.StatusUnhealthy)
+				if Config.FailUnhealthy {
+					headerStatusCode = status
+				}
 				healthy = false
 				return false
 			}
@@ -303,6 +463,9 @@ func WebHandler() http.Handler {
 
 		if healthy {
 			headerStatusCode = setStatus(StatusHealthy)
+			if starting {
+				Health.Status.Store("state", stateStarting)
+			}
 		}
 
 		healthInfo, err := json.Marshal(Health)
@@ -326,3 +489,35 @@ func WebHandler() http.Handler {
 		}
 	})
 }
+
+// ResetStatsHandler provides a web handler calling ResetStats on POST.
+func ResetStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ResetStats()
+		log.Info().Msg("health stats reset")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// StartupHandler provides a startup probe web handler, healthy once the checker has started. The state is starting
+// while dependencies are still waiting for their first check, and started after.
+func StartupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, found := Health.Status.Load("started"); !found {
+			w.WriteHeader(Config.StatusUnhealthy)
+			return
+		}
+
+		state := stateStarted
+		if pendingDependencies() {
+			state = stateStarting
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"state": state})
+	})
+}
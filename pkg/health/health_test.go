@@ -0,0 +1,278 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// serveHealth runs a request through WebHandler and decodes the health response
+func serveHealth() (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	WebHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec.Code, body
+}
+
+func TestRecentErrors(t *testing.T) {
+	Convey("Given a started health checker", t, func() {
+		Health.Status.Store("started", time.Now())
+		defer Health.Status.Delete("started")
+
+		Convey("Recent errors are left out by default", func() {
+			code, body := serveHealth()
+			So(code, ShouldEqual, http.StatusOK)
+			So(body, ShouldNotContainKey, "recent_errors")
+		})
+
+		Convey("Recent error lines are included when enabled", func() {
+			IncludeRecentErrors(func() []string {
+				return []string{`{"level":"error","message":"unhealthy dependency"}`}
+			})
+			defer IncludeRecentErrors(nil)
+
+			_, body := serveHealth()
+			So(body["recent_errors"], ShouldResemble, []interface{}{`{"level":"error","message":"unhealthy dependency"}`})
+		})
+	})
+}
+
+func TestSchemaVersion(t *testing.T) {
+	Convey("Given a started health checker", t, func() {
+		Health.Status.Store("started", time.Now())
+		defer Health.Status.Delete("started")
+
+		_, body := serveHealth()
+
+		Convey("The response carries the schema version and build variables", func() {
+			So(body["schema_version"], ShouldEqual, SchemaVersion)
+			So(body["version"], ShouldResemble, map[string]interface{}{
+				"version":  options.Version,
+				"git_hash": options.GitHash,
+				"build":    options.Build,
+			})
+		})
+	})
+}
+
+func TestResetStats(t *testing.T) {
+	Convey("Given health stats counted while they are being reset", t, func() {
+		Health.Status.Store("started", time.Now())
+		defer Health.Status.Delete("started")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					atomic.AddUint64(&Stats.Total, 1)
+					atomic.AddUint64(&Stats.Fails, 1)
+					atomic.AddUint64(&Stats.TotalChecks, 1)
+					serveHealth()
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					ResetStats()
+				}
+			}()
+		}
+		wg.Wait()
+
+		Convey("A POST to the reset handler zeroes the counters", func() {
+			rec := httptest.NewRecorder()
+			ResetStatsHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/health/reset-stats", nil))
+			So(rec.Code, ShouldEqual, http.StatusNoContent)
+
+			So(atomic.LoadUint64(&Stats.Total), ShouldEqual, 0)
+			So(atomic.LoadUint64(&Stats.Fails), ShouldEqual, 0)
+			So(atomic.LoadUint64(&Stats.TotalRequests), ShouldEqual, 0)
+			So(atomic.LoadUint64(&Stats.TotalChecks), ShouldEqual, 0)
+			So(atomic.LoadInt64(&Stats.CheckDurationMS), ShouldEqual, 0)
+		})
+
+		Convey("Other methods are rejected", func() {
+			rec := httptest.NewRecorder()
+			ResetStatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/health/reset-stats", nil))
+			So(rec.Code, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+	})
+}
+
+// healthyDep is a dependency that always passes its check
+type healthyDep struct{}
+
+func (healthyDep) Check() (map[string]interface{}, error) {
+	return nil, nil
+}
+
+// resetDependencies removes all registered dependencies and their check results
+func resetDependencies() {
+	dependenciesMu.Lock()
+	Dependencies = map[string]*Dependency{}
+	dependenciesMu.Unlock()
+	Health.Dependencies.Range(func(key, _ interface{}) bool {
+		Health.Dependencies.Delete(key)
+		return true
+	})
+	Health.Status.Delete("started")
+}
+
+func TestRegisterWhileChecking(t *testing.T) {
+	Convey("Given dependencies registered while the checker is running", t, func() {
+		defer resetDependencies()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				RegisterDependencies(&Dependency{Name: fmt.Sprintf("dep-%d", i), Item: healthyDep{}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			initDependencies()
+			for i := 0; i < 50; i++ {
+				checkDependencies(time.Second)
+			}
+		}()
+		wg.Wait()
+
+		Convey("Every dependency is registered and has a health entry", func() {
+			So(registeredDependencies(), ShouldHaveLength, 50)
+			for i := 0; i < 50; i++ {
+				_, found := Health.Dependencies.Load(fmt.Sprintf("dep-%d", i))
+				So(found, ShouldBeTrue)
+			}
+		})
+	})
+}
+
+func TestStartupGrace(t *testing.T) {
+	Convey("Given a dependency waiting for its first check", t, func() {
+		defer resetDependencies()
+		defer func() { Config.StartupGrace, Config.FailUnhealthy = 0, false }()
+		Config.StartupGrace, Config.FailUnhealthy = time.Minute, true
+
+		RegisterDependencies(&Dependency{Name: "mongo", Item: healthyDep{}})
+		initDependencies()
+
+		Convey("Readiness and the startup probe report starting during the grace period", func() {
+			code, body := serveHealth()
+			So(code, ShouldEqual, http.StatusOK)
+			So(body["status"].(map[string]interface{})["state"], ShouldEqual, "starting")
+
+			rec := httptest.NewRecorder()
+			StartupHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/health/startup", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, `"state":"starting"`)
+		})
+
+		Convey("Readiness fails once the grace period is over", func() {
+			Health.Status.Store("started", time.Now().Add(-2*time.Minute))
+
+			code, _ := serveHealth()
+			So(code, ShouldEqual, Config.StatusUnhealthy)
+		})
+
+		Convey("A failed first check fails readiness during the grace period", func() {
+			dependency := registeredDependencies()[0]
+			setDep(depCheck{dependency: dependency, err: errors.New("connection refused")})
+
+			code, _ := serveHealth()
+			So(code, ShouldEqual, Config.StatusUnhealthy)
+		})
+
+		Convey("The startup probe reports started after the first check", func() {
+			dependency := registeredDependencies()[0]
+			setDep(depCheck{dependency: dependency})
+
+			rec := httptest.NewRecorder()
+			StartupHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/health/startup", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, `"state":"started"`)
+		})
+	})
+}
+
+func TestFailUnhealthy(t *testing.T) {
+	Convey("Given an unhealthy dependency", t, func() {
+		defer resetDependencies()
+		RegisterDependencies(&Dependency{Name: "mongo", Item: failingDep{errors.New("connection refused")}})
+		initDependencies()
+		setDep(depCheck{dependency: registeredDependencies()[0], err: errors.New("connection refused")})
+
+		Convey("/health answers 200 with the unhealthy state by default", func() {
+			code, body := serveHealth()
+			So(code, ShouldEqual, http.StatusOK)
+			So(body["status"].(map[string]interface{})["state"], ShouldEqual, "unhealthy")
+		})
+
+		Convey("/health answers with StatusUnhealthy when FailUnhealthy is set", func() {
+			defer func() { Config.FailUnhealthy = false }()
+			Config.FailUnhealthy = true
+
+			code, body := serveHealth()
+			So(code, ShouldEqual, Config.StatusUnhealthy)
+			So(body["status"].(map[string]interface{})["state"], ShouldEqual, "unhealthy")
+		})
+	})
+}
+
+// stateChange is a recorded OnStateChange call
+type stateChange struct {
+	dep     string
+	healthy bool
+	err     error
+}
+
+func TestOnStateChange(t *testing.T) {
+	Convey("Given a state change callback", t, func() {
+		defer resetDependencies()
+		defer func() { stateChangeFuncs = nil }()
+
+		var changes []stateChange
+		OnStateChange(func(dep string, healthy bool, err error) {
+			changes = append(changes, stateChange{dep, healthy, err})
+		})
+
+		RegisterDependencies(&Dependency{Name: "Mongo", Item: healthyDep{}})
+		dependency := registeredDependencies()[0]
+		initDependencies()
+		errDown := errors.New("connection refused")
+
+		Convey("It is not called for the unhealthy by default state", func() {
+			So(changes, ShouldBeEmpty)
+		})
+
+		Convey("It is called on the first check and once per transition after", func() {
+			setDep(depCheck{dependency: dependency})
+			setDep(depCheck{dependency: dependency})
+			So(changes, ShouldResemble, []stateChange{{"Mongo", true, nil}})
+
+			setDep(depCheck{dependency: dependency, err: errDown})
+			setDep(depCheck{dependency: dependency, err: errDown})
+			setDep(depCheck{dependency: dependency, err: errDown})
+			So(changes, ShouldHaveLength, 2)
+			So(changes[1], ShouldResemble, stateChange{"Mongo", false, errDown})
+
+			setDep(depCheck{dependency: dependency})
+			setDep(depCheck{dependency: dependency})
+			So(changes, ShouldHaveLength, 3)
+			So(changes[2], ShouldResemble, stateChange{"Mongo", true, nil})
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// topology kinds reported by the mongo dependency
+const (
+	topologyStandalone = "standalone"
+	topologyReplicaSet = "replica_set"
+	topologySharded    = "sharded"
+)
+
+// MongoPinger is the mongo server as seen by the mongo dependency, the mongo client implements it, tests can supply
+// their own.
+type MongoPinger interface {
+	Ping(ctx context.Context) error
+	ServerVersion(ctx context.Context) (string, error)
+	TopologyKind(ctx context.Context) (string, error)
+}
+
+// mongoPinger runs the checks against a live mongo server
+type mongoPinger struct {
+	client *mongo.Client
+}
+
+func (m *mongoPinger) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, nil)
+}
+
+func (m *mongoPinger) ServerVersion(ctx context.Context) (string, error) {
+	var info struct {
+		Version string `bson:"version"`
+	}
+	err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+	return info.Version, err
+}
+
+func (m *mongoPinger) TopologyKind(ctx context.Context) (string, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	switch {
+	case err != nil:
+		return "", err
+	case hello.Msg == "isdbgrid":
+		return topologySharded, nil
+	case hello.SetName != "":
+		return topologyReplicaSet, nil
+	}
+	return topologyStandalone, nil
+}
+
+// MongoCheck is a Depender pinging a mongo server.
+type MongoCheck struct {
+	pinger MongoPinger
+}
+
+// NewMongoDependency creates a dependency pinging the mongo server through client, reporting ok, the server version
+// and the topology kind in its state.
+func NewMongoDependency(name string, client *mongo.Client) *Dependency {
+	return newMongoDependency(name, &mongoPinger{client: client})
+}
+
+func newMongoDependency(name string, pinger MongoPinger) *Dependency {
+	return &Dependency{
+		Name: name,
+		Desc: "mongo ping",
+		Item: &MongoCheck{pinger: pinger},
+	}
+}
+
+// Check pings the server, unhealthy when the ping fails or takes longer than CheckMaxTimeout.
+func (c *MongoCheck) Check() (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Config.CheckMaxTimeout)
+	defer cancel()
+
+	state := map[string]interface{}{"ok": false}
+	if err := c.pinger.Ping(ctx); err != nil {
+		return state, err
+	}
+	state["ok"] = true
+
+	// the ping is what decides health, the rest is for information
+	if version, err := c.pinger.ServerVersion(ctx); err == nil {
+		state["server_version"] = version
+	}
+	if topology, err := c.pinger.TopologyKind(ctx); err == nil {
+		state["topology"] = topology
+	}
+	return state, nil
+}
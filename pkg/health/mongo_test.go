@@ -0,0 +1,55 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakePinger is a mongo server that answers with fixed results
+type fakePinger struct {
+	err      error
+	version  string
+	topology string
+}
+
+func (f *fakePinger) Ping(ctx context.Context) error {
+	return f.err
+}
+
+func (f *fakePinger) ServerVersion(ctx context.Context) (string, error) {
+	return f.version, f.err
+}
+
+func (f *fakePinger) TopologyKind(ctx context.Context) (string, error) {
+	return f.topology, f.err
+}
+
+func TestMongoDependency(t *testing.T) {
+	Convey("Given a reachable mongo server", t, func() {
+		dependency := newMongoDependency("mongo", &fakePinger{version: "4.4.10", topology: topologyReplicaSet})
+
+		Convey("The check is healthy and reports the server", func() {
+			state, err := dependency.Item.Check()
+			So(err, ShouldBeNil)
+			So(state, ShouldResemble, map[string]interface{}{
+				"ok":             true,
+				"server_version": "4.4.10",
+				"topology":       topologyReplicaSet,
+			})
+		})
+	})
+
+	Convey("Given an unreachable mongo server", t, func() {
+		errDown := errors.New("server selection timeout")
+		dependency := newMongoDependency("mongo", &fakePinger{err: errDown})
+
+		Convey("The check fails with the ping error", func() {
+			state, err := dependency.Item.Check()
+			So(err, ShouldEqual, errDown)
+			So(state, ShouldResemble, map[string]interface{}{"ok": false})
+		})
+	})
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package health
+
+import "syscall"
+
+func statfsPath(path string) (diskUsage, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return diskUsage{}, err
+	}
+	return diskUsage{
+		Free:  fs.Bavail * uint64(fs.Bsize),
+		Total: fs.Blocks * uint64(fs.Bsize),
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package health
+
+import (
+	"errors"
+	"runtime"
+)
+
+func statfsPath(path string) (diskUsage, error) {
+	return diskUsage{}, errors.New("disk space check is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,33 @@
+package options
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseBuckets parses a comma separated list of histogram bucket upper bounds, they must be positive and increasing
+func ParseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		bucket, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", field, err)
+		}
+		if bucket <= 0 {
+			return nil, fmt.Errorf("invalid bucket %v: must be positive", bucket)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("invalid bucket %v: buckets must be in increasing order", bucket)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no buckets in %q", list)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,38 @@
+package options
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		Name     string
+		List     string
+		Expected []float64
+		Error    bool
+	}{
+		{Name: "sub second buckets", List: "0.1,0.25,0.5,1", Expected: []float64{0.1, 0.25, 0.5, 1}},
+		{Name: "spaces and trailing comma", List: " 1, 60 ,3600,", Expected: []float64{1, 60, 3600}},
+		{Name: "not a number", List: "1,two,3", Error: true},
+		{Name: "negative bucket", List: "-1,2", Error: true},
+		{Name: "zero bucket", List: "0,2", Error: true},
+		{Name: "unsorted buckets", List: "1,5,2", Error: true},
+		{Name: "duplicate buckets", List: "1,1", Error: true},
+		{Name: "empty list", List: " , ", Error: true},
+	}
+
+	for i, test := range tests {
+		Convey(fmt.Sprintf("Given the test case %d: %v", i, test.Name), t, func() {
+			buckets, err := ParseBuckets(test.List)
+			if test.Error {
+				So(err, ShouldNotBeNil)
+				return
+			}
+			So(err, ShouldBeNil)
+			So(buckets, ShouldResemble, test.Expected)
+		})
+	}
+}
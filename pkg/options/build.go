@@ -1,8 +1,25 @@
 package options
 
+import (
+	"encoding/json"
+	"io"
+)
+
 // Build variables
 var (
 	Version = "UNSET" // Version from git tag
 	GitHash = "UNSET" // GitHash is the short tag
 	Build   = "UNSET" // Build is the build string
 )
+
+// VersionInfo is the build variables as printed by --version-json
+type VersionInfo struct {
+	Version string `json:"version"`
+	GitHash string `json:"git_hash"`
+	Build   string `json:"build"`
+}
+
+// WriteVersionJSON writes the build variables as a single line of JSON, for deploy tooling to parse
+func WriteVersionJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(VersionInfo{Version: Version, GitHash: GitHash, Build: Build})
+}
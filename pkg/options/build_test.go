@@ -0,0 +1,32 @@
+package options
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteVersionJSON(t *testing.T) {
+	Convey("Given the build variables", t, func() {
+		defer func(version, hash, build string) { Version, GitHash, Build = version, hash, build }(Version, GitHash, Build)
+		Version, GitHash, Build = "v1.2.3", "abc1234", "2021-06-01T12:00:00Z"
+
+		var buf bytes.Buffer
+		So(WriteVersionJSON(&buf), ShouldBeNil)
+
+		Convey("They are written as one line of JSON", func() {
+			So(strings.Count(buf.String(), "\n"), ShouldEqual, 1)
+
+			var out map[string]string
+			So(json.Unmarshal(buf.Bytes(), &out), ShouldBeNil)
+			So(out, ShouldResemble, map[string]string{
+				"version":  "v1.2.3",
+				"git_hash": "abc1234",
+				"build":    "2021-06-01T12:00:00Z",
+			})
+		})
+	})
+}
@@ -1,7 +1,10 @@
 package options
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
@@ -13,11 +16,44 @@ type ServiceOptions struct {
 	SSL   bool `long:"ssl" env:"ENABLE_SSL" description:"enable SSL, default key and crt will be binary name .crt and .key"`
 }
 
+// HTTPOptions tunes the http server, the TLS certificate and key serve https with HTTP/2 instead of plain http
+type HTTPOptions struct {
+	ReadTimeout    time.Duration `long:"http-read-timeout" env:"HTTP_READ_TIMEOUT" default:"15s" description:"maximum time to read a request including the body"`
+	WriteTimeout   time.Duration `long:"http-write-timeout" env:"HTTP_WRITE_TIMEOUT" default:"15s" description:"maximum time to write a response"`
+	IdleTimeout    time.Duration `long:"http-idle-timeout" env:"HTTP_IDLE_TIMEOUT" default:"60s" description:"how long an idle keep-alive connection is kept open"`
+	MaxHeaderBytes int           `long:"http-max-header-bytes" env:"HTTP_MAX_HEADER_BYTES" default:"1048576" description:"maximum size of the request headers"`
+	TLSCert        string        `long:"tls-cert" env:"TLS_CERT" default:"" description:"certificate file to serve https and HTTP/2 with, needs --tls-key"`
+	TLSKey         string        `long:"tls-key" env:"TLS_KEY" default:"" description:"private key file for --tls-cert"`
+}
+
+// Validate checks the timeouts and sizes are positive and the TLS certificate and key are set together
+func (o HTTPOptions) Validate() error {
+	switch {
+	case o.ReadTimeout <= 0:
+		return fmt.Errorf("http read timeout must be positive, got %v", o.ReadTimeout)
+	case o.WriteTimeout <= 0:
+		return fmt.Errorf("http write timeout must be positive, got %v", o.WriteTimeout)
+	case o.IdleTimeout <= 0:
+		return fmt.Errorf("http idle timeout must be positive, got %v", o.IdleTimeout)
+	case o.MaxHeaderBytes <= 0:
+		return fmt.Errorf("http max header bytes must be positive, got %d", o.MaxHeaderBytes)
+	case (o.TLSCert == "") != (o.TLSKey == ""):
+		return errors.New("the tls certificate and key must be set together")
+	}
+	return nil
+}
+
+// TLS reports whether the server is to serve https
+func (o HTTPOptions) TLS() bool {
+	return o.TLSCert != "" && o.TLSKey != ""
+}
+
 // ApplicationOptions defines some default application options present in every utility or server
 type ApplicationOptions struct {
 	Debug       bool   `short:"d" long:"debug" env:"DEBUG" description:"enable debug logging level"`
 	Environment string `short:"e" long:"env" env:"ENVIRONMENT" default:"dev" description:"environment this is running in"`
 	Version     bool   `short:"v" long:"version" description:"output version variables"`
+	VersionJSON bool   `long:"version-json" description:"print the version variables as JSON to stdout and exit"`
 }
 
 // Environment loads environment files from a standard configuration place
@@ -34,6 +70,34 @@ func Environment(env string) {
 	godotenv.Load(os.Args[0] + "-" + env + ".env")
 }
 
+// ReloadEnvironment re-reads the same environment files as Environment, values in the files replace any that are
+// already set so edits are picked up. Used to reload the configuration on SIGHUP.
+func ReloadEnvironment(env string) {
+	OverloadEnvironment(EnvironmentFiles(env)...)
+}
+
+// EnvironmentFiles are the environment files read for env, the ENVIRONMENT variable or dev if empty, in load order
+func EnvironmentFiles(env string) []string {
+	if env == "" {
+		env = os.Getenv("ENVIRONMENT")
+	}
+	if env == "" {
+		env = "dev"
+	}
+	return []string{
+		"/etc/services/environment/" + env,
+		"/etc/services/" + os.Args[0] + "/environment",
+		os.Args[0] + "-" + env + ".env",
+	}
+}
+
+// OverloadEnvironment loads the environment files in order, replacing values already set, missing files are skipped
+func OverloadEnvironment(files ...string) {
+	for _, file := range files {
+		godotenv.Overload(file)
+	}
+}
+
 // LogVersion outputs the version build variables
 func LogVersion() {
 	log.Info().Str("version", Version).Str("build", Build).Msg("version variables")
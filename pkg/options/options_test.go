@@ -0,0 +1,40 @@
+package options
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHTTPOptions(t *testing.T) {
+	valid := HTTPOptions{ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, MaxHeaderBytes: 1024}
+
+	Convey("Given valid http options", t, func() {
+		So(valid.Validate(), ShouldBeNil)
+		So(valid.TLS(), ShouldBeFalse)
+	})
+
+	Convey("Given http options with a timeout that isn't positive", t, func() {
+		for _, modify := range []func(o *HTTPOptions){
+			func(o *HTTPOptions) { o.ReadTimeout = 0 },
+			func(o *HTTPOptions) { o.WriteTimeout = -time.Second },
+			func(o *HTTPOptions) { o.IdleTimeout = 0 },
+			func(o *HTTPOptions) { o.MaxHeaderBytes = 0 },
+		} {
+			o := valid
+			modify(&o)
+			So(o.Validate(), ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given a tls certificate without its key", t, func() {
+		o := valid
+		o.TLSCert = "server.crt"
+		So(o.Validate(), ShouldNotBeNil)
+
+		o.TLSKey = "server.key"
+		So(o.Validate(), ShouldBeNil)
+		So(o.TLS(), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,62 @@
+package options
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// RedactedValue replaces secrets in the output of Redact
+const RedactedValue = "REDACTED"
+
+// Redact flattens a go-flags options struct into a map of long flag name to value, for showing the effective
+// configuration. Fields tagged secret:"true" are replaced with RedactedValue when set, and the password of any value
+// that is a URL with credentials, e.g. a mongo URI or a proxy, is redacted.
+func Redact(opts interface{}) map[string]interface{} {
+	config := make(map[string]interface{})
+	redact(reflect.Indirect(reflect.ValueOf(opts)), config)
+	return config
+}
+
+func redact(v reflect.Value, config map[string]interface{}) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		name := field.Tag.Get("long")
+		if name == "" {
+			redact(v.Field(i), config)
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if !v.Field(i).IsZero() {
+				value = RedactedValue
+			}
+		case v.Field(i).Kind() == reflect.String:
+			value = redactURL(v.Field(i).String())
+		}
+		config[name] = value
+	}
+}
+
+// redactURL redacts the password of a URL, other values are returned as they are
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	u.User = url.UserPassword(u.User.Username(), RedactedValue)
+	return u.String()
+}
@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of making a request while the client's circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+// circuit breaker states
+const (
+	BreakerClosed   BreakerState = iota // requests flow normally
+	BreakerOpen                         // requests fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     // the cooldown has passed, a single trial request is let through
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops a client hammering a failing host. It opens after a number of consecutive failures, then after
+// the cooldown lets a trial request through, closing again if it succeeds.
+type CircuitBreaker struct {
+	Failures int           // consecutive failures before the breaker opens
+	Cooldown time.Duration // how long the breaker stays open before a trial request
+
+	mu       sync.Mutex
+	state    BreakerState
+	failed   int
+	openedAt time.Time
+	trial    bool // a half-open trial request is in flight
+	now      func() time.Time
+}
+
+// NewCircuitBreaker creates a closed circuit breaker, set it on Client.Breaker to use it
+func NewCircuitBreaker(failures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Failures: failures,
+		Cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// State returns the current breaker state, e.g. for exposing as a metric
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a request may be made now
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a request, transport errors and 5xx responses are failures
+func (b *CircuitBreaker) record(resp *http.Response, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		b.state = BreakerClosed
+		b.failed = 0
+		return
+	}
+	b.failed++
+	if b.state == BreakerHalfOpen || b.failed >= b.Failures {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
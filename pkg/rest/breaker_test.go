@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	Convey("Given a client with a breaker in front of a failing host", t, func() {
+		var calls, failing int32 = 0, 1
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		now := time.Now()
+		client := NewClient(server.URL)
+		client.Breaker = NewCircuitBreaker(3, time.Minute)
+		client.Breaker.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			So(client.Get("/webhook", nil), ShouldNotBeNil)
+		}
+
+		Convey("It opens after the consecutive failures and short circuits further calls", func() {
+			So(client.Breaker.State(), ShouldEqual, BreakerOpen)
+			So(client.Get("/webhook", nil), ShouldEqual, ErrCircuitOpen)
+			_, err := client.DoRaw("GET", "/webhook")
+			So(err, ShouldEqual, ErrCircuitOpen)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+		})
+
+		Convey("It recovers after the cooldown once the host is back", func() {
+			now = now.Add(time.Minute)
+			So(client.Breaker.State(), ShouldEqual, BreakerHalfOpen)
+			atomic.StoreInt32(&failing, 0)
+
+			So(client.Get("/webhook", nil), ShouldBeNil)
+			So(client.Breaker.State(), ShouldEqual, BreakerClosed)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 4)
+		})
+
+		Convey("A failed trial request opens it again", func() {
+			now = now.Add(time.Minute)
+			So(client.Get("/webhook", nil), ShouldNotEqual, ErrCircuitOpen)
+			So(client.Breaker.State(), ShouldEqual, BreakerOpen)
+			So(client.Get("/webhook", nil), ShouldEqual, ErrCircuitOpen)
+		})
+	})
+}
@@ -1,13 +1,16 @@
 package rest
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/gorilla/context"
+	"golang.org/x/time/rate"
 )
 
 // Client represents a REST client, has a host, http client, request and response options
@@ -16,38 +19,108 @@ type Client struct {
 	Client          *http.Client
 	ResponseOptions []ResponseOptionFunc
 	RequestOptions  []RequestOptionFunc
+	Breaker         *CircuitBreaker // optional, fails requests fast with ErrCircuitOpen while the host is failing
+	Retry           *RetryPolicy    // optional, retries failed and throttled requests
+	MaxBodySize     int64           // responses larger than this fail with ErrBodyTooLarge, zero for DefaultMaxBodySize
+	BasePath        string          // optional, prepended to every request path, e.g. /api/v2
+	Limiter         *rate.Limiter   // optional, every attempt, retries included, waits for a token, e.g. rate.NewLimiter(20, 1)
 }
 
+// connection pool defaults, enough idle connections per host that frequent callers reuse them instead of churning
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 10
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
 // setup some reasonable client timeouts here, note this does not stop
 // the entire request from hanging, that needs to be handled in the reader
 var (
 	// DefaultClient is a default http client used by the rest calls, sets up
-	// timeouts, keepalive, TLS timeout, response timeout
+	// timeouts, keepalive, TLS timeout, response timeout and connection pooling
 	DefaultClient = &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		},
+		Transport: NewTransport(),
 	}
 )
 
+// TransportOptionFunc tunes a transport created by NewTransport
+type TransportOptionFunc func(t *http.Transport)
+
+// MaxIdleConns sets the maximum number of idle connections kept across all hosts
+func MaxIdleConns(n int) TransportOptionFunc {
+	return func(t *http.Transport) {
+		t.MaxIdleConns = n
+	}
+}
+
+// MaxIdleConnsPerHost sets the maximum number of idle connections kept for each host
+func MaxIdleConnsPerHost(n int) TransportOptionFunc {
+	return func(t *http.Transport) {
+		t.MaxIdleConnsPerHost = n
+	}
+}
+
+// IdleConnTimeout sets how long an idle connection is kept before it is closed
+func IdleConnTimeout(d time.Duration) TransportOptionFunc {
+	return func(t *http.Transport) {
+		t.IdleConnTimeout = d
+	}
+}
+
+// NewTransport creates a transport with the default timeouts and connection pool settings, then applies options
+func NewTransport(options ...TransportOptionFunc) *http.Transport {
+	t := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConns:          DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:   DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       DefaultIdleConnTimeout,
+	}
+	for _, option := range options {
+		option(t)
+	}
+	return t
+}
+
 // NewClient creates a new rest client with some standard configured
-// response options:
+// request and response options:
+// Request:
+// - Accept: application/json
 // Response:
 // - Timing of requests
 // - JSON decoding
 // - HTTP response parsing, treating 200, 201, and 204 as good responses
+//
+// New code should swap ResponseOnlyOK for ResponseExpect2xx, which accepts any 2xx and keeps the error body.
 func NewClient(host string) *Client {
+	return newClient(host, DefaultClient)
+}
+
+// NewClientWithTransport creates a new rest client like NewClient, but with its own http client using transport t,
+// e.g. NewClientWithTransport(host, NewTransport(MaxIdleConnsPerHost(50)))
+func NewClientWithTransport(host string, t *http.Transport) *Client {
+	return newClient(host, &http.Client{Transport: t})
+}
+
+// NewClientWithBasePath creates a new rest client like NewClient, with every request path under basePath, e.g.
+// NewClientWithBasePath(host, "/api/v2").Get("/running.json", ...) requests /api/v2/running.json
+func NewClientWithBasePath(host, basePath string) *Client {
+	c := newClient(host, DefaultClient)
+	c.BasePath = basePath
+	return c
+}
+
+func newClient(host string, client *http.Client) *Client {
 	return &Client{
 		Host:           host,
-		Client:         DefaultClient,
-		RequestOptions: []RequestOptionFunc{},
+		Client:         client,
+		RequestOptions: []RequestOptionFunc{Accept("application/json")},
 		ResponseOptions: []ResponseOptionFunc{
 			ResponseTimer,
 			ResponseJSON,
@@ -73,43 +146,109 @@ func (c *Client) AddResponseOptions(options ...ResponseOptionFunc) {
 
 // Do does a HTTP REST request, applying all request options and applying all response options
 func (c *Client) Do(method, path string, result interface{}, options ...RequestOptionFunc) error {
-	url := fmt.Sprintf("%s%s", c.Host, path)
-
-	requestOptions := c.RequestOptions
-	if options != nil && len(options) > 0 {
-		requestOptions = append(requestOptions, options...)
+	req, err := c.newRequest(method, path, options)
+	if err != nil {
+		return err
 	}
 
-	req, err := http.NewRequest(method, url, nil)
+	info := requestInfo{start: time.Now(), maxBodySize: c.MaxBodySize}
+	req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+
+	resp, err := c.send(req)
 
 	if err != nil {
 		return err
 	}
 
-	context.Set(req, "start", time.Now())
-	defer context.Clear(req)
-
-	for _, option := range requestOptions {
-		err := option(req)
+	for _, option := range c.ResponseOptions {
+		err := option(resp, result)
 		if err != nil {
 			return err
 		}
 	}
 
+	return nil
+}
+
+// requestInfoKey is the context key of the requestInfo Do adds to each request
+type requestInfoKey struct{}
+
+// requestInfo is what the response options need to know about a request made by Do. It is carried on the request's
+// context, so it follows redirects and goes with the request.
+type requestInfo struct {
+	start       time.Time
+	maxBodySize int64
+}
+
+// infoOf returns the requestInfo of a request made by Do, zero for a request made any other way or none at all
+func infoOf(req *http.Request) requestInfo {
+	if req == nil {
+		return requestInfo{}
+	}
+	info, _ := req.Context().Value(requestInfoKey{}).(requestInfo)
+	return info
+}
+
+// DoRaw does a HTTP REST request, applying all request options but none of the response options, so the caller can
+// inspect the headers and read the body themselves. The caller must close the response body.
+func (c *Client) DoRaw(method, path string, options ...RequestOptionFunc) (*http.Response, error) {
+	req, err := c.newRequest(method, path, options)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+// attempt makes the request once, after the rate limiter and through the circuit breaker if there are any
+func (c *Client) attempt(req *http.Request) (*http.Response, error) {
+	if err := c.waitLimiter(req); err != nil {
+		return nil, err
+	}
+	if c.Breaker == nil {
+		return c.Client.Do(req)
+	}
+	if !c.Breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
 	resp, err := c.Client.Do(req)
+	c.Breaker.record(resp, err)
+	return resp, err
+}
+
+// newRequest builds the request for path and applies the client and per call request options
+func (c *Client) newRequest(method, path string, options []RequestOptionFunc) (*http.Request, error) {
+	url := fmt.Sprintf("%s%s", c.Host, joinPath(c.BasePath, path))
+
+	req, err := http.NewRequest(method, url, nil)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, option := range c.ResponseOptions {
-		err := option(resp, result)
-		if err != nil {
-			return err
+	for _, option := range c.RequestOptions {
+		if err := option(req); err != nil {
+			return nil, err
+		}
+	}
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	return req, nil
+}
+
+// joinPath prepends the base path to path with exactly one slash between them, the path is left alone without a base
+func joinPath(base, path string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return path
+	}
+	if path == "" || strings.HasPrefix(path, "?") {
+		return "/" + base + path
+	}
+	return "/" + base + "/" + strings.TrimLeft(path, "/")
 }
 
 // Get do a REST GET request
@@ -122,6 +261,16 @@ func (c *Client) Post(path string, result interface{}, options ...RequestOptionF
 	return c.Do("POST", path, result, options...)
 }
 
+// PostReader does a REST POST request streaming the body from reader, e.g. a large upload, with contentType as the
+// Content-Type if not empty. The body can only be sent once, so the request is not retried.
+func (c *Client) PostReader(path string, body io.Reader, contentType string, result interface{}, options ...RequestOptionFunc) error {
+	bodyOptions := []RequestOptionFunc{BodyReader(body)}
+	if contentType != "" {
+		bodyOptions = append(bodyOptions, Header("content-type", contentType))
+	}
+	return c.Do("POST", path, result, append(bodyOptions, options...)...)
+}
+
 // Delete does a REST DELETE request
 func (c *Client) Delete(path string, result interface{}, options ...RequestOptionFunc) error {
 	return c.Do("DELETE", path, result, options...)
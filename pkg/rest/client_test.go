@@ -0,0 +1,163 @@
+package rest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDoRaw(t *testing.T) {
+	Convey("Given a server returning rate limit headers", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Remaining", "42")
+			w.Header().Set("Location", "/alerts/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(r.Header.Get("X-Test")))
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.AddRequestOptions(Header("X-Test", "from-client"))
+
+		resp, err := client.DoRaw("POST", "/alerts")
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+
+		So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+		So(resp.Header.Get("X-RateLimit-Remaining"), ShouldEqual, "42")
+		So(resp.Header.Get("Location"), ShouldEqual, "/alerts/1")
+
+		body, err := ioutil.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		So(string(body), ShouldEqual, "from-client")
+	})
+}
+
+func TestTransportPooling(t *testing.T) {
+	Convey("Given the default client", t, func() {
+		transport := DefaultClient.Transport.(*http.Transport)
+		So(transport.MaxIdleConns, ShouldEqual, DefaultMaxIdleConns)
+		So(transport.MaxIdleConnsPerHost, ShouldEqual, DefaultMaxIdleConnsPerHost)
+		So(transport.IdleConnTimeout, ShouldEqual, DefaultIdleConnTimeout)
+	})
+
+	Convey("Given a client with a tuned transport", t, func() {
+		client := NewClientWithTransport("http://localhost",
+			NewTransport(MaxIdleConns(20), MaxIdleConnsPerHost(20), IdleConnTimeout(time.Minute)))
+
+		transport := client.Client.Transport.(*http.Transport)
+		So(transport.MaxIdleConns, ShouldEqual, 20)
+		So(transport.MaxIdleConnsPerHost, ShouldEqual, 20)
+		So(transport.IdleConnTimeout, ShouldEqual, time.Minute)
+		So(transport.ResponseHeaderTimeout, ShouldEqual, 10*time.Second)
+
+		Convey("It does not share the default client", func() {
+			So(client.Client, ShouldNotEqual, DefaultClient)
+			client.Timeout(time.Second)
+			So(DefaultClient.Transport.(*http.Transport).ResponseHeaderTimeout, ShouldEqual, 10*time.Second)
+		})
+	})
+}
+
+func TestBasePath(t *testing.T) {
+	Convey("Given base paths and request paths", t, func() {
+		cases := []struct{ base, path, expected string }{
+			{"", "/running.json", "/running.json"},
+			{"", "running.json", "running.json"},
+			{"/api/v2", "/running.json", "/api/v2/running.json"},
+			{"/api/v2", "running.json", "/api/v2/running.json"},
+			{"/api/v2/", "/running.json", "/api/v2/running.json"},
+			{"api/v2", "running.json", "/api/v2/running.json"},
+			{"/api/v2//", "//running.json", "/api/v2/running.json"},
+			{"/api/v2", "", "/api/v2"},
+			{"/api/v2", "/", "/api/v2/"},
+			{"/api/v2", "?limit=5", "/api/v2?limit=5"},
+			{"/api/v2", "/history.json?ns=foo", "/api/v2/history.json?ns=foo"},
+			{"/", "/running.json", "/running.json"},
+		}
+		for _, c := range cases {
+			So(joinPath(c.base, c.path), ShouldEqual, c.expected)
+		}
+	})
+
+	Convey("Given a client with a base path", t, func() {
+		var path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.RequestURI()
+			w.Write([]byte("{}"))
+		}))
+		defer server.Close()
+
+		client := NewClientWithBasePath(server.URL, "/api/v2/")
+		var result map[string]interface{}
+		So(client.Get("/running.json", &result), ShouldBeNil)
+		So(path, ShouldEqual, "/api/v2/running.json")
+
+		resp, err := client.DoRaw("GET", "history.json?ns=foo")
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(path, ShouldEqual, "/api/v2/history.json?ns=foo")
+	})
+}
+
+func TestPostReader(t *testing.T) {
+	Convey("Given a server recording the upload", t, func() {
+		var calls int32
+		var received []byte
+		var contentType string
+		var contentLength int64
+		var chunked bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			received, _ = ioutil.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+			contentLength = r.ContentLength
+			chunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		upload := bytes.Repeat([]byte("slow query\n"), 10000)
+
+		Convey("A reader of unknown length is streamed chunked", func() {
+			body := io.MultiReader(bytes.NewReader(upload[:50000]), bytes.NewReader(upload[50000:]))
+			So(client.PostReader("/upload", body, "application/x-ndjson", nil), ShouldBeNil)
+			So(received, ShouldResemble, upload)
+			So(contentType, ShouldEqual, "application/x-ndjson")
+			So(chunked, ShouldBeTrue)
+		})
+
+		Convey("A reader that knows its length sets the Content-Length", func() {
+			So(client.PostReader("/upload", strings.NewReader("slow query"), "text/plain", nil), ShouldBeNil)
+			So(string(received), ShouldEqual, "slow query")
+			So(contentLength, ShouldEqual, 10)
+			So(chunked, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a failing server and a retry policy", t, func() {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Retry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		Convey("The reader is not replayed", func() {
+			So(client.PostReader("/upload", strings.NewReader("slow query"), "text/plain", nil), ShouldNotBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+		})
+	})
+}
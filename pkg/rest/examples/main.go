@@ -4,7 +4,6 @@ Package main provides web app/service functionality.
 package main
 
 import (
-	"fmt"
 	"net/url"
 
 	"github.com/jeks313/go-mongo-slow-queries/pkg/rest"
@@ -46,7 +45,8 @@ func main() {
 
 	// test the basic auth works
 	result = make(map[string]interface{})
-	err = client.Get(fmt.Sprintf("/basic-auth/%s/%s", "batman", "cave"), &result, rest.BodyJSON(payload))
+	err = client.Get("/basic-auth/{user}/{pass}", &result, rest.BodyJSON(payload),
+		rest.PathParams(map[string]string{"user": "batman", "pass": "cave"}))
 
 	if err != nil {
 		log.Error().Str("method", "POST").Err(err).Msg("failed")
@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// redacted replaces sensitive header and body values in the request log
+const redacted = "[REDACTED]"
+
+// RedactHeaders are the headers always redacted by WithLogger
+var RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// RedactQueryParams are the URL query parameters always redacted by WithLogger
+var RedactQueryParams = []string{"token", "access_token", "api_key", "apikey", "key", "password", "secret"}
+
+// WithLogger logs each request's method, URL, status, duration, headers and body to logger. Add it with
+// AddResponseOptions. The RedactHeaders, RedactQueryParams, any URL password and any headers, query parameters or top
+// level JSON body fields named in redact are logged as [REDACTED]. Bodies set by BodyReader can't be read again so are
+// not logged.
+func WithLogger(logger zerolog.Logger, redact ...string) ResponseOptionFunc {
+	redactHeaders := make(map[string]bool)
+	for _, name := range append(append([]string{}, RedactHeaders...), redact...) {
+		redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	redactFields := make(map[string]bool)
+	for _, name := range redact {
+		redactFields[name] = true
+	}
+	redactParams := make(map[string]bool)
+	for _, name := range append(append([]string{}, RedactQueryParams...), redact...) {
+		redactParams[strings.ToLower(name)] = true
+	}
+
+	return func(resp *http.Response, result interface{}) error {
+		req := resp.Request
+		event := logger.Info().
+			Str("method", req.Method).
+			Str("url", requestURL(req.URL, redactParams)).
+			Int("status", resp.StatusCode)
+		if start := infoOf(req).start; !start.IsZero() {
+			event = event.Float64("duration_secs", time.Since(start).Seconds())
+		}
+
+		headers := zerolog.Dict()
+		for name, values := range req.Header {
+			value := strings.Join(values, ", ")
+			if redactHeaders[name] {
+				value = redacted
+			}
+			headers = headers.Str(name, value)
+		}
+		event = event.Dict("request_headers", headers)
+
+		if body := requestBody(req, redactFields); body != "" {
+			event = event.Str("request_body", body)
+		}
+		event.Msg("client request")
+		return nil
+	}
+}
+
+// requestURL is the URL for logging, with the password and the named query parameters redacted, matched ignoring case
+func requestURL(u *url.URL, redactParams map[string]bool) string {
+	c := *u
+	if _, ok := c.User.Password(); ok {
+		c.User = url.UserPassword(c.User.Username(), redacted)
+	}
+	query := c.Query()
+	if len(query) == 0 {
+		return c.String()
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			if redactParams[strings.ToLower(name)] {
+				value = redacted
+			} else {
+				value = url.QueryEscape(value)
+			}
+			params = append(params, url.QueryEscape(name)+"="+value)
+		}
+	}
+	c.RawQuery = strings.Join(params, "&")
+	return c.String()
+}
+
+// requestBody reads the request body again for logging, with the named JSON fields redacted
+func requestBody(req *http.Request, redactFields map[string]bool) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	r, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ""
+	}
+
+	var fields map[string]interface{}
+	if len(redactFields) > 0 && json.Unmarshal(body, &fields) == nil {
+		for name := range fields {
+			if redactFields[name] {
+				fields[name] = redacted
+			}
+		}
+		if b, err := json.Marshal(fields); err == nil {
+			body = b
+		}
+	}
+	if len(body) > bodyErrorStringLimit {
+		body = body[:bodyErrorStringLimit]
+	}
+	return string(body)
+}
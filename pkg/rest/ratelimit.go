@@ -0,0 +1,31 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrRateLimited is returned when the request context is done, or would be, before the client's Limiter allows the
+// request. It is not retried.
+var ErrRateLimited = errors.New("rate limit wait exceeds the request context")
+
+// waitLimiter blocks until the client's Limiter, if there is one, allows another attempt
+func (c *Client) waitLimiter(req *http.Request) error {
+	if c.Limiter == nil {
+		return nil
+	}
+	if err := c.Limiter.Wait(req.Context()); err != nil {
+		return fmt.Errorf("%w: %v", ErrRateLimited, err)
+	}
+	return nil
+}
+
+// Context sets the context of the request, cancelling it aborts the request, any rate limit wait and any retry
+func Context(ctx context.Context) RequestOptionFunc {
+	return func(req *http.Request) error {
+		*req = *req.WithContext(ctx)
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimit(t *testing.T) {
+	Convey("Given a client limited to 20 requests per second with no burst", t, func() {
+		var hits int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Limiter = rate.NewLimiter(20, 1)
+
+		Convey("Requests are spaced out by the limit", func() {
+			start := time.Now()
+			for i := 0; i < 5; i++ {
+				So(client.Get("/", nil), ShouldBeNil)
+			}
+			// the first request goes straight through, the next four wait 50ms each
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+		})
+
+		Convey("Waiting respects the per call context", func() {
+			client.Limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+			client.Retry = NewRetryPolicy(3)
+			So(client.Get("/", nil), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			start := time.Now()
+			err := client.Get("/", nil, Context(ctx))
+			So(errors.Is(err, ErrRateLimited), ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a rate limited client retrying a failing server", t, func() {
+		var hits []time.Time
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, time.Now())
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Limiter = rate.NewLimiter(20, 1)
+		client.Retry = &RetryPolicy{MaxAttempts: 4, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		Convey("Every retry waits for the limit, not just the first attempt", func() {
+			So(client.Get("/", nil), ShouldNotBeNil)
+			So(hits, ShouldHaveLength, 4)
+			// without the limiter the retries would follow each other after a millisecond
+			So(hits[3].Sub(hits[0]), ShouldBeGreaterThanOrEqualTo, 140*time.Millisecond)
+		})
+	})
+}
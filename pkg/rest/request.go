@@ -2,11 +2,15 @@ package rest
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 )
 
 // RequestOptionFunc is a function that is called on the request before the rest
@@ -29,6 +33,14 @@ func Header(name, val string) RequestOptionFunc {
 	}
 }
 
+// Accept sets the Accept header to the mime types, in order of preference
+func Accept(mimeTypes ...string) RequestOptionFunc {
+	return func(req *http.Request) error {
+		req.Header.Set("Accept", strings.Join(mimeTypes, ", "))
+		return nil
+	}
+}
+
 // Headers adds all the key: values in the map to the request headers
 func Headers(headers map[string]string) RequestOptionFunc {
 	return func(req *http.Request) error {
@@ -47,6 +59,32 @@ func Query(query url.Values) RequestOptionFunc {
 	}
 }
 
+// pathParam matches a {name} placeholder in a request path
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// PathParams substitutes {name} placeholders in the request path with the URL escaped values, so a value may safely
+// contain a / or spaces, e.g. client.Get("/users/{user}", &result, PathParams(map[string]string{"user": name}))
+func PathParams(params map[string]string) RequestOptionFunc {
+	return func(req *http.Request) error {
+		for _, match := range pathParam.FindAllStringSubmatch(req.URL.Path, -1) {
+			if _, ok := params[match[1]]; !ok {
+				return fmt.Errorf("missing path parameter %q", match[1])
+			}
+		}
+		escaped := req.URL.EscapedPath()
+		for name, val := range params {
+			escaped = strings.ReplaceAll(escaped, "%7B"+name+"%7D", url.PathEscape(val))
+		}
+		path, err := url.PathUnescape(escaped)
+		if err != nil {
+			return err
+		}
+		req.URL.Path = path
+		req.URL.RawPath = escaped
+		return nil
+	}
+}
+
 // BodyJSON is a utility function that encodes the body passed in
 // as JSON
 func BodyJSON(obj interface{}) RequestOptionFunc {
@@ -56,7 +94,7 @@ func BodyJSON(obj interface{}) RequestOptionFunc {
 			return err
 		}
 		req.Header.Add("content-type", "application/json")
-		req.Body = ioutil.NopCloser(b)
+		setBody(req, b.Bytes())
 		return nil
 	}
 }
@@ -64,17 +102,25 @@ func BodyJSON(obj interface{}) RequestOptionFunc {
 // BodyForm adds the data passed in as form variables to a request
 func BodyForm(data url.Values) RequestOptionFunc {
 	return func(req *http.Request) error {
-		b := bytes.NewBufferString(data.Encode())
 		req.Header.Add("content-type", "application/x-www-form-urlencoded")
-		req.Body = ioutil.NopCloser(b)
+		setBody(req, []byte(data.Encode()))
 		return nil
 	}
 }
 
-// BodyReader sets the body via reader.
+// BodyReader sets the body via reader. The body can only be sent once, so the request is not retried. The
+// Content-Length is set for readers that know their length, e.g. a bytes.Reader, others are sent chunked.
 func BodyReader(body io.Reader) RequestOptionFunc {
 	return func(req *http.Request) error {
-		req.Body = ioutil.NopCloser(body)
+		if r, ok := body.(interface{ Len() int }); ok {
+			req.ContentLength = int64(r.Len())
+		}
+		if rc, ok := body.(io.ReadCloser); ok {
+			req.Body = rc
+		} else {
+			req.Body = ioutil.NopCloser(body)
+		}
+		req.GetBody = nil
 		return nil
 	}
 }
@@ -82,8 +128,7 @@ func BodyReader(body io.Reader) RequestOptionFunc {
 // BodyBytes sets the body as bytes
 func BodyBytes(data []byte) RequestOptionFunc {
 	return func(req *http.Request) error {
-		buf := bytes.NewBuffer(data)
-		req.Body = ioutil.NopCloser(buf)
+		setBody(req, data)
 		return nil
 	}
 }
@@ -92,9 +137,39 @@ func BodyBytes(data []byte) RequestOptionFunc {
 // as plain text
 func BodyText(rawMessage string) RequestOptionFunc {
 	return func(req *http.Request) error {
-		b := bytes.NewBufferString(rawMessage)
 		req.Header.Add("content-type", "text/plain")
-		req.Body = ioutil.NopCloser(b)
+		setBody(req, []byte(rawMessage))
 		return nil
 	}
 }
+
+// Gzip compresses the request body set by an earlier body option and sets the Content-Encoding header. The
+// compressed body is fully buffered so it can be sent again.
+func Gzip() RequestOptionFunc {
+	return func(req *http.Request) error {
+		if req.Body == nil {
+			return nil
+		}
+		defer req.Body.Close()
+		b := new(bytes.Buffer)
+		zw := gzip.NewWriter(b)
+		if _, err := io.Copy(zw, req.Body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		req.Header.Set("content-encoding", "gzip")
+		setBody(req, b.Bytes())
+		return nil
+	}
+}
+
+// setBody sets a buffered request body that can be read again when the request is retried or redirected
+func setBody(req *http.Request, data []byte) {
+	req.ContentLength = int64(len(data))
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGzip(t *testing.T) {
+	Convey("Given a server that decompresses gzip request bodies", t, func() {
+		var encoding string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding = r.Header.Get("Content-Encoding")
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, _ := ioutil.ReadAll(zr)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		payload := map[string]string{"alert": "slow query", "ns": "foo.bar"}
+		result := make(map[string]string)
+
+		err := client.Post("/alerts", &result, BodyJSON(payload), Gzip())
+		So(err, ShouldBeNil)
+		So(encoding, ShouldEqual, "gzip")
+		So(result, ShouldResemble, payload)
+	})
+
+	Convey("Given a gzip body it can be read again", t, func() {
+		req, _ := http.NewRequest("POST", "http://localhost/", nil)
+		So(BodyText("hello hello hello")(req), ShouldBeNil)
+		So(Gzip()(req), ShouldBeNil)
+
+		first, _ := ioutil.ReadAll(req.Body)
+		again, err := req.GetBody()
+		So(err, ShouldBeNil)
+		second, _ := ioutil.ReadAll(again)
+		So(second, ShouldResemble, first)
+		So(req.ContentLength, ShouldEqual, len(first))
+	})
+
+	Convey("Given no body gzip does nothing", t, func() {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		So(Gzip()(req), ShouldBeNil)
+		So(req.Header.Get("Content-Encoding"), ShouldBeEmpty)
+	})
+}
+
+func TestPathParams(t *testing.T) {
+	Convey("Given a server recording the request path", t, func() {
+		var requestURI, path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestURI = r.RequestURI
+			path = r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+		client := NewClient(server.URL)
+
+		Convey("A value with a slash and a space is escaped into one segment", func() {
+			err := client.Get("/users/{user}/queries/{opid}", nil,
+				PathParams(map[string]string{"user": "ops/read only", "opid": "42"}))
+			So(err, ShouldBeNil)
+			So(requestURI, ShouldEqual, "/users/ops%2Fread%20only/queries/42")
+			So(path, ShouldEqual, "/users/ops/read only/queries/42")
+		})
+
+		Convey("Query parameters are kept", func() {
+			query := url.Values{}
+			query.Set("pretty", "true")
+			err := client.Get("/users/{user}", nil, PathParams(map[string]string{"user": "app"}), Query(query))
+			So(err, ShouldBeNil)
+			So(requestURI, ShouldEqual, "/users/app?pretty=true")
+		})
+
+		Convey("A missing parameter is an error", func() {
+			err := client.Get("/users/{user}", nil, PathParams(map[string]string{"opid": "1"}))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "user")
+		})
+	})
+}
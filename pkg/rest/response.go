@@ -2,13 +2,17 @@ package rest
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"time"
 
-	"github.com/gorilla/context"
 	"github.com/rs/zerolog/log"
 )
 
@@ -18,21 +22,81 @@ type ResponseOptionFunc func(resp *http.Response, result interface{}) error
 
 const bodyErrorStringLimit = 1024
 
+// DefaultMaxBodySize is the largest response body read by the decoding response options, unless the client sets
+// its own MaxBodySize
+const DefaultMaxBodySize int64 = 4 << 20
+
+// ErrBodyTooLarge is returned when a response body is larger than the max body size
+var ErrBodyTooLarge = errors.New("response body too large")
+
 // Error custom error message for json parsing error
 func NewJSONError(code int, body []byte, err error) *Error {
+	return newParseError(code, body, err)
+}
+
+// newParseError is the error for a response body that failed to decode
+func newParseError(code int, body []byte, err error) *Error {
 	if len(body) > bodyErrorStringLimit {
 		body = body[:bodyErrorStringLimit]
 	}
 	return &Error{StatusCode: code, Err: fmt.Errorf("failed to parse response [%v]: %v", string(body), err)}
 }
 
+// responseBody returns a reader for the response body, decompressing it if the server sent it gzipped and the
+// transport didn't transparently decode it (i.e. the caller set Accept-Encoding themselves)
+func responseBody(resp *http.Response) (io.Reader, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return resp.Body, nil
+	}
+	return gzip.NewReader(resp.Body)
+}
+
+// bufferedBody is a response body already read by readBody, left in place of resp.Body so the response options that
+// follow can read it again and a status check can put it on its Error
+type bufferedBody struct {
+	*bytes.Reader
+	content []byte
+}
+
+func (b *bufferedBody) Close() error {
+	return nil
+}
+
+// readBody reads the whole response body, up to the max body size of the client that made the request, and replaces
+// resp.Body with the content read. If body decompressed it the Content-Encoding is dropped, as the transport does.
+func readBody(resp *http.Response, body io.Reader) ([]byte, error) {
+	limit := DefaultMaxBodySize
+	if max := infoOf(resp.Request).maxBodySize; max > 0 {
+		limit = max
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return content, err
+	}
+	if int64(len(content)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	if body != resp.Body {
+		resp.Header.Del("Content-Encoding")
+	}
+	resp.Body = &bufferedBody{Reader: bytes.NewReader(content), content: content}
+	return content, nil
+}
+
 // ResponseJSON turns a rest client response into JSON
 func ResponseJSON(resp *http.Response, result interface{}) error {
 	defer resp.Body.Close()
 	if result == nil {
 		return nil
 	}
-	content, err := ioutil.ReadAll(resp.Body)
+	body, err := responseBody(resp)
+	if err != nil {
+		return NewJSONError(resp.StatusCode, nil, err)
+	}
+	content, err := readBody(resp, body)
+	if err == ErrBodyTooLarge {
+		return err
+	}
 	if err != nil {
 		return NewJSONError(resp.StatusCode, content, err)
 	}
@@ -45,6 +109,47 @@ func ResponseJSON(resp *http.Response, result interface{}) error {
 	return nil
 }
 
+// ResponseXML turns a rest client response into XML
+func ResponseXML(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	body, err := responseBody(resp)
+	if err != nil {
+		return newParseError(resp.StatusCode, nil, err)
+	}
+	content, err := readBody(resp, body)
+	if err == ErrBodyTooLarge {
+		return err
+	}
+	if err != nil {
+		return newParseError(resp.StatusCode, content, err)
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	if err := xml.Unmarshal(content, result); err != nil {
+		return newParseError(resp.StatusCode, content, err)
+	}
+	return nil
+}
+
+// ResponseContentType decodes the response with the decoder registered for its Content-Type, e.g.
+// ResponseContentType(map[string]ResponseOptionFunc{"application/xml": ResponseXML}, ResponseJSON), falling back to
+// fallback for any other or a missing content type. Use it in place of ResponseJSON.
+func ResponseContentType(decoders map[string]ResponseOptionFunc, fallback ResponseOptionFunc) ResponseOptionFunc {
+	return func(resp *http.Response, result interface{}) error {
+		mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err == nil {
+			if decoder, ok := decoders[mediaType]; ok {
+				return decoder(resp, result)
+			}
+		}
+		return fallback(resp, result)
+	}
+}
+
 // ResponseText turns a rest client response into a text string
 func ResponseText(resp *http.Response, result interface{}) error {
 	defer resp.Body.Close()
@@ -55,15 +160,21 @@ func ResponseText(resp *http.Response, result interface{}) error {
 	if !ok {
 		return fmt.Errorf("result is not a string pointer")
 	}
-	buf := new(bytes.Buffer)
-	n, err := buf.ReadFrom(resp.Body)
+	body, err := responseBody(resp)
 	if err != nil {
 		return fmt.Errorf("failed to read response body: %v", err)
 	}
-	if n == 0 {
+	content, err := readBody(resp, body)
+	if err == ErrBodyTooLarge {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+	if len(content) == 0 {
 		return fmt.Errorf("response body is empty")
 	}
-	*resultPtr = buf.String() // nolint:ineffassign
+	*resultPtr = string(content)
 	return nil
 }
 
@@ -89,25 +200,59 @@ func ResponseDebug(resp *http.Response, result interface{}) error {
 	return nil
 }
 
-// Error is a rest error, encapsulates the status code
+// ResponseCapture copies the raw response body into dst and restores it for the response options that follow, add it
+// with AddResponseOptions so it runs before the decoding
+func ResponseCapture(dst *[]byte) ResponseOptionFunc {
+	return func(resp *http.Response, result interface{}) error {
+		original := resp.Body
+		body, err := readBody(resp, resp.Body)
+		original.Close()
+		if err != nil {
+			return err
+		}
+		*dst = body
+		return nil
+	}
+}
+
+// Error is a rest error, encapsulates the status code and the error payload the server returned
 type Error struct {
 	StatusCode int
 	Response   *http.Response
 	Err        error
+	Body       []byte      // raw response body, if it was read by a decoding response option
+	Decoded    interface{} // the result the body was decoded into, e.g. a map of the API error fields
 }
 
 func (e *Error) Error() string {
 	return fmt.Sprintf("%d - %v", e.StatusCode, e.Err)
 }
 
+// newResponseError builds the error for an unexpected status, keeping the raw body and decoded result
+func newResponseError(resp *http.Response, result interface{}) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Response: resp, Decoded: result, Err: fmt.Errorf("%+v", result)}
+	if buffered, ok := resp.Body.(*bufferedBody); ok {
+		body := buffered.content
+		e.Body = body
+		if len(body) > bodyErrorStringLimit {
+			body = body[:bodyErrorStringLimit]
+		}
+		if len(body) > 0 {
+			e.Err = errors.New(string(body))
+		}
+	}
+	return e
+}
+
 // ResponseTimer logs the request duration
 func ResponseTimer(resp *http.Response, result interface{}) error {
-	start := context.Get(resp.Request, "start")
-	log.Info().
+	event := log.Info().
 		Str("request", resp.Request.URL.Path).
-		Str("method", resp.Request.Method).
-		Float64("duration_secs", time.Since(start.(time.Time)).Seconds()).
-		Msg("client request")
+		Str("method", resp.Request.Method)
+	if start := infoOf(resp.Request).start; !start.IsZero() {
+		event = event.Float64("duration_secs", time.Since(start).Seconds())
+	}
+	event.Msg("client request")
 	return nil
 }
 
@@ -120,7 +265,7 @@ func ResponseOK(ok ...int) ResponseOptionFunc {
 				return nil
 			}
 		}
-		return &Error{StatusCode: resp.StatusCode, Err: fmt.Errorf("%+v", result)}
+		return newResponseError(resp, result)
 	}
 }
 
@@ -130,11 +275,7 @@ func ResponseError(errors ...int) ResponseOptionFunc {
 	return func(resp *http.Response, result interface{}) error {
 		for _, err := range errors {
 			if resp.StatusCode == err {
-				return &Error{
-					StatusCode: resp.StatusCode,
-					Response:   resp,
-					Err:        fmt.Errorf("%+v", result),
-				}
+				return newResponseError(resp, result)
 			}
 		}
 		return nil
@@ -146,3 +287,22 @@ func ResponseError(errors ...int) ResponseOptionFunc {
 func ResponseOnlyOK() ResponseOptionFunc {
 	return ResponseOK(http.StatusOK, http.StatusCreated, http.StatusNoContent)
 }
+
+// ResponseExpect2xx treats any 2xx response as a success and anything else as an *Error carrying the status and the
+// raw body. It is the recommended status check, use it in place of ResponseOnlyOK rather than listing codes. It can
+// go before or after the decoding option, if the body hasn't been read yet it reads it for the error.
+func ResponseExpect2xx() ResponseOptionFunc {
+	return func(resp *http.Response, result interface{}) error {
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		if _, ok := resp.Body.(*bufferedBody); !ok {
+			defer resp.Body.Close()
+			body, err := responseBody(resp)
+			if err == nil {
+				readBody(resp, body)
+			}
+		}
+		return newResponseError(resp, result)
+	}
+}
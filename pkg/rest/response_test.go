@@ -2,9 +2,12 @@ package rest
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -74,3 +77,249 @@ func TestNilResultJSON(t *testing.T) {
 	})
 
 }
+
+func TestGzipResponse(t *testing.T) {
+	Convey("Given a server returning gzip encoded responses", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(`{"gzipped": true}`))
+			zw.Close()
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		acceptGzip := Header("Accept-Encoding", "gzip") // disables transparent decompression
+
+		Convey("JSON responses are decompressed", func() {
+			result := make(map[string]interface{})
+			So(client.Get("/gzip", &result, acceptGzip), ShouldBeNil)
+			So(result["gzipped"], ShouldEqual, true)
+		})
+
+		Convey("Text responses are decompressed", func() {
+			client.ResponseOptions = []ResponseOptionFunc{ResponseText}
+			var result string
+			So(client.Get("/gzip", &result, acceptGzip), ShouldBeNil)
+			So(result, ShouldEqual, `{"gzipped": true}`)
+		})
+
+		Convey("Transparent decompression still works", func() {
+			result := make(map[string]interface{})
+			So(client.Get("/gzip", &result), ShouldBeNil)
+			So(result["gzipped"], ShouldEqual, true)
+		})
+	})
+}
+
+func TestResponseCapture(t *testing.T) {
+	Convey("Given a server returning a payload", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "accepted", "dedup_key": "abc"}`))
+		}))
+		defer server.Close()
+
+		var raw []byte
+		client := NewClient(server.URL)
+		client.AddResponseOptions(ResponseCapture(&raw))
+
+		result := make(map[string]string)
+		So(client.Post("/webhook", &result), ShouldBeNil)
+
+		So(result["status"], ShouldEqual, "accepted")
+		So(string(raw), ShouldEqual, `{"status": "accepted", "dedup_key": "abc"}`)
+	})
+}
+
+func TestMaxBodySize(t *testing.T) {
+	Convey("Given a server returning a 64 byte body", t, func() {
+		body := `{"message":"` + strings.Repeat("x", 50) + `"}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+		client := NewClient(server.URL)
+
+		Convey("It is decoded under the default limit", func() {
+			var result map[string]string
+			So(client.Get("/", &result), ShouldBeNil)
+			So(result["message"], ShouldHaveLength, 50)
+		})
+
+		Convey("A body over the client limit fails with ErrBodyTooLarge", func() {
+			client.MaxBodySize = 32
+			var result map[string]string
+			So(client.Get("/", &result), ShouldEqual, ErrBodyTooLarge)
+
+			var text string
+			client.ResponseOptions = []ResponseOptionFunc{ResponseText}
+			So(client.Get("/", &text), ShouldEqual, ErrBodyTooLarge)
+		})
+
+		Convey("A body exactly at the limit is read", func() {
+			client.MaxBodySize = int64(len(body))
+			var result map[string]string
+			So(client.Get("/", &result), ShouldBeNil)
+		})
+	})
+}
+
+func TestErrorBody(t *testing.T) {
+	Convey("Given a server rejecting a request with a 422 and an error payload", t, func() {
+		payload := `{"code":"invalid","message":"validation failed","fields":["threshold"]}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(payload))
+		}))
+		defer server.Close()
+
+		var result map[string]interface{}
+		err := NewClient(server.URL).Post("/alerts", &result)
+		So(err, ShouldNotBeNil)
+
+		restErr, ok := err.(*Error)
+		So(ok, ShouldBeTrue)
+
+		Convey("The structured body is preserved", func() {
+			So(restErr.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			So(string(restErr.Body), ShouldEqual, payload)
+			decoded := *restErr.Decoded.(*map[string]interface{})
+			So(decoded["code"], ShouldEqual, "invalid")
+			So(decoded["fields"], ShouldResemble, []interface{}{"threshold"})
+		})
+
+		Convey("The error message shows the raw payload", func() {
+			So(err.Error(), ShouldEqual, "422 - "+payload)
+		})
+
+		Convey("The response body can still be read", func() {
+			body, err := ioutil.ReadAll(restErr.Response.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, payload)
+		})
+	})
+
+	Convey("Given a request redirected to a server rejecting it", t, func() {
+		payload := `{"code":"invalid"}`
+		mux := http.NewServeMux()
+		mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/alerts", http.StatusTemporaryRedirect)
+		})
+		mux.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(payload))
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		var result map[string]interface{}
+		err := NewClient(server.URL).Post("/old", &result)
+		restErr, ok := err.(*Error)
+		So(ok, ShouldBeTrue)
+
+		Convey("The body of the redirected request's response is on the error", func() {
+			So(restErr.Response.Request.URL.Path, ShouldEqual, "/alerts")
+			So(string(restErr.Body), ShouldEqual, payload)
+		})
+	})
+}
+
+func TestResponseExpect2xx(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Status int
+		Body   string
+		Error  bool
+	}{
+		{Name: "200 ok", Status: http.StatusOK, Body: `{"ok":true}`},
+		{Name: "202 accepted", Status: http.StatusAccepted, Body: `{"ok":true}`},
+		{Name: "204 no content", Status: http.StatusNoContent},
+		{Name: "404 not found", Status: http.StatusNotFound, Body: `{"error":"no such alert"}`, Error: true},
+		{Name: "500 html error page", Status: http.StatusInternalServerError, Body: `<html>oops</html>`, Error: true},
+	}
+
+	for _, test := range tests {
+		Convey("Given a server returning "+test.Name, t, func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.Status)
+				w.Write([]byte(test.Body))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL)
+			client.ResponseOptions = []ResponseOptionFunc{ResponseExpect2xx(), ResponseJSON}
+
+			var result map[string]interface{}
+			err := client.Get("/alerts/1", &result)
+			if !test.Error {
+				So(err, ShouldBeNil)
+				return
+			}
+			restErr, ok := err.(*Error)
+			So(ok, ShouldBeTrue)
+			So(restErr.StatusCode, ShouldEqual, test.Status)
+			So(string(restErr.Body), ShouldEqual, test.Body)
+		})
+	}
+
+	Convey("Given the check after the JSON decoding", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"no such alert"}`))
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.ResponseOptions = []ResponseOptionFunc{ResponseJSON, ResponseExpect2xx()}
+
+		var result map[string]interface{}
+		restErr, ok := client.Get("/alerts/1", &result).(*Error)
+		So(ok, ShouldBeTrue)
+		So(string(restErr.Body), ShouldEqual, `{"error":"no such alert"}`)
+		So(result["error"], ShouldEqual, "no such alert")
+	})
+}
+
+func TestContentNegotiation(t *testing.T) {
+	Convey("Given a server answering in the format it was asked for", t, func() {
+		var accept string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accept = r.Header.Get("Accept")
+			if r.URL.Path == "/xml" {
+				w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+				w.Write([]byte(`<alert><id>7</id><name>slow query</name></alert>`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":7,"name":"slow query"}`))
+		}))
+		defer server.Close()
+
+		type alert struct {
+			ID   int    `json:"id" xml:"id"`
+			Name string `json:"name" xml:"name"`
+		}
+
+		client := NewClient(server.URL)
+		client.ResponseOptions = []ResponseOptionFunc{
+			ResponseContentType(map[string]ResponseOptionFunc{"application/xml": ResponseXML}, ResponseJSON),
+			ResponseExpect2xx(),
+		}
+
+		Convey("The client asks for json by default", func() {
+			var result alert
+			So(client.Get("/json", &result), ShouldBeNil)
+			So(accept, ShouldEqual, "application/json")
+			So(result, ShouldResemble, alert{ID: 7, Name: "slow query"})
+		})
+
+		Convey("An xml response is routed to the xml decoder", func() {
+			var result alert
+			So(client.Get("/xml", &result, Accept("application/xml", "application/json")), ShouldBeNil)
+			So(accept, ShouldEqual, "application/xml, application/json")
+			So(result, ShouldResemble, alert{ID: 7, Name: "slow query"})
+		})
+	})
+}
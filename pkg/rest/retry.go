@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy retries requests that failed in the transport or got a 429 or 5xx gateway response. It waits for the
+// Retry-After the server asked for, capped at MaxRetryAfter, and falls back to exponential backoff otherwise.
+// Requests with a body are only retried if the body can be replayed, see http.Request.GetBody.
+type RetryPolicy struct {
+	MaxAttempts   int           // total attempts including the first
+	Backoff       time.Duration // wait before the first retry, doubled for each retry after
+	MaxBackoff    time.Duration // longest exponential backoff wait
+	MaxRetryAfter time.Duration // longest Retry-After wait honoured
+}
+
+// NewRetryPolicy creates a retry policy making up to attempts attempts with the default waits
+func NewRetryPolicy(attempts int) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:   attempts,
+		Backoff:       100 * time.Millisecond,
+		MaxBackoff:    10 * time.Second,
+		MaxRetryAfter: 30 * time.Second,
+	}
+}
+
+// retryable reports whether the outcome of an attempt is worth retrying
+func (p *RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return err != ErrCircuitOpen && !errors.Is(err, ErrRateLimited)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// wait returns how long to wait before the given retry, starting at 1
+func (p *RetryPolicy) wait(resp *http.Response, retry int, now time.Time) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			if d > p.MaxRetryAfter {
+				d = p.MaxRetryAfter
+			}
+			return d
+		}
+	}
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as a HTTP date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	at, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	d := at.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// IdempotencyKeyHeader is the header the server uses to spot a retried request it has already acted on
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyKey sets the Idempotency-Key header, sent unchanged with every retry of the request. With a retry policy
+// POST and PATCH requests get a random key if none is set.
+func IdempotencyKey(key string) RequestOptionFunc {
+	return func(req *http.Request) error {
+		req.Header.Set(IdempotencyKeyHeader, key)
+		return nil
+	}
+}
+
+// newIdempotencyKey generates a random key for a request that may be retried
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// needsIdempotencyKey reports whether the request can be retried but is not safe to repeat without a key
+func needsIdempotencyKey(req *http.Request) bool {
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return false
+	}
+	return req.Method == http.MethodPost || req.Method == http.MethodPatch
+}
+
+// send makes the request, retrying it according to the retry policy, if there is one
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.Retry != nil && c.Retry.MaxAttempts > 1 && needsIdempotencyKey(req) {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	for retry := 1; ; retry++ {
+		resp, err := c.attempt(req)
+		if c.Retry == nil || retry >= c.Retry.MaxAttempts || !c.Retry.retryable(resp, err) {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// the body has been consumed and can't be sent again
+			return resp, err
+		}
+
+		wait := c.Retry.wait(resp, retry, time.Now())
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package rest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryAfter(t *testing.T) {
+	Convey("Given a server that throttles the first request with Retry-After: 2", t, func() {
+		var calls int32
+		var bodies []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.Header().Set("Retry-After", "2")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Retry = NewRetryPolicy(3)
+
+		Convey("The client waits for the Retry-After before retrying with the same body", func() {
+			start := time.Now()
+			So(client.Post("/alerts", nil, BodyText("slow query")), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 2*time.Second)
+			So(time.Since(start), ShouldBeLessThan, 3*time.Second)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+			So(bodies, ShouldResemble, []string{"slow query", "slow query"})
+		})
+	})
+
+	Convey("Given a server that always fails", t, func() {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Retry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		Convey("The client gives up after the maximum attempts", func() {
+			So(client.Get("/", nil), ShouldNotBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+		})
+
+		Convey("A body that can't be replayed is not retried", func() {
+			So(client.Post("/", nil, BodyReader(strings.NewReader("slow query"))), ShouldNotBeNil)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	Convey("Given a server that fails the first two attempts", t, func() {
+		var keys []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+			if len(keys) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.Retry = &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		Convey("A supplied key is sent with every attempt", func() {
+			So(client.Post("/alerts", nil, BodyText("slow query"), IdempotencyKey("alert-1")), ShouldBeNil)
+			So(keys, ShouldResemble, []string{"alert-1", "alert-1", "alert-1"})
+		})
+
+		Convey("A generated key is the same for every attempt", func() {
+			So(client.Post("/alerts", nil, BodyText("slow query")), ShouldBeNil)
+			So(keys, ShouldHaveLength, 3)
+			So(keys[0], ShouldHaveLength, 32)
+			So(keys[1], ShouldEqual, keys[0])
+			So(keys[2], ShouldEqual, keys[0])
+
+			Convey("And a new request gets a new key", func() {
+				previous := keys[0]
+				keys = nil
+				So(client.Post("/alerts", nil, BodyText("slow query")), ShouldBeNil)
+				So(keys[0], ShouldHaveLength, 32)
+				So(keys[0], ShouldNotEqual, previous)
+			})
+		})
+
+		Convey("Idempotent methods don't get a key", func() {
+			So(client.Get("/alerts", nil), ShouldBeNil)
+			So(keys, ShouldResemble, []string{"", "", ""})
+		})
+
+		Convey("Without retries no key is generated", func() {
+			client.Retry = nil
+			So(client.Post("/alerts", nil, BodyText("slow query")), ShouldNotBeNil)
+			So(keys, ShouldResemble, []string{""})
+		})
+	})
+}
+
+func TestRetryWait(t *testing.T) {
+	now := time.Date(2021, 11, 12, 10, 0, 0, 0, time.UTC)
+	policy := NewRetryPolicy(5)
+	tests := []struct {
+		Name       string
+		RetryAfter string
+		Retry      int
+		Expected   time.Duration
+	}{
+		{Name: "retry after seconds", RetryAfter: "2", Retry: 1, Expected: 2 * time.Second},
+		{Name: "retry after http date", RetryAfter: now.Add(5 * time.Second).Format(http.TimeFormat), Retry: 1, Expected: 5 * time.Second},
+		{Name: "retry after in the past", RetryAfter: now.Add(-time.Minute).Format(http.TimeFormat), Retry: 1, Expected: 0},
+		{Name: "retry after capped", RetryAfter: "3600", Retry: 1, Expected: policy.MaxRetryAfter},
+		{Name: "invalid retry after backs off", RetryAfter: "soon", Retry: 1, Expected: 100 * time.Millisecond},
+		{Name: "exponential backoff", Retry: 3, Expected: 400 * time.Millisecond},
+		{Name: "backoff capped", Retry: 20, Expected: policy.MaxBackoff},
+	}
+
+	for _, test := range tests {
+		Convey("Given "+test.Name, t, func() {
+			resp := &http.Response{Header: http.Header{}}
+			if test.RetryAfter != "" {
+				resp.Header.Set("Retry-After", test.RetryAfter)
+			}
+			So(policy.wait(resp, test.Retry, now), ShouldEqual, test.Expected)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// BasicAuthMiddleware rejects requests that do not carry the given basic auth user and password
+func BasicAuthMiddleware(user, pass string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			u, p, ok := req.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
+)
+
+// BuildModule is a module compiled into the binary
+type BuildModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+// BuildInfoResponse is the build metadata served by the build info endpoint
+type BuildInfoResponse struct {
+	Version   string            `json:"version"`
+	GitHash   string            `json:"git_hash"`
+	Build     string            `json:"build"`
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path,omitempty"`
+	Main      BuildModule       `json:"main"`
+	Deps      []BuildModule     `json:"deps"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+// readBuildInfo combines the options build variables with the module and vcs metadata the go toolchain embeds
+func readBuildInfo() BuildInfoResponse {
+	info := BuildInfoResponse{
+		Version:   options.Version,
+		GitHash:   options.GitHash,
+		Build:     options.Build,
+		GoVersion: runtime.Version(),
+		Deps:      []BuildModule{},
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Path = bi.Path
+	info.Main = BuildModule{Path: bi.Main.Path, Version: bi.Main.Version, Sum: bi.Main.Sum}
+	for _, dep := range bi.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		info.Deps = append(info.Deps, BuildModule{Path: dep.Path, Version: dep.Version, Sum: dep.Sum})
+	}
+	// vcs.revision, vcs.time etc
+	if len(bi.Settings) > 0 {
+		info.Settings = make(map[string]string, len(bi.Settings))
+		for _, setting := range bi.Settings {
+			info.Settings[setting.Key] = setting.Value
+		}
+	}
+	return info
+}
+
+// BuildInfo installs a handler serving the go version, module versions and vcs revision the binary was built from
+func BuildInfo(r *mux.Router, route string) {
+	if route == "" {
+		route = "/build-info"
+	}
+	info := readBuildInfo()
+	r.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	})
+}
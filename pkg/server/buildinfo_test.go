@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBuildInfo(t *testing.T) {
+	Convey("Given the build info endpoint", t, func() {
+		r := mux.NewRouter()
+		BuildInfo(r, "/build-info")
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/build-info", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+		var info BuildInfoResponse
+		So(json.Unmarshal(rec.Body.Bytes(), &info), ShouldBeNil)
+
+		Convey("It reports the go version", func() {
+			So(info.GoVersion, ShouldEqual, runtime.Version())
+		})
+
+		Convey("It reports the main module and the build variables", func() {
+			So(info.Main.Path, ShouldEqual, "github.com/jeks313/go-mongo-slow-queries")
+			So(info.Version, ShouldEqual, "UNSET")
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// CompressMiddleware gzip or deflate compresses responses when the client accepts it. Routes starting with one of the
+// skip prefixes are never compressed, nor are server sent event streams, which the compressor would buffer, nor
+// requests that ask for Accept-Encoding: identity, e.g. when debugging with curl.
+func CompressMiddleware(skip ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		compressed := handlers.CompressHandler(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !compressible(req, skip) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			compressed.ServeHTTP(w, req)
+		})
+	}
+}
+
+// compressible reports whether the response to req may be compressed
+func compressible(req *http.Request, skip []string) bool {
+	for _, prefix := range skip {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return false
+		}
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, q := parseEncoding(encoding)
+		if (name == "gzip" || name == "deflate") && q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEncoding splits an Accept-Encoding entry such as "gzip;q=0.5" into its name and quality, 1 if not given
+func parseEncoding(encoding string) (string, float64) {
+	parts := strings.Split(encoding, ";")
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+	q := 1.0
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return name, q
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompressMiddleware(t *testing.T) {
+	Convey("Given a router with compression", t, func() {
+		body := strings.Repeat(`{"op":"query","ns":"shop.orders"},`, 100)
+
+		r := mux.NewRouter()
+		r.Use(CompressMiddleware("/export"))
+		r.HandleFunc("/history.json", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		r.HandleFunc("/export/history.csv", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "text/event-stream")
+			fmt.Fprint(w, "data: {}\n\n")
+			w.(http.Flusher).Flush()
+		})
+
+		get := func(path string, headers ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("Clients accepting gzip get gzip", func() {
+			w := get("/history.json", "Accept-Encoding", "gzip, deflate")
+			So(w.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(w.Body.Len(), ShouldBeLessThan, len(body))
+		})
+
+		Convey("Identity requests get plain output", func() {
+			for _, encoding := range []string{"identity", "identity, gzip;q=0", ""} {
+				w := get("/history.json", "Accept-Encoding", encoding)
+				So(w.Header().Get("Content-Encoding"), ShouldEqual, "")
+				So(w.Body.String(), ShouldEqual, body)
+			}
+		})
+
+		Convey("Skipped routes are never compressed", func() {
+			w := get("/export/history.csv", "Accept-Encoding", "gzip")
+			So(w.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(w.Body.String(), ShouldEqual, body)
+		})
+
+		Convey("Event streams are flushed straight through uncompressed", func() {
+			w := get("/events", "Accept", "text/event-stream", "Accept-Encoding", "gzip")
+			So(w.Flushed, ShouldBeTrue)
+			So(w.Header().Get("Content-Encoding"), ShouldEqual, "")
+			So(w.Body.String(), ShouldEqual, "data: {}\n\n")
+		})
+	})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
+)
+
+// Config serves the effective configuration, the go-flags options struct opts with its secrets redacted, see
+// options.Redact. It is under the debug subtree so pass the same middleware (e.g. BasicAuthMiddleware) as Profiling.
+func Config(r *mux.Router, route string, opts interface{}, middleware ...mux.MiddlewareFunc) {
+	r.Handle(route, Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		status := http.StatusOK
+		if err := enc.Encode(options.Redact(opts)); err != nil {
+			slog.Error("failed to encode config", "path", r.URL.Path, "error", err)
+			buf.Reset()
+			json.NewEncoder(&buf).Encode(map[string]string{"error": "failed to encode config: " + err.Error()})
+			status = http.StatusInternalServerError
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			slog.Warn("failed to write config", "path", r.URL.Path, "error", err)
+		}
+	}), middleware...))
+}
+
+// Chain wraps a single handler in middleware, the first outermost, to protect a route without a subrouter
+func Chain(handler http.Handler, middleware ...mux.MiddlewareFunc) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
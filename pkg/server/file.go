@@ -2,40 +2,89 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha1"
+	_ "embed"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log/slog"
+	"mime"
 	"net/http"
+	"path"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
 )
 
-// File serves up a file, optionally transforming it with a TransformFunc
+//go:embed markdown.css
+var markdownCSS string
+
+// File serves up a file, use FileTransform to apply FormatFuncs to it first. The content type comes from the filename
+// extension, or is sniffed from the contents, and an ETag and Last-Modified are set so browsers can cache it.
 func File(r *mux.Router, filename string, b *bytes.Buffer) {
-	r.Handle(filename, fileHandler(b))
+	r.Handle(filename, fileHandler(filename, b.Bytes()))
+}
+
+// FileTransform serves up a file after applying each of the FormatFuncs to it in order. If the file can't be read the
+// route isn't registered, so a truncated file is never served and cached.
+func FileTransform(r *mux.Router, filename string, src io.Reader, funcs ...FormatFunc) error {
+	for _, f := range funcs {
+		src = f(src)
+	}
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		slog.Error("failed to read transformed file", "filename", filename, "error", err)
+		return err
+	}
+	r.Handle(filename, fileHandler(filename, data))
+	return nil
 }
 
-func fileHandler(b *bytes.Buffer) http.Handler {
+func fileHandler(filename string, data []byte) http.Handler {
+	contentType := fileContentType(filename, data)
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(data))
+	modified := time.Now()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Content-Type", "text/html")
-		w.Write(b.Bytes())
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, filename, modified, bytes.NewReader(data))
 	})
 }
 
+// fileContentType works out the content type from the extension, markdown is served rendered so is sniffed
+func fileContentType(filename string, data []byte) string {
+	ext := path.Ext(filename)
+	if ext != ".md" && ext != ".markdown" {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+	return http.DetectContentType(data)
+}
+
 // FormatFunc functions are used to apply transformations to file data, such as applying templates
 type FormatFunc func(io.Reader) io.Reader
 
-// FormatMarkdown takes a markdown file and applies the js template to auto-render it
-func FormatMarkdown(f io.Reader) *bytes.Buffer {
+// FormatMarkdown takes a markdown file and renders it to a self contained HTML page, the styling is embedded so it
+// works without any external assets
+func FormatMarkdown(f io.Reader) io.Reader {
 	buf := bytes.NewBuffer([]byte(""))
 	contents, err := ioutil.ReadAll(f)
 	if err != nil {
 		slog.Error("failed to read input for formatting", "error", err)
 		return buf
 	}
-	header := `<!DOCTYPE html><html><title>Docs</title><xmp theme="cerulean" style="display:block;">`
-	footer := `</xmp><script src="http://strapdownjs.com/v/0.2/strapdown.js"></script></html>`
-	buf.WriteString(fmt.Sprintf("%s\n%s\n%s\n", header, contents, footer))
+	body := new(bytes.Buffer)
+	if err := markdown.Convert(contents, body); err != nil {
+		slog.Error("failed to render markdown", "error", err)
+		return buf
+	}
+	header := `<!DOCTYPE html><html><head><meta charset="utf-8"><title>Docs</title><style>`
+	buf.WriteString(fmt.Sprintf("%s\n%s</style></head><body><article>\n%s</article></body></html>\n", header, markdownCSS, body))
 	return buf
 }
+
+// markdown renders github flavoured markdown, raw HTML in the source is not passed through
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFile(t *testing.T) {
+	Convey("Given css, json and markdown files", t, func() {
+		r := mux.NewRouter()
+		File(r, "/static/style.css", bytes.NewBufferString("body { color: red; }"))
+		File(r, "/static/data.json", bytes.NewBufferString(`{"ok": true}`))
+		So(FileTransform(r, "/README.md", strings.NewReader("# Docs"), FormatMarkdown), ShouldBeNil)
+
+		get := func(path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			return rec
+		}
+
+		Convey("The content type matches the file", func() {
+			So(get("/static/style.css").Header().Get("Content-Type"), ShouldStartWith, "text/css")
+			So(get("/static/data.json").Header().Get("Content-Type"), ShouldStartWith, "application/json")
+			So(get("/README.md").Header().Get("Content-Type"), ShouldStartWith, "text/html")
+			So(get("/static/style.css").Body.String(), ShouldEqual, "body { color: red; }")
+		})
+
+		Convey("Caching headers are set", func() {
+			rec := get("/static/style.css")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("ETag"), ShouldNotBeEmpty)
+			So(rec.Header().Get("Last-Modified"), ShouldNotBeEmpty)
+		})
+
+		Convey("A matching ETag gets a 304", func() {
+			etag := get("/static/style.css").Header().Get("ETag")
+
+			req := httptest.NewRequest("GET", "/static/style.css", nil)
+			req.Header.Set("If-None-Match", etag)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotModified)
+			So(rec.Body.Len(), ShouldEqual, 0)
+
+			req = httptest.NewRequest("GET", "/static/style.css", nil)
+			req.Header.Set("If-None-Match", `"stale"`)
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestFormatMarkdown(t *testing.T) {
+	Convey("Given a markdown snippet", t, func() {
+		md := FormatMarkdown(strings.NewReader("# Slow Queries\n\nSee `/running` for the *current* list.\n\n| a | b |\n|---|---|\n| 1 | 2 |\n"))
+		b, _ := ioutil.ReadAll(md)
+		out := string(b)
+
+		So(out, ShouldStartWith, "<!DOCTYPE html>")
+		So(out, ShouldContainSubstring, "<h1>Slow Queries</h1>")
+		So(out, ShouldContainSubstring, "<code>/running</code>")
+		So(out, ShouldContainSubstring, "<em>current</em>")
+		So(out, ShouldContainSubstring, "<table>")
+		So(out, ShouldContainSubstring, "<style>")
+		So(out, ShouldNotContainSubstring, "<script")
+		So(out, ShouldNotContainSubstring, "http://")
+	})
+}
+
+func TestFileTransform(t *testing.T) {
+	Convey("Given two chained transforms", t, func() {
+		upper := func(f io.Reader) io.Reader {
+			b, _ := ioutil.ReadAll(f)
+			return bytes.NewReader(bytes.ToUpper(b))
+		}
+		wrap := func(f io.Reader) io.Reader {
+			b, _ := ioutil.ReadAll(f)
+			return io.MultiReader(strings.NewReader("before "), bytes.NewReader(b), strings.NewReader(" after"))
+		}
+
+		r := mux.NewRouter()
+		So(FileTransform(r, "/upper-then-wrap.txt", strings.NewReader("text"), upper, wrap), ShouldBeNil)
+		So(FileTransform(r, "/wrap-then-upper.txt", strings.NewReader("text"), wrap, upper), ShouldBeNil)
+		So(FileTransform(r, "/plain.txt", strings.NewReader("text")), ShouldBeNil)
+
+		get := func(path string) string {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			return rec.Body.String()
+		}
+
+		So(get("/upper-then-wrap.txt"), ShouldEqual, "before TEXT after")
+		So(get("/wrap-then-upper.txt"), ShouldEqual, "BEFORE TEXT AFTER")
+		So(get("/plain.txt"), ShouldEqual, "text")
+	})
+
+	Convey("Given a file that fails part way through reading", t, func() {
+		r := mux.NewRouter()
+		src := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("read failed")))
+		So(FileTransform(r, "/truncated.txt", src), ShouldNotBeNil)
+
+		Convey("The truncated file isn't served", func() {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/truncated.txt", nil))
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+			So(rec.Header().Get("ETag"), ShouldBeEmpty)
+		})
+	})
+}
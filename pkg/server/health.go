@@ -13,3 +13,15 @@ func Health(r *mux.Router, route string, dependencies ...*health.Dependency) {
 
 	r.PathPrefix(route).Handler(health.WebHandler())
 }
+
+// HealthResetStats installs a POST handler zeroing the health stats, e.g. on /health/reset-stats. Only install it when
+// explicitly enabled, and before Health so the health route prefix doesn't shadow it.
+func HealthResetStats(r *mux.Router, route string) {
+	r.Handle(route, health.ResetStatsHandler())
+}
+
+// HealthStartup installs the startup probe, e.g. on /health/startup. Install it before Health so the health route
+// prefix doesn't shadow it.
+func HealthStartup(r *mux.Router, route string) {
+	r.Handle(route, health.StartupHandler())
+}
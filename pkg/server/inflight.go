@@ -0,0 +1,20 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InFlightMiddleware tracks the number of requests currently being served in gauge, e.g. to spot slow handlers piling
+// up. Create the gauge as http_requests_in_flight so it matches the other http server metrics.
+func InFlightMiddleware(gauge prometheus.Gauge) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gauge.Inc()
+			defer gauge.Dec()
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInFlightMiddleware(t *testing.T) {
+	Convey("Given a handler that blocks until released", t, func() {
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "http_requests_in_flight"})
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		r := mux.NewRouter()
+		r.Use(InFlightMiddleware(gauge))
+		r.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})
+
+		done := make(chan struct{})
+		for i := 0; i < 2; i++ {
+			go func() {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/history", nil))
+				done <- struct{}{}
+			}()
+		}
+		<-started
+		<-started
+
+		Convey("The gauge counts the blocked requests and falls once they complete", func() {
+			So(testutil.ToFloat64(gauge), ShouldEqual, 2)
+			close(release)
+			<-done
+			<-done
+			So(testutil.ToFloat64(gauge), ShouldEqual, 0)
+		})
+	})
+}
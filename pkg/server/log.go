@@ -1,25 +1,62 @@
 package server
 
 import (
-  "bufio"
+	"bufio"
 	"container/ring"
-  "errors"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
-  "net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 )
 
-// LogBuffer buffers the last number of log lines for the log output handler
+// LogBuffer buffers the last number of log lines at or above a level, add it to a logger's output with
+// zerolog.MultiLevelWriter
 type LogBuffer struct {
-	buf *ring.Ring
+	mu    sync.Mutex
+	buf   *ring.Ring
+	level zerolog.Level
 }
 
-// Run is the zerolog hook to install
-func (h *LogBuffer) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+// NewLogBuffer creates a log buffer keeping the last length lines logged at level or above
+func NewLogBuffer(length int, level zerolog.Level) *LogBuffer {
+	return &LogBuffer{buf: ring.New(length), level: level}
+}
+
+// Write buffers a log line regardless of its level
+func (h *LogBuffer) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	h.mu.Lock()
+	h.buf.Value = line
+	h.buf = h.buf.Next()
+	h.mu.Unlock()
+	return len(p), nil
+}
+
+// WriteLevel buffers a log line if it is at or above the buffer's level
+func (h *LogBuffer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < h.level {
+		return len(p), nil
+	}
+	return h.Write(p)
+}
+
+// Lines returns the buffered log lines, oldest first
+func (h *LogBuffer) Lines() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lines := []string{}
+	h.buf.Do(func(v interface{}) {
+		if line, ok := v.(string); ok {
+			lines = append(lines, line)
+		}
+	})
+	return lines
 }
 
 // LogHandler sets up a log circular buffer and serves this on the given router
@@ -43,18 +80,18 @@ func newStatusReponseWriter(w http.ResponseWriter) *statusResponseWriter {
 
 // Flush re-implement the flusher
 func (s *statusResponseWriter) Flush() {
-  if f, ok := s.ResponseWriter.(http.Flusher); ok {
-    f.Flush()
-  }
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 // Hijack re-implement the hijack interface
 func (s *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-    h, ok := s.ResponseWriter.(http.Hijacker)
-    if !ok {
-        return nil, nil, errors.New("hijack not supported")
-    }
-    return h.Hijack()
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
 }
 
 func (s *statusResponseWriter) Write(data []byte) (n int, err error) {
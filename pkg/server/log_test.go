@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogBuffer(t *testing.T) {
+	Convey("Given a logger writing to an error level log buffer of 2 lines", t, func() {
+		buffer := NewLogBuffer(2, zerolog.ErrorLevel)
+		log := zerolog.New(buffer)
+
+		Convey("It is empty before anything is logged", func() {
+			So(buffer.Lines(), ShouldBeEmpty)
+		})
+
+		Convey("It keeps only the last error lines, oldest first", func() {
+			log.Error().Msg("first")
+			log.Info().Msg("ignored")
+			log.Error().Msg("second")
+			log.Error().Msg("third")
+
+			So(buffer.Lines(), ShouldResemble, []string{
+				`{"level":"error","message":"second"}`,
+				`{"level":"error","message":"third"}`,
+			})
+		})
+	})
+}
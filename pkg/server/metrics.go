@@ -2,13 +2,32 @@ package server
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// OpenMetrics serves the OpenMetrics format to scrapers that ask for it in their Accept header, the rest still get
+// the prometheus text format
+var OpenMetrics = true
+
 // Metrics installs the prometheus handler for the metrics endpoint
 func Metrics(r *mux.Router, route string) {
 	if route == "" {
 		route = "/metrics"
 	}
-	r.Handle(route, promhttp.Handler())
+	r.Handle(route, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, metricsHandlerOpts())))
+}
+
+// MetricsWithRegistry installs a prometheus handler for the metrics endpoint that only serves the metrics registered
+// on reg, leaving the global default registry out of it. Pass prometheus.Gatherers to serve several registries.
+func MetricsWithRegistry(r *mux.Router, route string, reg prometheus.Gatherer) {
+	if route == "" {
+		route = "/metrics"
+	}
+	r.Handle(route, promhttp.HandlerFor(reg, metricsHandlerOpts()))
+}
+
+func metricsHandlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{EnableOpenMetrics: OpenMetrics}
 }
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricsWithRegistry(t *testing.T) {
+	Convey("Given a custom registry with one counter", t, func() {
+		reg := prometheus.NewRegistry()
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_scrapes_total", Help: "test counter"})
+		reg.MustRegister(counter)
+		counter.Inc()
+
+		r := mux.NewRouter()
+		MetricsWithRegistry(r, "/metrics", reg)
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+
+		Convey("Only the registered series are served", func() {
+			body := rec.Body.String()
+			So(body, ShouldContainSubstring, "test_scrapes_total 1")
+			So(body, ShouldNotContainSubstring, "go_goroutines")
+			So(body, ShouldNotContainSubstring, "process_")
+		})
+	})
+}
+
+func TestOpenMetrics(t *testing.T) {
+	Convey("Given the metrics endpoint", t, func() {
+		reg := prometheus.NewRegistry()
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_scrapes_total", Help: "test counter"})
+		reg.MustRegister(counter)
+
+		get := func(accept string) *httptest.ResponseRecorder {
+			r := mux.NewRouter()
+			MetricsWithRegistry(r, "/metrics", reg)
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.Header.Set("Accept", accept)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			return rec
+		}
+		openMetrics := "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+		Convey("A scraper asking for OpenMetrics gets it", func() {
+			rec := get(openMetrics)
+			So(rec.Header().Get("content-type"), ShouldStartWith, "application/openmetrics-text")
+			So(rec.Body.String(), ShouldContainSubstring, "# EOF")
+		})
+
+		Convey("Other scrapers get the text format", func() {
+			So(get("text/plain").Header().Get("content-type"), ShouldStartWith, "text/plain")
+		})
+
+		Convey("OpenMetrics can be turned off", func() {
+			defer func() { OpenMetrics = true }()
+			OpenMetrics = false
+			So(get(openMetrics).Header().Get("content-type"), ShouldStartWith, "text/plain")
+		})
+	})
+}
+
+func TestMetricsWithGatherers(t *testing.T) {
+	Convey("Given the runtime metrics in one registry and the mongo metrics in another", t, func() {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(prometheus.NewGoCollector())
+		mongoReg := prometheus.NewRegistry()
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "mongo_slow_query_ms", Help: "test counter"})
+		mongoReg.MustRegister(counter)
+		counter.Add(5)
+
+		r := mux.NewRouter()
+		MetricsWithRegistry(r, "/metrics", prometheus.Gatherers{reg, mongoReg})
+		MetricsWithRegistry(r, "/metrics/mongo", mongoReg)
+		get := func(url string) string {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			return rec.Body.String()
+		}
+
+		Convey("The full endpoint serves both", func() {
+			body := get("/metrics")
+			So(body, ShouldContainSubstring, "mongo_slow_query_ms 5")
+			So(body, ShouldContainSubstring, "go_goroutines")
+		})
+
+		Convey("The filtered endpoint serves just the mongo metrics", func() {
+			body := get("/metrics/mongo")
+			So(body, ShouldContainSubstring, "mongo_slow_query_ms 5")
+			So(body, ShouldNotContainSubstring, "# TYPE go_")
+		})
+	})
+}
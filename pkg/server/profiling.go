@@ -3,23 +3,28 @@ package server
 import (
 	"net/http"
 	"net/http/pprof"
-	"path"
 
 	"github.com/gorilla/mux"
 )
 
-// Profiling installs the go default profiling endpoints
-func Profiling(r *mux.Router, route string) {
+// Profiling installs the go default profiling endpoints, any middleware (e.g. BasicAuthMiddleware) wraps the whole
+// profiling subtree
+func Profiling(r *mux.Router, route string, middleware ...mux.MiddlewareFunc) {
+	// routes on the subrouter are relative to the profiling route
+	s := r.PathPrefix(route).Subrouter()
+	s.Use(middleware...)
+
 	// add the profiling endpoints
-	r.Handle(path.Join(route, "/"), http.HandlerFunc(pprof.Index))
-	r.Handle(path.Join(route, "/profile"), http.HandlerFunc(pprof.Profile))
-	r.Handle(path.Join(route, "/cmdline"), http.HandlerFunc(pprof.Cmdline))
-	r.Handle(path.Join(route, "/trace"), http.HandlerFunc(pprof.Trace))
-	r.Handle(path.Join(route, "/symbol"), http.HandlerFunc(pprof.Symbol))
+	s.Handle("/", http.HandlerFunc(pprof.Index))
+	s.Handle("/profile", http.HandlerFunc(pprof.Profile))
+	s.Handle("/cmdline", http.HandlerFunc(pprof.Cmdline))
+	s.Handle("/trace", http.HandlerFunc(pprof.Trace))
+	s.Handle("/symbol", http.HandlerFunc(pprof.Symbol))
 
-	r.Handle(path.Join(route, "mutex"), pprof.Handler("mutex"))
-	r.Handle(path.Join(route, "heap"), pprof.Handler("heap"))
-	r.Handle(path.Join(route, "goroutine"), pprof.Handler("goroutine"))
-	r.Handle(path.Join(route, "block"), pprof.Handler("block"))
-	r.Handle(path.Join(route, "threadcreate"), pprof.Handler("threadcreate"))
+	s.Handle("/mutex", pprof.Handler("mutex"))
+	s.Handle("/heap", pprof.Handler("heap"))
+	s.Handle("/allocs", pprof.Handler("allocs"))
+	s.Handle("/goroutine", pprof.Handler("goroutine"))
+	s.Handle("/block", pprof.Handler("block"))
+	s.Handle("/threadcreate", pprof.Handler("threadcreate"))
 }
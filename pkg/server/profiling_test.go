@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProfiling(t *testing.T) {
+	Convey("Given the open profiling endpoints", t, func() {
+		r := mux.NewRouter()
+		Profiling(r, "/debug/pprof")
+
+		Convey("The allocs profile is registered", func() {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?debug=1", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldContainSubstring, "heap profile")
+		})
+	})
+
+	Convey("Given profiling endpoints behind basic auth", t, func() {
+		r := mux.NewRouter()
+		Profiling(r, "/debug/pprof", BasicAuthMiddleware("ops", "secret"))
+		r.HandleFunc("/running", func(w http.ResponseWriter, r *http.Request) {})
+
+		Convey("Requests without credentials are rejected", func() {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?debug=1", nil))
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+			So(rec.Header().Get("WWW-Authenticate"), ShouldStartWith, "Basic")
+		})
+
+		Convey("Requests with the wrong password are rejected", func() {
+			req := httptest.NewRequest("GET", "/debug/pprof/heap?debug=1", nil)
+			req.SetBasicAuth("ops", "guess")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Requests with credentials are served", func() {
+			req := httptest.NewRequest("GET", "/debug/pprof/allocs?debug=1", nil)
+			req.SetBasicAuth("ops", "secret")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Routes outside the profiling subtree are not affected", func() {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/running", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
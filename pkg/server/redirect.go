@@ -1,18 +1,40 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 // Redirect takes one path and redirects it to another
 func Redirect(r *mux.Router, from, to string) {
-	r.Handle(from, redirectHandler(to))
+	RedirectWithStatus(r, from, to, http.StatusPermanentRedirect)
 }
 
-func redirectHandler(path string) http.Handler {
+// RedirectWithStatus takes one path and redirects it to another with the given redirect status code, the incoming
+// query string is kept. Panics if code is not one of 301, 302, 303, 307 or 308.
+func RedirectWithStatus(r *mux.Router, from, to string, code int) {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		panic(fmt.Sprintf("server: invalid redirect status code %d", code))
+	}
+	r.Handle(from, redirectHandler(to, code))
+}
+
+func redirectHandler(path string, code int) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		http.Redirect(res, req, path, http.StatusPermanentRedirect)
+		target := path
+		if req.URL.RawQuery != "" {
+			if strings.Contains(target, "?") {
+				target += "&" + req.URL.RawQuery
+			} else {
+				target += "?" + req.URL.RawQuery
+			}
+		}
+		http.Redirect(res, req, target, code)
 	})
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedirect(t *testing.T) {
+	Convey("Given the default redirect", t, func() {
+		r := mux.NewRouter()
+		Redirect(r, "/", "/running")
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/?pretty=true", nil))
+		So(rec.Code, ShouldEqual, http.StatusPermanentRedirect)
+		So(rec.Header().Get("Location"), ShouldEqual, "/running?pretty=true")
+	})
+
+	codes := []int{
+		http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect,
+	}
+	for _, code := range codes {
+		Convey(fmt.Sprintf("Given a redirect with status %d", code), t, func() {
+			r := mux.NewRouter()
+			RedirectWithStatus(r, "/old", "/new?tab=history", code)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/old?ns=foo.bar&user=app", nil))
+			So(rec.Code, ShouldEqual, code)
+			So(rec.Header().Get("Location"), ShouldEqual, "/new?tab=history&ns=foo.bar&user=app")
+
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest("GET", "/old", nil))
+			So(rec.Header().Get("Location"), ShouldEqual, "/new?tab=history")
+		})
+	}
+
+	Convey("Given a status code that is not a redirect", t, func() {
+		r := mux.NewRouter()
+		So(func() { RedirectWithStatus(r, "/old", "/new", http.StatusOK) }, ShouldPanic)
+		So(func() { RedirectWithStatus(r, "/old", "/new", http.StatusNotModified) }, ShouldPanic)
+	})
+}
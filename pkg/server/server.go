@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
+)
+
+// Server is an http server that serves https when it has a certificate
+type Server struct {
+	*http.Server
+	certFile string
+	keyFile  string
+}
+
+// NewServer creates the http server for the handler configured from the http options, offering HTTP/2 ahead of
+// HTTP/1.1 when serving TLS
+func NewServer(addr string, handler http.Handler, opts options.HTTPOptions) *Server {
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    opts.ReadTimeout,
+		WriteTimeout:   opts.WriteTimeout,
+		IdleTimeout:    opts.IdleTimeout,
+		MaxHeaderBytes: opts.MaxHeaderBytes,
+	}
+	if opts.TLS() {
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+	}
+	return &Server{Server: srv, certFile: opts.TLSCert, keyFile: opts.TLSKey}
+}
+
+// ListenAndServe serves https with the certificate if there is one, plain http otherwise
+func (s *Server) ListenAndServe() error {
+	if s.certFile != "" {
+		return s.Server.ListenAndServeTLS(s.certFile, s.keyFile)
+	}
+	return s.Server.ListenAndServe()
+}
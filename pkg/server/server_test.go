@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jeks313/go-mongo-slow-queries/pkg/options"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewServer(t *testing.T) {
+	opts := options.HTTPOptions{
+		ReadTimeout:    5 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		IdleTimeout:    2 * time.Minute,
+		MaxHeaderBytes: 8192,
+	}
+
+	Convey("Given http options without a certificate", t, func() {
+		srv := NewServer(":8172", http.NotFoundHandler(), opts)
+
+		Convey("The server is configured from them", func() {
+			So(srv.Addr, ShouldEqual, ":8172")
+			So(srv.ReadTimeout, ShouldEqual, 5*time.Second)
+			So(srv.WriteTimeout, ShouldEqual, 30*time.Second)
+			So(srv.IdleTimeout, ShouldEqual, 2*time.Minute)
+			So(srv.MaxHeaderBytes, ShouldEqual, 8192)
+			So(srv.TLSConfig, ShouldBeNil)
+		})
+	})
+
+	Convey("Given http options with a certificate", t, func() {
+		tlsOpts := opts
+		tlsOpts.TLSCert, tlsOpts.TLSKey = "server.crt", "server.key"
+		srv := NewServer(":8172", http.NotFoundHandler(), tlsOpts)
+
+		Convey("HTTP/2 is offered", func() {
+			So(srv.TLSConfig, ShouldNotBeNil)
+			So(srv.TLSConfig.NextProtos, ShouldResemble, []string{"h2", "http/1.1"})
+		})
+
+		Convey("A missing certificate fails to serve", func() {
+			So(srv.ListenAndServe(), ShouldNotBeNil)
+		})
+	})
+}